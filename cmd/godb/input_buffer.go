@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+
+type InputBuffer struct {
+	buffer        string
+	buffer_length int
+	input_length  int
+	reader        *bufio.Reader
+}
+
+func new_input_buffer() *InputBuffer {
+	return &InputBuffer{
+		buffer:        "",
+		buffer_length: 0,
+		input_length:  0,
+		reader:        bufio.NewReader(os.Stdin),
+	}
+}
+
+func close_input_buffer(input_buffer *InputBuffer) {
+	input_buffer = nil
+}
+
+func print_prompt() { fmt.Print("db > ") }
+
+// read_input reads one line into the buffer. It returns false once stdin is exhausted.
+func read_input(input_buffer *InputBuffer) bool {
+	input, err := input_buffer.reader.ReadString('\n')
+	if err != nil && len(input) == 0 {
+		return false
+	}
+	input = strings.TrimSuffix(input, "\n")
+	input_buffer.buffer = input
+	input_buffer.input_length = len(input)
+	return true
+}
\ No newline at end of file
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorogoroumaru/godb"
+)
+
+func main() {
+	options := godb.Options{}
+	flag.IntVar(&options.CachePages, "cache", godb.DEFAULT_CACHE_PAGES, "number of pages kept in the buffer pool")
+	journal_mode := flag.String("journal", "wal", "journal mode: wal or delete")
+	flag.IntVar(&options.SortMemory, "sort-memory", godb.DEFAULT_SORT_MEMORY, "bytes of rows a sort keeps in memory before spilling to temporary files")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Must supply a database filename.")
+		os.Exit(1)
+	}
+	if options.CachePages < 1 {
+		fmt.Println("The cache must hold at least one page.")
+		os.Exit(1)
+	}
+	if options.SortMemory < 1 {
+		fmt.Println("The sort memory must be at least one byte.")
+		os.Exit(1)
+	}
+	switch *journal_mode {
+	case "wal":
+		options.JournalMode = godb.JOURNAL_MODE_WAL
+	case "delete":
+		options.JournalMode = godb.JOURNAL_MODE_DELETE
+	default:
+		fmt.Println("The journal mode must be wal or delete.")
+		os.Exit(1)
+	}
+
+	filename := flag.Arg(0)
+	db, err := godb.Open(filename, &options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	input_buffer := new_input_buffer()
+
+	for {
+		print_prompt()
+		if !read_input(input_buffer) {
+			close_input_buffer(input_buffer)
+			if err := db.Close(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if len(input_buffer.buffer) == 0 {
+			continue
+		}
+
+		if string(input_buffer.buffer[0]) == "." {
+			switch do_meta_command(input_buffer, db) {
+			case META_COMMAND_SUCCESS:
+				fmt.Println("success")
+				continue
+			case META_COMMAND_UNRECOGNIZED_COMMAND:
+				fmt.Printf("unrecognized command")
+				continue
+			}
+		}
+
+		rows, err := db.Query(input_buffer.buffer)
+		var statement_error *godb.Error
+		if errors.As(err, &statement_error) && !statement_error.Ran() {
+			fmt.Println(err)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			print_rows(rows)
+			fmt.Println("Executed")
+		}
+		fmt.Println("execution finished")
+	}
+}
+
+// print_rows prints each row as "(value, ...)". The lines of an explain are
+// printed as they are.
+func print_rows(rows *godb.Rows) {
+	for rows.Next() {
+		values := rows.Values()
+		if rows.Explain() {
+			fmt.Println(values[0])
+			continue
+		}
+		fields := make([]string, len(values))
+		for i, value := range values {
+			fields[i] = value.String()
+		}
+		fmt.Printf("(%s)\n", strings.Join(fields, ", "))
+	}
+	rows.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorogoroumaru/godb"
+)
+
+
+const (
+	META_COMMAND_SUCCESS = 0
+	META_COMMAND_UNRECOGNIZED_COMMAND = 1
+)
+
+func do_meta_command(input_buffer *InputBuffer, db *godb.DB) int {
+	if input_buffer.buffer == ".exit" {
+		close_input_buffer(input_buffer)
+		if err := db.Close(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	} else if strings.HasPrefix(input_buffer.buffer, ".btree ") {
+		name := strings.TrimSpace(strings.TrimPrefix(input_buffer.buffer, ".btree "))
+		var tree strings.Builder
+		if err := db.WriteTree(&tree, name); errors.Is(err, godb.ErrNoTable) {
+			fmt.Println("No such table.")
+			return META_COMMAND_SUCCESS
+		} else if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return META_COMMAND_SUCCESS
+		}
+		fmt.Println("Tree: ")
+		fmt.Print(tree.String())
+		return META_COMMAND_SUCCESS
+	} else if input_buffer.buffer == ".tables" {
+		for _, name := range db.Tables() {
+			fmt.Println(name)
+		}
+		return META_COMMAND_SUCCESS
+	} else if input_buffer.buffer == ".vacuum" {
+		num_pages, vacuumed_pages, err := db.Vacuum()
+		if errors.Is(err, godb.ErrInTransaction) {
+			fmt.Println("Cannot vacuum inside a transaction.")
+			return META_COMMAND_SUCCESS
+		} else if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return META_COMMAND_SUCCESS
+		}
+		fmt.Printf("Vacuumed %d pages down to %d.\n", num_pages, vacuumed_pages)
+		return META_COMMAND_SUCCESS
+	} else if input_buffer.buffer == ".stats" {
+		db.WriteStats(os.Stdout)
+		return META_COMMAND_SUCCESS
+	} else if input_buffer.buffer == ".constants" {
+		fmt.Println("constants: ")
+		godb.WriteConstants(os.Stdout)
+		return META_COMMAND_SUCCESS
+	} else {
+		fmt.Printf("Unrecognized command '%s'.\n", input_buffer.buffer)
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+	return META_COMMAND_SUCCESS
+}
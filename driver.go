@@ -0,0 +1,355 @@
+package godb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/gorogoroumaru/godb/internal/engine"
+)
+
+func init() {
+	sql.Register("godb", &sqlDriver{})
+}
+
+// sqlDriver is the database/sql driver registered as "godb", described in
+// the package documentation.
+type sqlDriver struct{}
+
+// sharedDatabase is a database file and the driver connections using it.
+type sharedDatabase struct {
+	key         string
+	db          *DB
+	connections int
+	// lock holds a value while a connection is writing or in a transaction.
+	// It is a channel so that waiting for it can end with a context.
+	lock chan struct{}
+}
+
+// wait_lock takes the lock of the database, unless the context ends first.
+func (shared *sharedDatabase) wait_lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case shared.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (shared *sharedDatabase) unlock() {
+	<-shared.lock
+}
+
+var shared_databases = struct {
+	sync.Mutex
+	files map[string]*sharedDatabase
+}{files: map[string]*sharedDatabase{}}
+
+// Open opens a connection to the database file name.
+func (*sqlDriver) Open(name string) (driver.Conn, error) {
+	key, err := filepath.Abs(name)
+	if err != nil {
+		key = name
+	}
+
+	shared_databases.Lock()
+	defer shared_databases.Unlock()
+	shared, ok := shared_databases.files[key]
+	if !ok {
+		db, err := Open(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDatabase{key: key, db: db, lock: make(chan struct{}, 1)}
+		shared_databases.files[key] = shared
+	}
+	shared.connections++
+	return &driverConn{shared: shared}, nil
+}
+
+// driverConn is a connection of the driver.
+type driverConn struct {
+	shared *sharedDatabase
+	tx     *driverTx // the transaction holding the lock, if any
+	closed bool
+}
+
+// Prepare compiles a statement through the statement cache of the database.
+func (conn *driverConn) Prepare(query string) (driver.Stmt, error) {
+	if conn.closed {
+		return nil, driver.ErrBadConn
+	}
+	compiled, err := conn.shared.db.compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return &driverStmt{conn: conn, compiled: compiled}, nil
+}
+
+// ExecContext runs a statement that was not prepared, so that it too is
+// compiled through the statement cache. The context can end the wait for
+// another connection's write or transaction, but not a statement once it
+// runs.
+func (conn *driverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	statement, err := conn.run_query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driverResult{rows_affected: statement.RowsAffected()}, nil
+}
+
+// QueryContext is ExecContext for a query.
+func (conn *driverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	statement, err := conn.run_query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &driverRows{rows: statement_rows(statement)}, nil
+}
+
+// run_query compiles a statement and runs it with positional arguments.
+func (conn *driverConn) run_query(ctx context.Context, query string, args []driver.NamedValue) (*engine.Statement, error) {
+	if conn.closed {
+		return nil, driver.ErrBadConn
+	}
+	compiled, err := conn.shared.db.compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return conn.run(ctx, compiled, args)
+}
+
+// positional_values are the values of arguments that are passed by position.
+func positional_values(args []driver.NamedValue) ([]any, error) {
+	values := make([]any, len(args))
+	for _, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("godb: named argument %s is not supported", arg.Name)
+		}
+		values[arg.Ordinal-1] = arg.Value
+	}
+	return values, nil
+}
+
+// Close rolls back a transaction left open and closes the database once its
+// last connection is gone.
+func (conn *driverConn) Close() error {
+	if conn.closed {
+		return nil
+	}
+	var err error
+	if conn.tx != nil {
+		err = conn.tx.Rollback()
+	}
+	conn.closed = true
+
+	shared_databases.Lock()
+	defer shared_databases.Unlock()
+	shared := conn.shared
+	shared.connections--
+	if shared.connections == 0 {
+		delete(shared_databases.files, shared.key)
+		if close_err := shared.db.Close(); err == nil {
+			err = close_err
+		}
+	}
+	return err
+}
+
+// Begin starts a transaction, waiting for one on another connection to end.
+func (conn *driverConn) Begin() (driver.Tx, error) {
+	return conn.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx is Begin, giving up the wait if the context ends first. Only the
+// default isolation level is supported; transactions are serializable.
+func (conn *driverConn) BeginTx(ctx context.Context, options driver.TxOptions) (driver.Tx, error) {
+	if conn.closed {
+		return nil, driver.ErrBadConn
+	}
+	if conn.tx != nil {
+		return nil, errors.New("godb: a transaction is already active on this connection")
+	}
+	if options.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, errors.New("godb: isolation levels are not supported")
+	}
+	if err := conn.shared.wait_lock(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := conn.shared.db.Exec("begin"); err != nil {
+		conn.shared.unlock()
+		return nil, err
+	}
+	conn.tx = &driverTx{conn: conn}
+	return conn.tx, nil
+}
+
+// run runs a statement. A select outside a transaction reads a snapshot;
+// anything else has the database to itself. The context is checked before
+// the statement runs.
+func (conn *driverConn) run(ctx context.Context, compiled *engine.CompiledStatement, named_args []driver.NamedValue) (*engine.Statement, error) {
+	if conn.closed {
+		return nil, driver.ErrBadConn
+	}
+	args, err := positional_values(named_args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// A transaction begun by a statement would outlive the lock of the
+	// connection that began it, and other connections would join it.
+	if compiled.ControlsTransaction() {
+		return nil, errors.New("godb: use Begin, Commit and Rollback of database/sql for transactions")
+	}
+	if conn.tx == nil && compiled.IsSelect() {
+		return conn.shared.db.execute(compiled, args, true)
+	}
+	if conn.tx == nil {
+		if err := conn.shared.wait_lock(ctx); err != nil {
+			return nil, err
+		}
+		defer conn.shared.unlock()
+		return conn.shared.db.execute(compiled, args, false)
+	}
+
+	// A storage error rolls the whole transaction back, and the statements
+	// after it must not quietly commit on their own.
+	if conn.tx.aborted != nil {
+		return nil, conn.tx.aborted
+	}
+	statement, err := conn.shared.db.execute(compiled, args, false)
+	if err != nil && !conn.shared.db.in_transaction.Load() {
+		conn.tx.aborted = fmt.Errorf("godb: transaction was rolled back: %w", err)
+	}
+	return statement, err
+}
+
+// driverTx is a transaction of a driver connection.
+type driverTx struct {
+	conn    *driverConn
+	aborted error // set once an error has rolled the transaction back
+}
+
+func (tx *driverTx) Commit() error {
+	return tx.end("commit")
+}
+
+func (tx *driverTx) Rollback() error {
+	return tx.end("rollback")
+}
+
+// end commits or rolls back and lets other connections have the database.
+// A transaction an error already rolled back fails to commit.
+func (tx *driverTx) end(sql string) error {
+	conn := tx.conn
+	if conn.tx != tx {
+		return errors.New("godb: transaction has already ended")
+	}
+	var err error
+	if tx.aborted == nil {
+		_, err = conn.shared.db.Exec(sql)
+	} else if sql == "commit" {
+		err = tx.aborted
+	}
+	conn.tx = nil
+	conn.shared.unlock()
+	return err
+}
+
+// driverStmt is a statement of a driver connection.
+type driverStmt struct {
+	conn     *driverConn
+	compiled *engine.CompiledStatement
+}
+
+func (stmt *driverStmt) Close() error {
+	return nil
+}
+
+func (stmt *driverStmt) NumInput() int {
+	return stmt.compiled.NumInput()
+}
+
+func (stmt *driverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return stmt.ExecContext(context.Background(), named_values(args))
+}
+
+func (stmt *driverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.QueryContext(context.Background(), named_values(args))
+}
+
+// ExecContext runs the statement like driverConn.ExecContext.
+func (stmt *driverStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	statement, err := stmt.conn.run(ctx, stmt.compiled, args)
+	if err != nil {
+		return nil, err
+	}
+	return driverResult{rows_affected: statement.RowsAffected()}, nil
+}
+
+// QueryContext runs the statement like driverConn.QueryContext.
+func (stmt *driverStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	statement, err := stmt.conn.run(ctx, stmt.compiled, args)
+	if err != nil {
+		return nil, err
+	}
+	return &driverRows{rows: statement_rows(statement)}, nil
+}
+
+// named_values numbers values passed by position.
+func named_values(values []driver.Value) []driver.NamedValue {
+	args := make([]driver.NamedValue, len(values))
+	for i, value := range values {
+		args[i] = driver.NamedValue{Ordinal: i + 1, Value: value}
+	}
+	return args
+}
+
+// driverResult is what a statement run through the driver changed.
+type driverResult struct {
+	rows_affected int64
+}
+
+// LastInsertId is not supported; rows are inserted with their id.
+func (driverResult) LastInsertId() (int64, error) {
+	return 0, errors.New("godb: LastInsertId is not supported")
+}
+
+func (result driverResult) RowsAffected() (int64, error) {
+	return result.rows_affected, nil
+}
+
+// driverRows are the rows of a query run through the driver.
+type driverRows struct {
+	rows *Rows
+}
+
+func (rows *driverRows) Columns() []string {
+	return rows.rows.Columns()
+}
+
+func (rows *driverRows) Close() error {
+	return rows.rows.Close()
+}
+
+// Next stores the values of the next row as nil, int64, float64, string,
+// []byte or bool.
+func (rows *driverRows) Next(dest []driver.Value) error {
+	if !rows.rows.Next() {
+		return io.EOF
+	}
+	for i, value := range rows.rows.Values() {
+		dest[i] = value_any(value)
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+// Package godb is a small SQL database stored in a single file.
+//
+// A database is opened with Open and statements are run with DB.Exec, or
+// DB.Query for the rows of a select:
+//
+//	db, err := godb.Open("my.db", nil)
+//	if err != nil {
+//		...
+//	}
+//	defer db.Close()
+//	db.Exec("create table users (id integer, name text)")
+//	db.Exec("insert into users values (?, ?)", 1, "alice")
+//	rows, err := db.Query("select name from users where id = $1", 1)
+//	for rows.Next() {
+//		var name string
+//		rows.Scan(&name)
+//	}
+//
+// A statement can have parameters, written ? for the next one or $1, $2 and
+// so on, whose values are passed as arguments. A value is bound as a literal
+// of its type and never read as SQL. Statements are compiled once and kept
+// in a cache by their text; DB.Prepare returns one to run again and again.
+//
+// Outside of an explicit begin, every statement commits on its own.
+//
+// A DB is safe for concurrent use. Statements that write run one at a time,
+// and a transaction is shared by every goroutine using the DB. A select
+// outside a transaction does not wait for them: it reads the database as of
+// the last commit before it started, and never sees part of a commit. In
+// WAL mode any number of selects run alongside each other and the writer;
+// in rollback journal mode they wait while the writer runs a statement or
+// holds a transaction open.
+//
+// The package also registers a database/sql driver named "godb". The name
+// given to sql.Open is the path of the database file:
+//
+//	db, err := sql.Open("godb", "my.db")
+//	db.Exec("insert into users values (?, ?)", 1, "alice")
+//
+// A database file is opened once however many connections the pool makes to
+// it. A query outside a transaction reads the last commit and runs alongside
+// the other connections. Statements that write take turns: one has the
+// database to itself while it runs, and a transaction until it commits or
+// rolls back, so a connection that writes while another connection is in a
+// transaction waits for it to end. The context of a statement or BeginTx can
+// give up that wait; once a statement runs, it runs to the end. Transactions
+// are begun and ended with the methods of database/sql, and the statements
+// begin, commit and rollback are refused.
+package godb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorogoroumaru/godb/internal/engine"
+)
+
+// ErrClosed is returned by the methods of a DB that has been closed.
+var ErrClosed = errors.New("godb: database is closed")
+
+// ErrInTransaction is returned by DB.Vacuum while a transaction is active.
+var ErrInTransaction = engine.ErrInTransaction
+
+// ErrNoTable is returned for a table that does not exist.
+var ErrNoTable = engine.ErrNoTable
+
+// The storage reports failures with these errors, wrapped with the details
+// of what went wrong; errors.Is tells them apart.
+var (
+	// ErrCorrupt is a file whose contents make no sense as a database.
+	ErrCorrupt = engine.ErrCorrupt
+	// ErrIO is a read, write or sync of the database, its log or a temporary
+	// file that the operating system refused.
+	ErrIO = engine.ErrIO
+	// ErrPageOutOfRange is a reference to a page past the end of the database.
+	ErrPageOutOfRange = engine.ErrPageOutOfRange
+	// ErrDuplicateKey is an insert of a key the table already holds.
+	ErrDuplicateKey = engine.ErrDuplicateKey
+)
+
+// Journal modes select how a database keeps its changes atomic.
+const (
+	JOURNAL_MODE_WAL    = engine.JOURNAL_MODE_WAL    // append changes to a write-ahead log
+	JOURNAL_MODE_DELETE = engine.JOURNAL_MODE_DELETE // save original pages to a rollback journal
+)
+
+const (
+	// DEFAULT_CACHE_PAGES is the size of the buffer pool when none is
+	// configured (4 MB).
+	DEFAULT_CACHE_PAGES = engine.DEFAULT_CACHE_PAGES
+	// DEFAULT_SORT_MEMORY is how many bytes of rows a sort holds in memory
+	// before it spills them to a temporary file (4 MB).
+	DEFAULT_SORT_MEMORY = engine.DEFAULT_SORT_MEMORY
+	// DEFAULT_STATEMENT_CACHE_SIZE is how many compiled statements a database
+	// keeps for reuse.
+	DEFAULT_STATEMENT_CACHE_SIZE = engine.DEFAULT_STATEMENT_CACHE_SIZE
+)
+
+// Options configures how a database is opened.
+type Options struct {
+	CachePages  int // size of the buffer pool in pages
+	JournalMode int // JOURNAL_MODE_WAL or JOURNAL_MODE_DELETE
+	SortMemory  int // bytes a sort keeps in memory before spilling to disk
+}
+
+// DB is an open database.
+type DB struct {
+	db    *engine.Database
+	cache *engine.StatementCache
+	// lock is held shared by every call and exclusively by Close.
+	lock sync.RWMutex
+	// write is held by the writer while it runs a statement.
+	write          sync.Mutex
+	in_transaction atomic.Bool
+}
+
+// Result describes what Exec changed.
+type Result struct {
+	RowsAffected int64 // the rows an insert, update or delete changed
+}
+
+// Error is a statement that failed. A statement that could not be prepared
+// never ran; one that failed while running was rolled back, unless it was
+// part of an explicit transaction. A failure of the storage, one of ErrIO,
+// ErrCorrupt or ErrPageOutOfRange, rolls back the whole transaction.
+type Error struct {
+	message string
+	ran     bool
+	err     error // what errors.Is and errors.As see through the error
+}
+
+func (err *Error) Error() string {
+	return err.message
+}
+
+func (err *Error) Unwrap() error {
+	return err.err
+}
+
+// Ran reports whether the statement got past preparing and failed while
+// running.
+func (err *Error) Ran() bool {
+	return err.ran
+}
+
+// statement_error reports a statement the engine failed to run as an Error.
+func statement_error(err error) error {
+	var engine_error *engine.Error
+	if errors.As(err, &engine_error) {
+		return &Error{message: engine_error.Message, ran: engine_error.Ran, err: engine_error.Err}
+	}
+	return err
+}
+
+// Open opens the database in the file at path, creating it if it does not
+// exist. Options left at zero, or nil options, take their defaults.
+func Open(path string, options *Options) (*DB, error) {
+	resolved := Options{CachePages: DEFAULT_CACHE_PAGES, JournalMode: JOURNAL_MODE_WAL, SortMemory: DEFAULT_SORT_MEMORY}
+	if options != nil {
+		if options.CachePages < 0 || options.SortMemory < 0 {
+			return nil, errors.New("godb: negative cache or sort memory size")
+		}
+		if options.JournalMode != JOURNAL_MODE_WAL && options.JournalMode != JOURNAL_MODE_DELETE {
+			return nil, fmt.Errorf("godb: unknown journal mode %d", options.JournalMode)
+		}
+		if options.CachePages > 0 {
+			resolved.CachePages = options.CachePages
+		}
+		if options.SortMemory > 0 {
+			resolved.SortMemory = options.SortMemory
+		}
+		resolved.JournalMode = options.JournalMode
+	}
+	db, err := engine.Open(path, engine.Options(resolved))
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db, cache: engine.NewStatementCache(DEFAULT_STATEMENT_CACHE_SIZE)}, nil
+}
+
+// Close abandons a transaction left open, writes everything to the file and
+// closes it.
+func (db *DB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.db == nil {
+		return ErrClosed
+	}
+	err := db.db.Close()
+	db.db = nil
+	return err
+}
+
+// compile returns the compiled statement for the text from the cache.
+func (db *DB) compile(sql string) (*engine.CompiledStatement, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return nil, ErrClosed
+	}
+	compiled, err := db.cache.Compile(sql)
+	if err != nil {
+		return nil, statement_error(err)
+	}
+	return compiled, nil
+}
+
+// run runs a compiled statement, reading a snapshot for a select outside a
+// transaction.
+func (db *DB) run(compiled *engine.CompiledStatement, args []any) (*engine.Statement, error) {
+	snapshot := compiled.IsSelect() && !db.in_transaction.Load()
+	return db.execute(compiled, args, snapshot)
+}
+
+// execute runs a compiled statement, either as the writer or against a
+// snapshot of the last commit.
+func (db *DB) execute(compiled *engine.CompiledStatement, args []any, snapshot bool) (*engine.Statement, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return nil, ErrClosed
+	}
+	args = engine_arguments(args)
+	if !snapshot {
+		db.write.Lock()
+		defer db.write.Unlock()
+	}
+	statement, err := db.db.Execute(compiled, args, snapshot)
+	if !snapshot {
+		db.in_transaction.Store(db.db.InTransaction())
+	}
+	if err != nil {
+		return nil, statement_error(err)
+	}
+	return statement, nil
+}
+
+// engine_arguments passes the Values among the arguments on as the engine's.
+func engine_arguments(args []any) []any {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		if value, ok := arg.(Value); ok {
+			arg = value.value
+		}
+		values[i] = arg
+	}
+	return values
+}
+
+// exec compiles a statement, or finds it in the cache, and runs it.
+func (db *DB) exec(sql string, args []any) (*engine.Statement, error) {
+	compiled, err := db.compile(sql)
+	if err != nil {
+		return nil, err
+	}
+	return db.run(compiled, args)
+}
+
+// Exec runs a statement with the arguments as the values of its parameters.
+// The rows of a select are thrown away.
+func (db *DB) Exec(sql string, args ...any) (Result, error) {
+	statement, err := db.exec(sql, args)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{RowsAffected: statement.RowsAffected()}, nil
+}
+
+// Query runs a statement with the arguments as the values of its parameters
+// and returns the rows it produced. Statements other than select produce
+// none. The rows are read in full before Query returns, so an error reading
+// them is returned by Query and iterating over them cannot fail.
+func (db *DB) Query(sql string, args ...any) (*Rows, error) {
+	statement, err := db.exec(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	return statement_rows(statement), nil
+}
+
+// Stmt is a compiled statement of a DB. It runs with the tables and indexes
+// the database has when it runs, not when it was prepared.
+type Stmt struct {
+	db       *DB
+	compiled *engine.CompiledStatement
+}
+
+// Prepare compiles a statement to run any number of times.
+func (db *DB) Prepare(sql string) (*Stmt, error) {
+	compiled, err := db.compile(sql)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{db: db, compiled: compiled}, nil
+}
+
+// NumInput is the number of parameters of the statement.
+func (stmt *Stmt) NumInput() int {
+	return stmt.compiled.NumInput()
+}
+
+// Exec runs the statement with the arguments as the values of its
+// parameters, like DB.Exec.
+func (stmt *Stmt) Exec(args ...any) (Result, error) {
+	statement, err := stmt.db.run(stmt.compiled, args)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{RowsAffected: statement.RowsAffected()}, nil
+}
+
+// Query runs the statement with the arguments as the values of its
+// parameters, like DB.Query.
+func (stmt *Stmt) Query(args ...any) (*Rows, error) {
+	statement, err := stmt.db.run(stmt.compiled, args)
+	if err != nil {
+		return nil, err
+	}
+	return statement_rows(statement), nil
+}
+
+func statement_rows(statement *engine.Statement) *Rows {
+	return &Rows{columns: statement.Columns(), rows: statement.Rows(), explain: statement.Explain()}
+}
+
+// Tables returns the names of the tables in the order they were created.
+func (db *DB) Tables() []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return nil
+	}
+	db.write.Lock()
+	defer db.write.Unlock()
+	return db.db.Tables()
+}
+
+// Vacuum rebuilds the database without free pages and returns its size in
+// pages before and after.
+func (db *DB) Vacuum() (uint32, uint32, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return 0, 0, ErrClosed
+	}
+	db.write.Lock()
+	defer db.write.Unlock()
+	return db.db.Vacuum()
+}
+
+// WriteTree writes the shape of a table's B-tree.
+func (db *DB) WriteTree(w io.Writer, name string) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return ErrClosed
+	}
+	db.write.Lock()
+	defer db.write.Unlock()
+	return db.db.WriteTree(w, name)
+}
+
+// WriteStats writes the buffer pool and I/O counters.
+func (db *DB) WriteStats(w io.Writer) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return ErrClosed
+	}
+	db.write.Lock()
+	defer db.write.Unlock()
+	db.db.WriteStats(w)
+	return nil
+}
+
+// WriteConstants writes the sizes of the B-tree node layout.
+func WriteConstants(w io.Writer) {
+	engine.WriteConstants(w)
+}
+
+// Rows are the result of a query, held in memory. Next moves to each row in
+// turn.
+type Rows struct {
+	columns  []string
+	rows     [][]engine.Value
+	position int // the current row is rows[position-1]
+	values   []Value
+	explain  bool
+}
+
+// Next moves to the next row and reports whether there was one.
+func (rows *Rows) Next() bool {
+	if rows.position >= len(rows.rows) {
+		rows.position = len(rows.rows) + 1
+		rows.values = nil
+		return false
+	}
+	rows.position++
+	rows.values = make([]Value, len(rows.rows[rows.position-1]))
+	for i, value := range rows.rows[rows.position-1] {
+		rows.values[i] = Value{value: value}
+	}
+	return true
+}
+
+// Columns returns the names of the columns: the text of each projected
+// expression, or the column names for "*".
+func (rows *Rows) Columns() []string {
+	return rows.columns
+}
+
+// Explain reports whether the rows are the plan of an explain, one line of
+// text per row.
+func (rows *Rows) Explain() bool {
+	return rows.explain
+}
+
+// Values returns the values of the current row.
+func (rows *Rows) Values() []Value {
+	return rows.values
+}
+
+// Close releases the rows.
+func (rows *Rows) Close() error {
+	rows.rows = nil
+	rows.values = nil
+	return nil
+}
+
+// Scan copies the values of the current row into dest, one pointer per
+// column. A *Value or *any takes any value; *int64, *int, *float64, *string,
+// *[]byte and *bool take values of a matching type. NULL only goes into a
+// *Value, *any or *[]byte, as nil.
+func (rows *Rows) Scan(dest ...any) error {
+	values := rows.Values()
+	if values == nil {
+		return errors.New("godb: Scan called without a current row")
+	}
+	if len(dest) != len(values) {
+		return fmt.Errorf("godb: expected %d destinations, got %d", len(values), len(dest))
+	}
+	for i, value := range values {
+		if dest, ok := dest[i].(*Value); ok {
+			*dest = value
+			continue
+		}
+		if !value.value.Scan(dest[i]) {
+			return fmt.Errorf("godb: cannot scan %s column %s into %T", value.value.TypeName(), rows.columns[i], dest[i])
+		}
+	}
+	return nil
+}
+
+// Value is one field of a row: NULL, an integer, a real, text, a blob or a
+// boolean. A Value can be passed as the value of a parameter.
+type Value struct {
+	value engine.Value
+}
+
+// String formats a value the way the REPL prints it.
+func (value Value) String() string {
+	return value.value.String()
+}
+
+// value_any is a value as the Go type that holds it: nil, int64, float64,
+// string, []byte or bool.
+func value_any(value Value) any {
+	return value.value.Any()
+}
@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"slices"
+)
+
+// A grouped select is evaluated in two steps. The scan puts every row that
+// passes the where clause into the group of its group by values, kept in a
+// hash table, and feeds it to the aggregates of that group. Each group then
+// becomes a group row, its group by values followed by its aggregate results,
+// and having, the projection and the order by are evaluated against the
+// group rows.
+
+// prepare_aggregate checks an aggregate function and works out its type.
+func prepare_aggregate(expression *Expression) int {
+	if len(expression.operands) == 0 {
+		if expression.operator != "count" {
+			return PREPARE_SYNTAX_ERROR
+		}
+		expression.value_type = COLUMN_TYPE_INTEGER
+		return PREPARE_SUCCESS
+	}
+
+	argument := expression.operands[0]
+	if contains_aggregate(argument) {
+		return PREPARE_MISUSED_AGGREGATE
+	}
+	switch expression.operator {
+	case "count":
+		expression.value_type = COLUMN_TYPE_INTEGER
+	case "sum", "avg":
+		if !is_numeric_type(argument.value_type) {
+			return PREPARE_TYPE_MISMATCH
+		}
+		expression.value_type = COLUMN_TYPE_REAL
+		if expression.operator == "sum" && argument.value_type != COLUMN_TYPE_REAL {
+			expression.value_type = COLUMN_TYPE_INTEGER
+		}
+	case "min", "max":
+		expression.value_type = argument.value_type
+	default:
+		return PREPARE_UNRECOGNIZED_FUNCTION
+	}
+	return PREPARE_SUCCESS
+}
+
+// prepare_grouping sets up a select with group by, having or aggregates. The
+// projection and order by, already prepared against the table, are rewritten
+// to read group rows.
+func prepare_grouping(ast *Ast, statement *Statement) int {
+	scope := statement.scope
+	statement.group_by = ast.group_by
+	for _, expression := range statement.group_by {
+		if result := prepare_expression(expression, scope); result != PREPARE_SUCCESS {
+			return result
+		}
+		if contains_aggregate(expression) {
+			return PREPARE_MISUSED_AGGREGATE
+		}
+	}
+
+	statement.grouped = ast.group_by != nil || ast.having != nil ||
+		slices.ContainsFunc(statement.projection, contains_aggregate) ||
+		slices.ContainsFunc(statement.ordering, func(ordering Ordering) bool { return contains_aggregate(ordering.expression) })
+	if !statement.grouped {
+		return PREPARE_SUCCESS
+	}
+
+	statement.aggregates = nil
+	result := PREPARE_SUCCESS
+	for i, expression := range statement.projection {
+		if statement.projection[i], result = group_expression(expression, statement); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	for i, ordering := range statement.ordering {
+		if statement.ordering[i].expression, result = group_expression(ordering.expression, statement); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+
+	statement.having = nil
+	if ast.having != nil {
+		if result = prepare_expression(ast.having, scope); result != PREPARE_SUCCESS {
+			return result
+		}
+		if !is_boolean_type(ast.having.value_type) {
+			return PREPARE_TYPE_MISMATCH
+		}
+		if statement.having, result = group_expression(ast.having, statement); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	return PREPARE_SUCCESS
+}
+
+// group_expression returns a copy of an expression that reads a group row.
+// Parts equal to a group by expression read its group value and aggregates
+// read their result; any other column is not defined for a group.
+func group_expression(expression *Expression, statement *Statement) (*Expression, int) {
+	column := func(index int) *Expression {
+		return &Expression{expression_type: EXPRESSION_COLUMN, token: expression.token, column: index, value_type: expression.value_type}
+	}
+	for i, key := range statement.group_by {
+		if expressions_equal(expression, key) {
+			return column(i), PREPARE_SUCCESS
+		}
+	}
+
+	switch expression.expression_type {
+	case EXPRESSION_AGGREGATE:
+		index := slices.IndexFunc(statement.aggregates, func(aggregate *Expression) bool {
+			return expressions_equal(aggregate, expression)
+		})
+		if index < 0 {
+			index = len(statement.aggregates)
+			statement.aggregates = append(statement.aggregates, expression)
+		}
+		return column(len(statement.group_by) + index), PREPARE_SUCCESS
+	case EXPRESSION_COLUMN:
+		return nil, PREPARE_NOT_GROUPED
+	}
+
+	grouped := *expression
+	grouped.operands = make([]*Expression, len(expression.operands))
+	for i, operand := range expression.operands {
+		var result int
+		if grouped.operands[i], result = group_expression(operand, statement); result != PREPARE_SUCCESS {
+			return nil, result
+		}
+	}
+	return &grouped, PREPARE_SUCCESS
+}
+
+// AggregateState is what an aggregate has gathered from a group's rows so
+// far. Sums are kept in integer until a real is added or they overflow.
+type AggregateState struct {
+	count   int64
+	integer int64
+	real    float64
+	is_real bool
+	value   Value // the smallest or largest value for min and max
+}
+
+// aggregate_step adds one row to an aggregate. Apart from count(*),
+// aggregates skip NULLs.
+func aggregate_step(aggregate *Expression, state *AggregateState, row *Row) {
+	if len(aggregate.operands) == 0 {
+		state.count++
+		return
+	}
+	value := evaluate_expression(aggregate.operands[0], row)
+	if value.value_type == COLUMN_TYPE_NULL {
+		return
+	}
+	state.count++
+
+	switch aggregate.operator {
+	case "sum", "avg":
+		if !state.is_real && value.value_type != COLUMN_TYPE_REAL {
+			sum := state.integer + value.integer
+			overflow := (value.integer > 0 && sum < state.integer) || (value.integer < 0 && sum > state.integer)
+			if !overflow {
+				state.integer = sum
+				return
+			}
+		}
+		if !state.is_real {
+			state.is_real = true
+			state.real = float64(state.integer)
+		}
+		state.real += numeric_value(value)
+	case "min":
+		if state.count == 1 || compare_values(value, state.value) < 0 {
+			state.value = value
+		}
+	case "max":
+		if state.count == 1 || compare_values(value, state.value) > 0 {
+			state.value = value
+		}
+	}
+}
+
+// aggregate_result is the value of an aggregate over a group. Only count is
+// defined for a group without values; the others are NULL.
+func aggregate_result(aggregate *Expression, state *AggregateState) Value {
+	if aggregate.operator == "count" {
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: state.count}
+	}
+	if state.count == 0 {
+		return Value{value_type: COLUMN_TYPE_NULL}
+	}
+	switch aggregate.operator {
+	case "sum":
+		if state.is_real {
+			return Value{value_type: COLUMN_TYPE_REAL, real: state.real}
+		}
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: state.integer}
+	case "avg":
+		sum := float64(state.integer)
+		if state.is_real {
+			sum = state.real
+		}
+		return Value{value_type: COLUMN_TYPE_REAL, real: sum / float64(state.count)}
+	}
+	return state.value
+}
+
+// Group is one entry of the hash table: its group by values and the state of
+// each aggregate.
+type Group struct {
+	keys   []Value
+	states []AggregateState
+}
+
+// counts_rows_only reports whether every aggregate is count(*) over the
+// whole table with no grouping, which the number of cells in the leaves
+// answers without reading any row.
+func counts_rows_only(statement *Statement) bool {
+	if statement.group_by != nil || statement.where.condition != nil || statement.joins != nil {
+		return false
+	}
+	for _, aggregate := range statement.aggregates {
+		if aggregate.operator != "count" || len(aggregate.operands) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// execute_aggregate groups the rows, and passes the group rows that satisfy
+// having to the output. Groups come out in the order their first rows were
+// read. Without a group by there is exactly one group, even with no rows.
+func execute_aggregate(statement *Statement, output *SelectOutput) error {
+	table := statement.table
+	groups := map[string]*Group{}
+	var order []*Group
+	new_group := func(keys []Value) *Group {
+		group := &Group{keys: keys, states: make([]AggregateState, len(statement.aggregates))}
+		order = append(order, group)
+		return group
+	}
+
+	if counts_rows_only(statement) {
+		group := new_group(nil)
+		count, err := table_count_rows(table)
+		if err != nil {
+			return err
+		}
+		for i := range group.states {
+			group.states[i].count = int64(count)
+		}
+	} else {
+		err := select_scan(statement, func(row *Row) bool {
+			keys := project_row(statement.group_by, row)
+			hash := string(encode_sort_row(keys))
+			group, ok := groups[hash]
+			if !ok {
+				group = new_group(keys)
+				groups[hash] = group
+			}
+			for i, aggregate := range statement.aggregates {
+				aggregate_step(aggregate, &group.states[i], row)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if statement.group_by == nil && len(order) == 0 {
+			new_group(nil)
+		}
+	}
+
+	for _, group := range order {
+		row := Row{values: group.keys}
+		for i, aggregate := range statement.aggregates {
+			row.values = append(row.values, aggregate_result(aggregate, &group.states[i]))
+		}
+		if statement.having != nil && !is_true(evaluate_expression(statement.having, &row)) {
+			continue
+		}
+		if !select_output_add(output, &row) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1227 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+const (
+	NODE_INTERNAL = iota
+	NODE_LEAF
+)
+
+const (
+	NODE_TYPE_SIZE           = uint32(unsafe.Sizeof(uint8(0)))
+	NODE_TYPE_OFFSET         = uint32(0)
+	IS_ROOT_SIZE             = uint32(unsafe.Sizeof(uint8(0)))
+	IS_ROOT_OFFSET           = NODE_TYPE_SIZE
+	PARENT_POINTER_SIZE      = uint32(unsafe.Sizeof(uint32(0)))
+	PARENT_POINTER_OFFSET    = IS_ROOT_OFFSET + IS_ROOT_SIZE
+	COMMON_NODE_HEADER_SIZE  = NODE_TYPE_SIZE + IS_ROOT_SIZE + PARENT_POINTER_SIZE
+
+	LEAF_NODE_NUM_CELLS_SIZE   = uint32(unsafe.Sizeof(uint32(0)))
+	LEAF_NODE_NUM_CELLS_OFFSET = COMMON_NODE_HEADER_SIZE
+	LEAF_NODE_NEXT_LEAF_SIZE   = uint32(unsafe.Sizeof(uint32(0)))
+	LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
+	LEAF_NODE_CONTENT_START_SIZE   = uint32(unsafe.Sizeof(uint16(0)))
+	LEAF_NODE_CONTENT_START_OFFSET = LEAF_NODE_NEXT_LEAF_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
+	LEAF_NODE_FRAGMENTED_SIZE      = uint32(unsafe.Sizeof(uint16(0)))
+	LEAF_NODE_FRAGMENTED_OFFSET    = LEAF_NODE_CONTENT_START_OFFSET + LEAF_NODE_CONTENT_START_SIZE
+	LEAF_NODE_HEADER_SIZE          = LEAF_NODE_FRAGMENTED_OFFSET + LEAF_NODE_FRAGMENTED_SIZE
+)
+
+// Leaves are slotted pages. An array of 2 byte cell offsets, kept in key
+// order, grows from the end of the header while the cells themselves are
+// packed from the end of the page towards it:
+//
+//	header | slot 0 | slot 1 | ... free ... | cell 1 | cell 0
+//	cell:  key (4 bytes) | record size (4 bytes) | record
+//
+// Large records keep only their first part in the cell; see overflow.go.
+//
+// Removing a cell leaves a hole in the content area. The header counts those
+// fragmented bytes, and the leaf is defragmented when a new cell only fits
+// once the holes are squeezed out.
+const (
+	LEAF_NODE_SLOT_SIZE          = uint32(unsafe.Sizeof(uint16(0)))
+	LEAF_NODE_KEY_SIZE           = uint32(unsafe.Sizeof(uint32(0)))
+	LEAF_NODE_KEY_OFFSET         = uint32(0)
+	LEAF_NODE_RECORD_SIZE_SIZE   = uint32(unsafe.Sizeof(uint32(0)))
+	LEAF_NODE_RECORD_SIZE_OFFSET = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
+	LEAF_NODE_VALUE_OFFSET       = LEAF_NODE_RECORD_SIZE_OFFSET + LEAF_NODE_RECORD_SIZE_SIZE
+	LEAF_NODE_CELL_HEADER_SIZE   = LEAF_NODE_VALUE_OFFSET
+	LEAF_NODE_SPACE_FOR_CELLS    = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
+	// A cell takes at most a quarter of a leaf, so an overfull leaf can always
+	// be split into two halves that fit. Larger records spill into overflow pages.
+	LEAF_NODE_MAX_LOCAL = LEAF_NODE_SPACE_FOR_CELLS/4 - LEAF_NODE_SLOT_SIZE - LEAF_NODE_CELL_HEADER_SIZE - OVERFLOW_POINTER_SIZE
+	// A leaf using less space than this is refilled from a sibling.
+	LEAF_NODE_MIN_SPACE = LEAF_NODE_SPACE_FOR_CELLS / 4
+)
+
+// ブログではこの構造を可視化する
+// right child, left childのポインタが格納されている部分のビットマップとBtreeの木を対応付けする
+
+const (
+	INTERNAL_NODE_NUM_KEYS_SIZE = 4
+	INTERNAL_NODE_NUM_KEYS_OFFSET = COMMON_NODE_HEADER_SIZE
+	INTERNAL_NODE_RIGHT_CHILD_SIZE = 4
+	INTERNAL_NODE_RIGHT_CHILD_OFFSET = INTERNAL_NODE_NUM_KEYS_OFFSET + INTERNAL_NODE_NUM_KEYS_SIZE
+	INTERNAL_NODE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + INTERNAL_NODE_NUM_KEYS_SIZE + INTERNAL_NODE_RIGHT_CHILD_SIZE
+
+	INTERNAL_NODE_KEY_SIZE = 4
+	INTERNAL_NODE_CHILD_SIZE = 4
+	INTERNAL_NODE_CELL_SIZE = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
+	INTERNAL_NODE_SPACE_FOR_CELLS = PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE
+	INTERNAL_NODE_MAX_CELLS = INTERNAL_NODE_SPACE_FOR_CELLS / INTERNAL_NODE_CELL_SIZE
+	INTERNAL_NODE_MIN_KEYS = INTERNAL_NODE_MAX_CELLS / 2
+)
+
+func node_parent(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[PARENT_POINTER_OFFSET:])
+}
+
+func set_node_parent(node []byte, parent_page_num uint32) {
+	binary.LittleEndian.PutUint32(node[PARENT_POINTER_OFFSET:], parent_page_num)
+}
+
+func internal_node_num_keys(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:])
+}
+
+func internal_node_right_child(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:])
+}
+
+func internal_node_cell(node []byte, cellNum uint32) []byte {
+	return node[INTERNAL_NODE_HEADER_SIZE + cellNum*INTERNAL_NODE_CELL_SIZE:]
+}
+
+func internal_node_child(node []byte, childNum uint32) ([]byte, error) {
+	numKeys := internal_node_num_keys(node)
+	if numKeys > INTERNAL_NODE_MAX_CELLS {
+		return nil, corrupt_error("internal node with %d keys", numKeys)
+	} else if childNum > numKeys {
+		return nil, corrupt_error("child %d of an internal node with %d keys", childNum, numKeys)
+	} else if childNum == numKeys {
+		return node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:], nil
+	} else {
+		return internal_node_cell(node, childNum), nil
+	}
+}
+
+
+func internal_node_key(node []byte, keyNum uint32) []byte {
+	return internal_node_cell(node, keyNum)[INTERNAL_NODE_CHILD_SIZE:]
+}
+
+func set_internal_node_cell(node []byte, cell_num uint32, child_page_num uint32, key uint32) {
+	cell := internal_node_cell(node, cell_num)
+	binary.LittleEndian.PutUint32(cell, child_page_num)
+	binary.LittleEndian.PutUint32(cell[INTERNAL_NODE_CHILD_SIZE:], key)
+}
+
+func set_internal_node_num_keys(node []byte, num_keys uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:], num_keys)
+}
+
+func set_internal_node_right_child(node []byte, page_num uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:], page_num)
+}
+
+// internal_node_find_child returns the index of the child which should contain the given key.
+func internal_node_find_child(node []byte, key uint32) uint32 {
+	num_keys := internal_node_num_keys(node)
+
+	min_index := uint32(0)
+	max_index := num_keys
+
+	for min_index != max_index {
+		index := (min_index + max_index) / 2
+		key_to_right := binary.LittleEndian.Uint32(internal_node_key(node, index))
+		if key_to_right >= key {
+			max_index = index
+		} else {
+			min_index = index + 1
+		}
+	}
+
+	return min_index
+}
+
+// update_internal_node_key sets the key stored for the given child to its new maximum.
+func update_internal_node_key(node []byte, child_page_num uint32, new_key uint32) error {
+	child_index, err := internal_node_child_index(node, child_page_num)
+	if err != nil {
+		return err
+	}
+	// The right child has no key of its own, so there is nothing to update.
+	if child_index < internal_node_num_keys(node) {
+		binary.LittleEndian.PutUint32(internal_node_key(node, child_index), new_key)
+	}
+	return nil
+}
+
+func internal_node_child_page(node []byte, child_num uint32) (uint32, error) {
+	child, err := internal_node_child(node, child_num)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(child), nil
+}
+
+// internal_node_child_index returns the position of the given page among the children of node.
+func internal_node_child_index(node []byte, child_page_num uint32) (uint32, error) {
+	num_keys := internal_node_num_keys(node)
+	for i := uint32(0); i <= num_keys; i++ {
+		page_num, err := internal_node_child_page(node, i)
+		if err != nil {
+			return 0, err
+		}
+		if page_num == child_page_num {
+			return i, nil
+		}
+	}
+	return 0, corrupt_error("page %d is not a child of its parent", child_page_num)
+}
+
+// internal_node_entries returns the children of an internal node and the keys between them.
+func internal_node_entries(node []byte) ([]uint32, []uint32, error) {
+	num_keys := internal_node_num_keys(node)
+	if num_keys > INTERNAL_NODE_MAX_CELLS {
+		return nil, nil, corrupt_error("internal node with %d keys", num_keys)
+	}
+	children := make([]uint32, 0, num_keys+1)
+	keys := make([]uint32, 0, num_keys)
+	for i := uint32(0); i < num_keys; i++ {
+		children = append(children, binary.LittleEndian.Uint32(internal_node_cell(node, i)))
+		keys = append(keys, binary.LittleEndian.Uint32(internal_node_key(node, i)))
+	}
+	children = append(children, internal_node_right_child(node))
+	return children, keys, nil
+}
+
+// internal_node_check makes sure a page read from the file looks like an
+// internal node before its keys are searched.
+func internal_node_check(node []byte, page_num uint32) error {
+	if get_node_type(node) != NODE_INTERNAL || internal_node_num_keys(node) > INTERNAL_NODE_MAX_CELLS {
+		return corrupt_error("page %d is not a valid internal node", page_num)
+	}
+	return nil
+}
+
+func internal_node_find(table *Table, page_num uint32, key uint32) (*Cursor, error) {
+    node, err := get_page(table.pager, page_num)
+    if err != nil {
+        return nil, err
+    }
+    if err := internal_node_check(*node, page_num); err != nil {
+        return nil, err
+    }
+    child_index := internal_node_find_child(*node, key)
+
+    child_num, err := internal_node_child_page(*node, child_index)
+    if err != nil {
+        return nil, err
+    }
+    child, err := get_page(table.pager, child_num)
+    if err != nil {
+        return nil, err
+    }
+    switch get_node_type(*child) {
+    case NODE_LEAF:
+        return leaf_node_find(table, child_num, key)
+    case NODE_INTERNAL:
+        return internal_node_find(table, child_num, key)
+    }
+
+	return nil, corrupt_error("page %d has unknown node type %d", child_num, get_node_type(*child))
+}
+
+
+func get_node_max_key(pager *Pager, node []byte) (uint32, error) {
+	switch get_node_type(node) {
+	case NODE_INTERNAL:
+		// The keys of an internal node only cover its left children, so the
+		// maximum lives in the right-most subtree.
+		right_child, err := get_page(pager, internal_node_right_child(node))
+		if err != nil {
+			return 0, err
+		}
+		return get_node_max_key(pager, *right_child)
+	case NODE_LEAF:
+		if leaf_node_num_cells(node) == 0 {
+			return 0, nil
+		}
+		return leaf_node_key(node, leaf_node_num_cells(node)-1), nil
+	default:
+		return 0, nil
+	}
+}
+
+func is_node_root(node []byte) bool {
+	value := node[IS_ROOT_OFFSET]
+	return value == 1
+}
+
+func set_node_root(node []byte, isRoot bool) {
+	var value byte
+	if isRoot {
+		value = 1
+	} else {
+		value = 0
+	}
+	node[IS_ROOT_OFFSET] = value
+}
+
+func initialize_internal_node(node []byte) {
+	set_node_type(node, NODE_INTERNAL)
+	set_node_root(node, false)
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:], 0)
+}
+
+
+func create_new_root(table *Table, rightChildPageNum uint32) error {
+	root, err := get_page_for_write(table.pager, table.root_page_num)
+	if err != nil {
+		return err
+	}
+	rightChild, err := get_page_for_write(table.pager, rightChildPageNum)
+	if err != nil {
+		return err
+	}
+	leftChildPageNum, err := get_unused_page_num(table.pager)
+	if err != nil {
+		return err
+	}
+	leftChild, err := get_page_for_write(table.pager, leftChildPageNum)
+	if err != nil {
+		return err
+	}
+
+	copy(*leftChild, *root)
+	set_node_root(*leftChild, false)
+
+	if get_node_type(*leftChild) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(*leftChild); i++ {
+			child_page_num, err := internal_node_child_page(*leftChild, i)
+			if err != nil {
+				return err
+			}
+			child, err := get_page_for_write(table.pager, child_page_num)
+			if err != nil {
+				return err
+			}
+			set_node_parent(*child, leftChildPageNum)
+		}
+	}
+
+	initialize_internal_node(*root)
+	set_node_root(*root, true)
+	set_internal_node_num_keys(*root, 1)
+	leftChildMaxKey, err := get_node_max_key(table.pager, *leftChild)
+	if err != nil {
+		return err
+	}
+	set_internal_node_cell(*root, 0, leftChildPageNum, leftChildMaxKey)
+	set_internal_node_right_child(*root, rightChildPageNum)
+	set_node_parent(*leftChild, table.root_page_num)
+	set_node_parent(*rightChild, table.root_page_num)
+	return nil
+}
+
+// internal_node_insert adds a new child/key pair to the parent that corresponds to the child.
+func internal_node_insert(table *Table, parent_page_num uint32, child_page_num uint32) error {
+	parent, err := get_page_for_write(table.pager, parent_page_num)
+	if err != nil {
+		return err
+	}
+	child, err := get_page_for_write(table.pager, child_page_num)
+	if err != nil {
+		return err
+	}
+	child_max_key, err := get_node_max_key(table.pager, *child)
+	if err != nil {
+		return err
+	}
+	index := internal_node_find_child(*parent, child_max_key)
+
+	original_num_keys := internal_node_num_keys(*parent)
+	if original_num_keys >= INTERNAL_NODE_MAX_CELLS {
+		return internal_node_split_and_insert(table, parent_page_num, child_page_num)
+	}
+
+	set_node_parent(*child, parent_page_num)
+
+	right_child_page_num := internal_node_right_child(*parent)
+	right_child, err := get_page(table.pager, right_child_page_num)
+	if err != nil {
+		return err
+	}
+	right_child_max_key, err := get_node_max_key(table.pager, *right_child)
+	if err != nil {
+		return err
+	}
+
+	if child_max_key > right_child_max_key {
+		// Replace the right child
+		set_internal_node_cell(*parent, original_num_keys, right_child_page_num, right_child_max_key)
+		set_internal_node_right_child(*parent, child_page_num)
+	} else {
+		// Make room for the new cell
+		for i := original_num_keys; i > index; i-- {
+			copy(internal_node_cell(*parent, i)[:INTERNAL_NODE_CELL_SIZE], internal_node_cell(*parent, i-1)[:INTERNAL_NODE_CELL_SIZE])
+		}
+		set_internal_node_cell(*parent, index, child_page_num, child_max_key)
+	}
+	set_internal_node_num_keys(*parent, original_num_keys+1)
+	return nil
+}
+
+// internal_node_split_and_insert splits a full internal node in two, adds the
+// new child to whichever half it belongs to and pushes the new node into the parent.
+func internal_node_split_and_insert(table *Table, old_page_num uint32, child_page_num uint32) error {
+	old_node, err := get_page(table.pager, old_page_num)
+	if err != nil {
+		return err
+	}
+	right_max, err := get_node_max_key(table.pager, *old_node)
+	if err != nil {
+		return err
+	}
+
+	child, err := get_page(table.pager, child_page_num)
+	if err != nil {
+		return err
+	}
+	child_max, err := get_node_max_key(table.pager, *child)
+	if err != nil {
+		return err
+	}
+
+	// Gather every child of the overfull node, including the new one, in key order.
+	old_children, old_keys, err := internal_node_entries(*old_node)
+	if err != nil {
+		return err
+	}
+	old_keys = append(old_keys, right_max)
+	children := make([]uint32, 0, len(old_children)+1)
+	keys := make([]uint32, 0, len(old_children)+1)
+	inserted := false
+	for i, page_num := range old_children {
+		key := old_keys[i]
+		if !inserted && child_max < key {
+			children = append(children, child_page_num)
+			keys = append(keys, child_max)
+			inserted = true
+		}
+		children = append(children, page_num)
+		keys = append(keys, key)
+	}
+	if !inserted {
+		children = append(children, child_page_num)
+		keys = append(keys, child_max)
+	}
+
+	new_page_num, err := get_unused_page_num(table.pager)
+	if err != nil {
+		return err
+	}
+	new_node, err := get_page_for_write(table.pager, new_page_num)
+	if err != nil {
+		return err
+	}
+	initialize_internal_node(*new_node)
+
+	left_count := uint32(len(children)) / 2
+	if err := internal_node_fill(table, old_page_num, children[:left_count], keys[:left_count]); err != nil {
+		return err
+	}
+	if err := internal_node_fill(table, new_page_num, children[left_count:], keys[left_count:]); err != nil {
+		return err
+	}
+
+	if is_node_root(*old_node) {
+		return create_new_root(table, new_page_num)
+	}
+
+	parent_page_num := node_parent(*old_node)
+	parent, err := get_page_for_write(table.pager, parent_page_num)
+	if err != nil {
+		return err
+	}
+	old_max, err := get_node_max_key(table.pager, *old_node)
+	if err != nil {
+		return err
+	}
+	if err := update_internal_node_key(*parent, old_page_num, old_max); err != nil {
+		return err
+	}
+	return internal_node_insert(table, parent_page_num, new_page_num)
+}
+
+// internal_node_fill overwrites the cells of an internal node with the given
+// children; the last child becomes the right child.
+func internal_node_fill(table *Table, page_num uint32, children []uint32, keys []uint32) error {
+	node, err := get_page_for_write(table.pager, page_num)
+	if err != nil {
+		return err
+	}
+	num_keys := uint32(len(children)) - 1
+
+	for i := uint32(0); i < num_keys; i++ {
+		set_internal_node_cell(*node, i, children[i], keys[i])
+	}
+	set_internal_node_num_keys(*node, num_keys)
+	set_internal_node_right_child(*node, children[num_keys])
+
+	for _, child_page_num := range children {
+		child, err := get_page_for_write(table.pager, child_page_num)
+		if err != nil {
+			return err
+		}
+		set_node_parent(*child, page_num)
+	}
+	return nil
+}
+
+func leaf_node_num_cells(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NUM_CELLS_OFFSET:])
+}
+
+func set_leaf_node_num_cells(node []byte, num_cells uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NUM_CELLS_OFFSET:], num_cells)
+}
+
+// leaf_node_next_leaf returns the page number of the right sibling, or 0 for the right-most leaf.
+// Page 0 holds the database header, so it can never be a sibling.
+func leaf_node_next_leaf(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:])
+}
+
+func set_leaf_node_next_leaf(node []byte, page_num uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:], page_num)
+}
+
+func leaf_node_content_start(node []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(node[LEAF_NODE_CONTENT_START_OFFSET:]))
+}
+
+func set_leaf_node_content_start(node []byte, offset uint32) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_CONTENT_START_OFFSET:], uint16(offset))
+}
+
+func leaf_node_fragmented(node []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(node[LEAF_NODE_FRAGMENTED_OFFSET:]))
+}
+
+func set_leaf_node_fragmented(node []byte, size uint32) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_FRAGMENTED_OFFSET:], uint16(size))
+}
+
+func leaf_node_slot(node []byte, cell_num uint32) []byte {
+	return node[LEAF_NODE_HEADER_SIZE+cell_num*LEAF_NODE_SLOT_SIZE:]
+}
+
+// leaf_node_cell returns the cell with the given index, key and record included.
+func leaf_node_cell(node []byte, cell_num uint32) []byte {
+	offset := uint32(binary.LittleEndian.Uint16(leaf_node_slot(node, cell_num)))
+	record_size := binary.LittleEndian.Uint32(node[offset+LEAF_NODE_RECORD_SIZE_OFFSET:])
+	cell_size := LEAF_NODE_CELL_HEADER_SIZE + leaf_cell_local_size(record_size)
+	if record_size > LEAF_NODE_MAX_LOCAL {
+		cell_size += OVERFLOW_POINTER_SIZE
+	}
+	return node[offset : offset+cell_size]
+}
+
+// leaf_node_make_cell serializes a row into a new cell of the table.
+func leaf_node_make_cell(table *Table, key uint32, value *Row) ([]byte, error) {
+	record := make([]byte, record_size(table.schema, value))
+	serialize_row(table.schema, value, record)
+	return leaf_cell_build(table.pager, key, record)
+}
+
+// leaf_cell_space is the room a cell takes in a leaf, its slot included.
+func leaf_cell_space(cell []byte) uint32 {
+	return uint32(len(cell)) + LEAF_NODE_SLOT_SIZE
+}
+
+// leaf_node_free_space counts every unused byte of the leaf, holes included.
+func leaf_node_free_space(node []byte) uint32 {
+	slots_end := LEAF_NODE_HEADER_SIZE + leaf_node_num_cells(node)*LEAF_NODE_SLOT_SIZE
+	return leaf_node_content_start(node) - slots_end + leaf_node_fragmented(node)
+}
+
+func leaf_node_used_space(node []byte) uint32 {
+	return LEAF_NODE_SPACE_FOR_CELLS - leaf_node_free_space(node)
+}
+
+// leaf_node_cells returns copies of every cell of a leaf in key order.
+func leaf_node_cells(node []byte) [][]byte {
+	num_cells := leaf_node_num_cells(node)
+	cells := make([][]byte, num_cells)
+	for i := uint32(0); i < num_cells; i++ {
+		cells[i] = append([]byte(nil), leaf_node_cell(node, i)...)
+	}
+	return cells
+}
+
+// leaf_node_fill replaces the cells of a leaf, packing them against the end of
+// the page.
+func leaf_node_fill(node []byte, cells [][]byte) {
+	set_leaf_node_num_cells(node, 0)
+	set_leaf_node_content_start(node, PAGE_SIZE)
+	set_leaf_node_fragmented(node, 0)
+	for i, cell := range cells {
+		leaf_node_insert_cell(node, uint32(i), cell)
+	}
+}
+
+// leaf_node_defragment moves the cells of a leaf together so that all of its
+// free space is in one piece.
+func leaf_node_defragment(node []byte) {
+	leaf_node_fill(node, leaf_node_cells(node))
+}
+
+// leaf_node_insert_cell puts a cell at the given index. The caller makes sure
+// the leaf has room for it.
+func leaf_node_insert_cell(node []byte, cell_num uint32, cell []byte) {
+	num_cells := leaf_node_num_cells(node)
+	slots_end := LEAF_NODE_HEADER_SIZE + (num_cells+1)*LEAF_NODE_SLOT_SIZE
+	if leaf_node_content_start(node) < slots_end+uint32(len(cell)) {
+		leaf_node_defragment(node)
+	}
+
+	offset := leaf_node_content_start(node) - uint32(len(cell))
+	copy(node[offset:], cell)
+	set_leaf_node_content_start(node, offset)
+
+	slots := node[LEAF_NODE_HEADER_SIZE:slots_end]
+	copy(slots[(cell_num+1)*LEAF_NODE_SLOT_SIZE:], slots[cell_num*LEAF_NODE_SLOT_SIZE:])
+	binary.LittleEndian.PutUint16(leaf_node_slot(node, cell_num), uint16(offset))
+	set_leaf_node_num_cells(node, num_cells+1)
+}
+
+// leaf_node_remove_cell drops the cell at the given index. Its bytes become a
+// hole unless they were at the start of the content area.
+func leaf_node_remove_cell(node []byte, cell_num uint32) {
+	cell := leaf_node_cell(node, cell_num)
+	offset := uint32(binary.LittleEndian.Uint16(leaf_node_slot(node, cell_num)))
+	size := uint32(len(cell))
+
+	num_cells := leaf_node_num_cells(node)
+	slots := node[LEAF_NODE_HEADER_SIZE : LEAF_NODE_HEADER_SIZE+num_cells*LEAF_NODE_SLOT_SIZE]
+	copy(slots[cell_num*LEAF_NODE_SLOT_SIZE:], slots[(cell_num+1)*LEAF_NODE_SLOT_SIZE:])
+	set_leaf_node_num_cells(node, num_cells-1)
+
+	if offset == leaf_node_content_start(node) {
+		set_leaf_node_content_start(node, offset+size)
+	} else {
+		set_leaf_node_fragmented(node, leaf_node_fragmented(node)+size)
+	}
+}
+
+// leaf_node_split_point returns how many of the cells go to the left half of a
+// split so that both halves use about the same space.
+func leaf_node_split_point(cells [][]byte) uint32 {
+	total := uint32(0)
+	for _, cell := range cells {
+		total += leaf_cell_space(cell)
+	}
+
+	left := uint32(0)
+	for i, cell := range cells {
+		left += leaf_cell_space(cell)
+		if left >= total/2 {
+			return min(uint32(i+1), uint32(len(cells)-1))
+		}
+	}
+	return uint32(len(cells) - 1)
+}
+
+func leaf_node_key(node []byte, cellNum uint32) uint32 {
+	return binary.LittleEndian.Uint32(leaf_node_cell(node, cellNum))
+}
+
+// leaf_node_value returns the record of a cell, following its overflow pages.
+func leaf_node_value(pager *Pager, node []byte, cell_num uint32) ([]byte, error) {
+	return leaf_cell_record(pager, leaf_node_cell(node, cell_num))
+}
+
+func leaf_node_find(table *Table, page_num uint32, key uint32) (*Cursor, error) {
+	node, err := get_page(table.pager, page_num)
+	if err != nil {
+		return nil, err
+	}
+	numCells := leaf_node_num_cells(*node)
+	if err := leaf_node_check(*node, page_num); err != nil {
+		return nil, err
+	}
+
+	cursor := &Cursor{
+		table:   table,
+		page_num: page_num,
+	}
+
+	minIndex := uint32(0)
+	onePastMaxIndex := numCells
+
+	for onePastMaxIndex != minIndex {
+		index := (minIndex + onePastMaxIndex) / 2
+		keyAtIndex := leaf_node_key(*node, index)
+		if key == keyAtIndex {
+			cursor.cell_num = index
+			return cursor, nil
+		}
+		if key < keyAtIndex {
+			onePastMaxIndex = index
+		} else {
+			minIndex = index + 1
+		}
+	}
+
+	cursor.cell_num = minIndex
+	return cursor, nil
+}
+
+// leaf_node_check makes sure the header of a leaf read from disk describes
+// slots that fit in its page.
+func leaf_node_check(node []byte, page_num uint32) error {
+	slots_end := uint64(LEAF_NODE_HEADER_SIZE) + uint64(leaf_node_num_cells(node))*uint64(LEAF_NODE_SLOT_SIZE)
+	if get_node_type(node) != NODE_LEAF || uint64(leaf_node_content_start(node)) < slots_end {
+		return corrupt_error("page %d is not a valid leaf", page_num)
+	}
+	return nil
+}
+
+// leaf_node_split_and_insert splits a leaf that has no room for the new cell,
+// dividing the cells between the two halves by the space they use.
+func leaf_node_split_and_insert(cursor *Cursor, cell []byte) error {
+	oldNode, err := get_page_for_write(cursor.table.pager, cursor.page_num)
+	if err != nil {
+		return err
+	}
+	newPageNum, err := get_unused_page_num(cursor.table.pager)
+	if err != nil {
+		return err
+	}
+	newNode, err := get_page_for_write(cursor.table.pager, newPageNum)
+	if err != nil {
+		return err
+	}
+	initialize_leaf_node(*newNode)
+	set_node_parent(*newNode, node_parent(*oldNode))
+	set_leaf_node_next_leaf(*newNode, leaf_node_next_leaf(*oldNode))
+	set_leaf_node_next_leaf(*oldNode, newPageNum)
+
+	cells := leaf_node_cells(*oldNode)
+	cells = append(cells[:cursor.cell_num], append([][]byte{cell}, cells[cursor.cell_num:]...)...)
+	leftCount := leaf_node_split_point(cells)
+	leaf_node_fill(*oldNode, cells[:leftCount])
+	leaf_node_fill(*newNode, cells[leftCount:])
+
+	if is_node_root(*oldNode) {
+		return create_new_root(cursor.table, newPageNum)
+	}
+
+	parentPageNum := node_parent(*oldNode)
+	newMax, err := get_node_max_key(cursor.table.pager, *oldNode)
+	if err != nil {
+		return err
+	}
+	parent, err := get_page_for_write(cursor.table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+
+	if err := update_internal_node_key(*parent, cursor.page_num, newMax); err != nil {
+		return err
+	}
+	return internal_node_insert(cursor.table, parentPageNum, newPageNum)
+}
+
+func get_node_type(node []byte) int {
+	value := int(node[NODE_TYPE_OFFSET])
+	return value
+}
+
+func set_node_type(node []byte, nodeType int) {
+	value := uint8(nodeType)
+	node[NODE_TYPE_OFFSET] = value
+}
+
+func printConstants() {
+	fmt.Printf("COMMON_NODE_HEADER_SIZE: %d\n", COMMON_NODE_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_HEADER_SIZE: %d\n", LEAF_NODE_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_CELL_HEADER_SIZE: %d\n", LEAF_NODE_CELL_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_SPACE_FOR_CELLS: %d\n", LEAF_NODE_SPACE_FOR_CELLS)
+	fmt.Printf("LEAF_NODE_MAX_LOCAL: %d\n", LEAF_NODE_MAX_LOCAL)
+}
+
+func printLeafNode(node []byte) {
+	numCells := leaf_node_num_cells(node)
+	fmt.Printf("leaf (size %d)\n", numCells)
+	for i := uint32(0); i < numCells; i++ {
+		key := leaf_node_key(node, i)
+		fmt.Printf("  - %d : %d\n", i, key)
+	}
+}
+
+func initialize_leaf_node(node []byte) {
+	set_node_type(node, NODE_LEAF)
+	set_node_root(node, false)
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NUM_CELLS_OFFSET:], 0)
+	set_leaf_node_next_leaf(node, 0)
+	set_leaf_node_content_start(node, PAGE_SIZE)
+	set_leaf_node_fragmented(node, 0)
+}
+
+func leaf_node_insert(cursor *Cursor, key uint32, value *Row) error {
+	node, err := get_page_for_write(cursor.table.pager, cursor.page_num)
+	if err != nil {
+		return err
+	}
+
+	cell, err := leaf_node_make_cell(cursor.table, key, value)
+	if err != nil {
+		return err
+	}
+	return leaf_node_place_cell(cursor, *node, cell)
+}
+
+// leaf_node_place_cell puts a cell at the cursor, splitting the leaf if it has
+// no room for it.
+func leaf_node_place_cell(cursor *Cursor, node []byte, cell []byte) error {
+	if leaf_cell_space(cell) > leaf_node_free_space(node) {
+		return leaf_node_split_and_insert(cursor, cell);
+	}
+
+	leaf_node_insert_cell(node, cursor.cell_num, cell)
+	return nil
+}
+
+// leaf_node_update replaces the row under the cursor. A row that grew too
+// large for its leaf splits it like an insert would, and one that shrank can
+// leave it underflowing, which is rebalanced like a delete.
+func leaf_node_update(cursor *Cursor, value *Row) error {
+	node, err := get_page_for_write(cursor.table.pager, cursor.page_num)
+	if err != nil {
+		return err
+	}
+	key := leaf_node_key(*node, cursor.cell_num)
+
+	old_cell := leaf_node_cell(*node, cursor.cell_num)
+	if err := overflow_free(cursor.table.pager, leaf_cell_overflow_page(old_cell)); err != nil {
+		return err
+	}
+	cell, err := leaf_node_make_cell(cursor.table, key, value)
+	if err != nil {
+		return err
+	}
+	if len(old_cell) == len(cell) {
+		copy(old_cell, cell)
+		return nil
+	}
+
+	leaf_node_remove_cell(*node, cursor.cell_num)
+	if err := leaf_node_place_cell(cursor, *node, cell); err != nil {
+		return err
+	}
+	if len(cell) < len(old_cell) && !is_node_root(*node) && leaf_node_used_space(*node) < LEAF_NODE_MIN_SPACE {
+		return leaf_node_rebalance(cursor.table, cursor.page_num)
+	}
+	return nil
+}
+
+
+func print_constants(w io.Writer) {
+    fmt.Fprintf(w, "COMMON_NODE_HEADER_SIZE: %d\n", COMMON_NODE_HEADER_SIZE)
+    fmt.Fprintf(w, "LEAF_NODE_HEADER_SIZE: %d\n", LEAF_NODE_HEADER_SIZE)
+    fmt.Fprintf(w, "LEAF_NODE_CELL_HEADER_SIZE: %d\n", LEAF_NODE_CELL_HEADER_SIZE)
+    fmt.Fprintf(w, "LEAF_NODE_SPACE_FOR_CELLS: %d\n", LEAF_NODE_SPACE_FOR_CELLS)
+    fmt.Fprintf(w, "LEAF_NODE_MAX_LOCAL: %d\n", LEAF_NODE_MAX_LOCAL)
+}
+
+func print_leaf_node(node []byte) {
+    numCells := leaf_node_num_cells(node)
+    fmt.Printf("leaf (size %d)\n", numCells)
+    for i := uint32(0); i < numCells; i++ {
+        key := leaf_node_key(node, i)
+        fmt.Printf("  - %d : %d\n", i, key)
+    }
+}
+
+func indent(w io.Writer, level uint32) {
+    for i := uint32(0); i < level; i++ {
+        fmt.Fprint(w, "  ")
+    }
+}
+
+func print_tree(w io.Writer, pager *Pager, pageNum uint32, indentationLevel uint32) error {
+    node, err := get_page(pager, pageNum)
+    if err != nil {
+        return err
+    }
+    var numKeys, child uint32
+
+    switch get_node_type(*node) {
+    case NODE_LEAF:
+        numKeys = leaf_node_num_cells(*node)
+        indent(w, indentationLevel)
+        fmt.Fprintf(w, "- leaf (size %d)\n", numKeys)
+        for i := uint32(0); i < numKeys; i++ {
+            indent(w, indentationLevel + 1)
+            fmt.Fprintf(w, "- %d\n", leaf_node_key(*node, i))
+        }
+        // Printing only reads pages, so the leaf can be released right away.
+        pager_end_operation(pager)
+    case NODE_INTERNAL:
+        numKeys = internal_node_num_keys(*node)
+        indent(w, indentationLevel)
+        fmt.Fprintf(w, "- internal (size %d)\n", numKeys)
+        for i := uint32(0); i < numKeys; i++ {
+            if child, err = internal_node_child_page(*node, i); err != nil {
+                return err
+            }
+            if err = print_tree(w, pager, child, indentationLevel+1); err != nil {
+                return err
+            }
+
+            indent(w, indentationLevel + 1)
+            fmt.Fprintf(w, "- key %d\n", binary.LittleEndian.Uint32(internal_node_key(*node, i)))
+        }
+        child = internal_node_right_child(*node)
+        return print_tree(w, pager, child, indentationLevel+1)
+    }
+    return nil
+}
+
+// leaf_node_delete removes the cell under the cursor and rebalances the tree if the leaf underflows.
+func leaf_node_delete(cursor *Cursor) error {
+	table := cursor.table
+	node, err := get_page_for_write(table.pager, cursor.page_num)
+	if err != nil {
+		return err
+	}
+	if err := overflow_free(table.pager, leaf_cell_overflow_page(leaf_node_cell(*node, cursor.cell_num))); err != nil {
+		return err
+	}
+	leaf_node_remove_cell(*node, cursor.cell_num)
+	num_cells := leaf_node_num_cells(*node)
+
+	if is_node_root(*node) {
+		return nil
+	}
+
+	if num_cells > 0 && cursor.cell_num == num_cells {
+		if err := update_max_key(table, cursor.page_num, leaf_node_key(*node, num_cells-1)); err != nil {
+			return err
+		}
+	}
+	if leaf_node_used_space(*node) < LEAF_NODE_MIN_SPACE {
+		return leaf_node_rebalance(table, cursor.page_num)
+	}
+	return nil
+}
+
+// update_max_key fixes the separator key above a node whose maximum key changed.
+// The separator lives in the first ancestor where the subtree is not the right child.
+func update_max_key(table *Table, page_num uint32, new_max uint32) error {
+	node, err := get_page(table.pager, page_num)
+	if err != nil {
+		return err
+	}
+	for !is_node_root(*node) {
+		parent_page_num := node_parent(*node)
+		parent, err := get_page_for_write(table.pager, parent_page_num)
+		if err != nil {
+			return err
+		}
+		if internal_node_right_child(*parent) != page_num {
+			return update_internal_node_key(*parent, page_num, new_max)
+		}
+		page_num = parent_page_num
+		node = parent
+	}
+	return nil
+}
+
+// leaf_node_rebalance refills an underflowing leaf from a sibling. When the
+// two leaves fit in one they are merged; otherwise their cells are spread
+// evenly over both.
+func leaf_node_rebalance(table *Table, page_num uint32) error {
+	node, err := get_page_for_write(table.pager, page_num)
+	if err != nil {
+		return err
+	}
+	parent_page_num := node_parent(*node)
+	parent, err := get_page_for_write(table.pager, parent_page_num)
+	if err != nil {
+		return err
+	}
+	index, err := internal_node_child_index(*parent, page_num)
+	if err != nil {
+		return err
+	}
+
+	left_index := index
+	if index > 0 {
+		left_index = index - 1
+	}
+	left_page_num, err := internal_node_child_page(*parent, left_index)
+	if err != nil {
+		return err
+	}
+	left, err := get_page_for_write(table.pager, left_page_num)
+	if err != nil {
+		return err
+	}
+	right_page_num, err := internal_node_child_page(*parent, left_index+1)
+	if err != nil {
+		return err
+	}
+	right, err := get_page_for_write(table.pager, right_page_num)
+	if err != nil {
+		return err
+	}
+
+	if leaf_node_used_space(*left)+leaf_node_used_space(*right) <= LEAF_NODE_SPACE_FOR_CELLS {
+		return leaf_node_merge(table, parent_page_num, left_index)
+	}
+
+	cells := append(leaf_node_cells(*left), leaf_node_cells(*right)...)
+	left_count := leaf_node_split_point(cells)
+	leaf_node_fill(*left, cells[:left_count])
+	leaf_node_fill(*right, cells[left_count:])
+	binary.LittleEndian.PutUint32(internal_node_key(*parent, left_index), leaf_node_key(*left, left_count-1))
+	// The right leaf may have been emptied, leaving its key behind.
+	right_max, err := get_node_max_key(table.pager, *right)
+	if err != nil {
+		return err
+	}
+	return update_max_key(table, right_page_num, right_max)
+}
+
+// leaf_node_merge moves every cell of the child at left_index+1 into the child at left_index.
+func leaf_node_merge(table *Table, parent_page_num uint32, left_index uint32) error {
+	parent, err := get_page(table.pager, parent_page_num)
+	if err != nil {
+		return err
+	}
+	left_page_num, err := internal_node_child_page(*parent, left_index)
+	if err != nil {
+		return err
+	}
+	left, err := get_page_for_write(table.pager, left_page_num)
+	if err != nil {
+		return err
+	}
+	right_page_num, err := internal_node_child_page(*parent, left_index+1)
+	if err != nil {
+		return err
+	}
+	right, err := get_page(table.pager, right_page_num)
+	if err != nil {
+		return err
+	}
+
+	leaf_node_fill(*left, append(leaf_node_cells(*left), leaf_node_cells(*right)...))
+	set_leaf_node_next_leaf(*left, leaf_node_next_leaf(*right))
+	// The merged leaf inherits the key of the right one, which is stale if
+	// the right leaf was emptied.
+	left_max, err := get_node_max_key(table.pager, *left)
+	if err != nil {
+		return err
+	}
+	if err := update_max_key(table, right_page_num, left_max); err != nil {
+		return err
+	}
+
+	if err := internal_node_remove_child(table, parent_page_num, left_index); err != nil {
+		return err
+	}
+	return free_page(table.pager, right_page_num)
+}
+
+// internal_node_remove_child drops the child at index+1 after it was merged into the child at index.
+// The merged child inherits the key of the removed one, which is its new maximum.
+func internal_node_remove_child(table *Table, page_num uint32, index uint32) error {
+	node, err := get_page(table.pager, page_num)
+	if err != nil {
+		return err
+	}
+	children, keys, err := internal_node_entries(*node)
+	if err != nil {
+		return err
+	}
+	children = append(children[:index+1], children[index+2:]...)
+	keys = append(keys[:index], keys[index+1:]...)
+	if err := internal_node_fill(table, page_num, children, keys); err != nil {
+		return err
+	}
+
+	num_keys := internal_node_num_keys(*node)
+	if is_node_root(*node) {
+		if num_keys == 0 {
+			return collapse_root(table)
+		}
+	} else if num_keys < INTERNAL_NODE_MIN_KEYS {
+		return internal_node_rebalance(table, page_num)
+	}
+	return nil
+}
+
+// internal_node_rebalance refills an underflowing internal node from a sibling, or merges them.
+func internal_node_rebalance(table *Table, page_num uint32) error {
+	node, err := get_page(table.pager, page_num)
+	if err != nil {
+		return err
+	}
+	parent_page_num := node_parent(*node)
+	parent, err := get_page_for_write(table.pager, parent_page_num)
+	if err != nil {
+		return err
+	}
+	index, err := internal_node_child_index(*parent, page_num)
+	if err != nil {
+		return err
+	}
+	children, keys, err := internal_node_entries(*node)
+	if err != nil {
+		return err
+	}
+
+	if index > 0 {
+		left_page_num, err := internal_node_child_page(*parent, index-1)
+		if err != nil {
+			return err
+		}
+		left, err := get_page(table.pager, left_page_num)
+		if err != nil {
+			return err
+		}
+		if internal_node_num_keys(*left) > INTERNAL_NODE_MIN_KEYS {
+			// Move the right child of the left sibling to the front of this node
+			left_children, left_keys, err := internal_node_entries(*left)
+			if err != nil {
+				return err
+			}
+			separator := binary.LittleEndian.Uint32(internal_node_key(*parent, index-1))
+			last := len(left_keys) - 1
+
+			children = append([]uint32{left_children[last+1]}, children...)
+			keys = append([]uint32{separator}, keys...)
+			if err := internal_node_fill(table, page_num, children, keys); err != nil {
+				return err
+			}
+			if err := internal_node_fill(table, left_page_num, left_children[:last+1], left_keys[:last]); err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(internal_node_key(*parent, index-1), left_keys[last])
+			return nil
+		}
+	}
+
+	if index < internal_node_num_keys(*parent) {
+		right_page_num, err := internal_node_child_page(*parent, index+1)
+		if err != nil {
+			return err
+		}
+		right, err := get_page(table.pager, right_page_num)
+		if err != nil {
+			return err
+		}
+		if internal_node_num_keys(*right) > INTERNAL_NODE_MIN_KEYS {
+			// Move the first child of the right sibling to the end of this node
+			right_children, right_keys, err := internal_node_entries(*right)
+			if err != nil {
+				return err
+			}
+			separator := binary.LittleEndian.Uint32(internal_node_key(*parent, index))
+
+			children = append(children, right_children[0])
+			keys = append(keys, separator)
+			if err := internal_node_fill(table, page_num, children, keys); err != nil {
+				return err
+			}
+			if err := internal_node_fill(table, right_page_num, right_children[1:], right_keys[1:]); err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(internal_node_key(*parent, index), right_keys[0])
+			return nil
+		}
+	}
+
+	left_index := index
+	if index > 0 {
+		left_index = index - 1
+	}
+	left_page_num, err := internal_node_child_page(*parent, left_index)
+	if err != nil {
+		return err
+	}
+	left, err := get_page(table.pager, left_page_num)
+	if err != nil {
+		return err
+	}
+	right_page_num, err := internal_node_child_page(*parent, left_index+1)
+	if err != nil {
+		return err
+	}
+	right, err := get_page(table.pager, right_page_num)
+	if err != nil {
+		return err
+	}
+	left_children, left_keys, err := internal_node_entries(*left)
+	if err != nil {
+		return err
+	}
+	right_children, right_keys, err := internal_node_entries(*right)
+	if err != nil {
+		return err
+	}
+
+	// The separator from the parent becomes the key between the two halves.
+	left_keys = append(left_keys, binary.LittleEndian.Uint32(internal_node_key(*parent, left_index)))
+	if err := internal_node_fill(table, left_page_num, append(left_children, right_children...), append(left_keys, right_keys...)); err != nil {
+		return err
+	}
+
+	if err := internal_node_remove_child(table, parent_page_num, left_index); err != nil {
+		return err
+	}
+	return free_page(table.pager, right_page_num)
+}
+
+// collapse_root replaces a root with a single child by that child, shrinking the tree by one level.
+func collapse_root(table *Table) error {
+	root, err := get_page_for_write(table.pager, table.root_page_num)
+	if err != nil {
+		return err
+	}
+	child_page_num := internal_node_right_child(*root)
+	child, err := get_page(table.pager, child_page_num)
+	if err != nil {
+		return err
+	}
+
+	copy(*root, *child)
+	set_node_root(*root, true)
+	set_node_parent(*root, 0)
+
+	if get_node_type(*root) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(*root); i++ {
+			grandchild_page_num, err := internal_node_child_page(*root, i)
+			if err != nil {
+				return err
+			}
+			grandchild, err := get_page_for_write(table.pager, grandchild_page_num)
+			if err != nil {
+				return err
+			}
+			set_node_parent(*grandchild, table.root_page_num)
+		}
+	}
+	return free_page(table.pager, child_page_num)
+}
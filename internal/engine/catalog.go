@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The catalog is a table rooted on page 1 that lists every table and index in
+// the database, much like sqlite_master. Each row holds the root page of a
+// table or index and the create statement that defines it.
+const (
+	CATALOG_NAME          = "godb_master"
+	CATALOG_ROOT_PAGE_NUM = 1
+)
+
+const (
+	CATALOG_COLUMN_ID = iota
+	CATALOG_COLUMN_TYPE
+	CATALOG_COLUMN_NAME
+	CATALOG_COLUMN_ROOT_PAGE
+	CATALOG_COLUMN_SQL
+)
+
+var catalog_schema = &Schema{
+	name: CATALOG_NAME,
+	columns: []Column{
+		{name: "id", column_type: COLUMN_TYPE_INTEGER},
+		{name: "type", column_type: COLUMN_TYPE_TEXT},
+		{name: "name", column_type: COLUMN_TYPE_TEXT},
+		{name: "root_page", column_type: COLUMN_TYPE_INTEGER},
+		{name: "sql", column_type: COLUMN_TYPE_TEXT},
+	},
+}
+
+// Database is an open database file and the tables its catalog lists.
+type Database struct {
+	pager       *Pager
+	catalog     *Table
+	tables      []*Table // in the order they were created
+	sort_memory int
+}
+
+// find_table looks a table up by name. The catalog itself can be found too.
+func find_table(db *Database, name string) (*Table, bool) {
+	if name == CATALOG_NAME {
+		return db.catalog, true
+	}
+	for _, table := range db.tables {
+		if table.schema.name == name {
+			return table, true
+		}
+	}
+	return nil, false
+}
+
+// find_index looks an index up by name.
+func find_index(db *Database, name string) (*Index, bool) {
+	for _, table := range db.tables {
+		for _, index := range table.indexes {
+			if index.name == name {
+				return index, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// schema_sql renders the create table statement stored in the catalog.
+func schema_sql(schema *Schema) string {
+	columns := make([]string, len(schema.columns))
+	for i, column := range schema.columns {
+		columns[i] = quote_identifier(column.name) + " " + column_type_name(column.column_type)
+	}
+	return fmt.Sprintf("create table %s (%s)", quote_identifier(schema.name), strings.Join(columns, ", "))
+}
+
+// quote_identifier quotes a name that would not read back as the same
+// identifier, such as a keyword or a name with spaces.
+func quote_identifier(name string) string {
+	tokens, err := tokenize(name)
+	if err == nil && len(tokens) == 2 && tokens[0].token_type == TOKEN_IDENTIFIER && tokens[0].text == name && name[0] != '"' {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func catalog_row(id int64, schema *Schema, root_page_num uint32) *Row {
+	return &Row{values: []Value{
+		{value_type: COLUMN_TYPE_INTEGER, integer: id},
+		{value_type: COLUMN_TYPE_TEXT, text: "table"},
+		{value_type: COLUMN_TYPE_TEXT, text: schema.name},
+		{value_type: COLUMN_TYPE_INTEGER, integer: int64(root_page_num)},
+		{value_type: COLUMN_TYPE_TEXT, text: schema_sql(schema)},
+	}}
+}
+
+// index_sql renders the create index statement stored in the catalog.
+func index_sql(index *Index) string {
+	schema := index.table.schema
+	return fmt.Sprintf("create index %s on %s (%s)", quote_identifier(index.name), quote_identifier(schema.name), quote_identifier(schema.columns[index.column].name))
+}
+
+func catalog_index_row(id int64, index *Index) *Row {
+	return &Row{values: []Value{
+		{value_type: COLUMN_TYPE_INTEGER, integer: id},
+		{value_type: COLUMN_TYPE_TEXT, text: "index"},
+		{value_type: COLUMN_TYPE_TEXT, text: index.name},
+		{value_type: COLUMN_TYPE_INTEGER, integer: int64(index.root_page_num)},
+		{value_type: COLUMN_TYPE_TEXT, text: index_sql(index)},
+	}}
+}
+
+// catalog_load reads the catalog into db.tables, replacing whatever was
+// there. It runs on open and after a rollback.
+func catalog_load(db *Database) error {
+	db.tables = nil
+
+	var row Row
+	cursor, err := table_start(db.catalog)
+	if err != nil {
+		return err
+	}
+	for !cursor.end_of_table {
+		source, err := cursor_value(cursor)
+		if err != nil {
+			return err
+		}
+		if err := deserialize_row(catalog_schema, source, &row); err != nil {
+			return err
+		}
+		root_page_num := uint32(row.values[CATALOG_COLUMN_ROOT_PAGE].integer)
+		if row.values[CATALOG_COLUMN_TYPE].text == "index" {
+			if err := catalog_load_index(db, row.values[CATALOG_COLUMN_SQL].text, root_page_num); err != nil {
+				return err
+			}
+		} else {
+			schema, result := parse_create_table(row.values[CATALOG_COLUMN_SQL].text)
+			if result != PREPARE_SUCCESS {
+				return corrupt_error("catalog entry for %s", row.values[CATALOG_COLUMN_NAME].text)
+			}
+			db.tables = append(db.tables, &Table{pager: db.pager, root_page_num: root_page_num, schema: schema})
+		}
+		if err := cursor_advance(cursor); err != nil {
+			return err
+		}
+		pager_end_operation(db.pager)
+	}
+	return nil
+}
+
+// catalog_load_index attaches an index listed in the catalog to its table,
+// which is always listed before it.
+func catalog_load_index(db *Database, sql string, root_page_num uint32) error {
+	ast, result, _ := parse_sql(sql)
+	if result != PREPARE_SUCCESS || ast.statement_type != STATEMENT_CREATE_INDEX {
+		return corrupt_error("catalog entry %s", sql)
+	}
+	statement := NewStatement()
+	if prepare_create_index(ast, statement, db) != PREPARE_SUCCESS {
+		return corrupt_error("catalog entry %s", sql)
+	}
+	index := statement.index
+	index.root_page_num = root_page_num
+	index.table.indexes = append(index.table.indexes, index)
+	return nil
+}
+
+// catalog_next_id returns the id for a new catalog row.
+func catalog_next_id(db *Database) (int64, error) {
+	id := int64(1)
+	cursor, err := table_start(db.catalog)
+	if err != nil {
+		return 0, err
+	}
+	for !cursor.end_of_table {
+		key, err := cursor_key(cursor)
+		if err != nil {
+			return 0, err
+		}
+		id = int64(key) + 1
+		if err := cursor_advance(cursor); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// catalog_create_root gives a new table or index an empty root page.
+func catalog_create_root(db *Database, initialize func(node []byte)) (uint32, error) {
+	root_page_num, err := get_unused_page_num(db.pager)
+	if err != nil {
+		return 0, err
+	}
+	root, err := get_page_for_write(db.pager, root_page_num)
+	if err != nil {
+		return 0, err
+	}
+	initialize(*root)
+	set_node_root(*root, true)
+	return root_page_num, nil
+}
+
+// catalog_create_table gives a new table an empty root leaf and records it in
+// the catalog.
+func catalog_create_table(db *Database, schema *Schema) (*Table, error) {
+	id, err := catalog_next_id(db)
+	if err != nil {
+		return nil, err
+	}
+	root_page_num, err := catalog_create_root(db, initialize_leaf_node)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := table_insert(db.catalog, catalog_row(id, schema, root_page_num)); err != nil {
+		return nil, err
+	}
+
+	table := &Table{pager: db.pager, root_page_num: root_page_num, schema: schema}
+	db.tables = append(db.tables, table)
+	return table, nil
+}
+
+// catalog_create_index gives a new index an empty root leaf, records it in
+// the catalog and attaches it to its table. The caller fills it.
+func catalog_create_index(db *Database, index *Index) (*Index, error) {
+	id, err := catalog_next_id(db)
+	if err != nil {
+		return nil, err
+	}
+	index.root_page_num, err = catalog_create_root(db, func(node []byte) {
+		initialize_index_node(node, NODE_LEAF)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := table_insert(db.catalog, catalog_index_row(id, index)); err != nil {
+		return nil, err
+	}
+
+	index.table.indexes = append(index.table.indexes, index)
+	return index, nil
+}
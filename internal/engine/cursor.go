@@ -0,0 +1,127 @@
+package engine
+
+type Cursor struct {
+	table       *Table
+	page_num    uint32
+	cell_num    uint32
+	end_of_table  bool // Indicates a position one past the last element
+	index       *IndexCursor // set when the rows are read in the order of an index
+}
+
+// table_start returns a cursor positioned on the first row of the left-most leaf.
+func table_start(table *Table) (*Cursor, error) {
+	cursor, err := table_find(table, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := get_page(table.pager, cursor.page_num)
+	if err != nil {
+		return nil, err
+	}
+	num_cells := leaf_node_num_cells(*node)
+	cursor.end_of_table = (num_cells == 0)
+
+	return cursor, nil
+}
+
+func table_find(table *Table, key uint32) (*Cursor, error) {
+	root_page_num := table.root_page_num
+	rootNode, err := get_page(table.pager, root_page_num)
+	if err != nil {
+		return nil, err
+	}
+
+	if get_node_type(*rootNode) == NODE_LEAF {
+		return leaf_node_find(table, root_page_num, key)
+	} else {
+		return internal_node_find(table, root_page_num, key)
+	}
+}
+
+// table_seek returns a cursor positioned on the first row whose key is >= key.
+func table_seek(table *Table, key uint32) (*Cursor, error) {
+	cursor, err := table_find(table, key)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := get_page(table.pager, cursor.page_num)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.cell_num >= leaf_node_num_cells(*node) {
+		// Every key in this leaf is smaller, so the row we want starts the next leaf.
+		next_page_num := leaf_node_next_leaf(*node)
+		if next_page_num == 0 {
+			cursor.end_of_table = true
+		} else {
+			cursor.page_num = next_page_num
+			cursor.cell_num = 0
+		}
+	}
+
+	return cursor, nil
+}
+
+// table_count_rows adds up the number of cells of every leaf, reading only
+// the leaf headers.
+func table_count_rows(table *Table) (uint64, error) {
+	count := uint64(0)
+	cursor, err := table_find(table, 0)
+	if err != nil {
+		return 0, err
+	}
+	page_num := cursor.page_num
+	for {
+		node, err := get_page(table.pager, page_num)
+		if err != nil {
+			return 0, err
+		}
+		count += uint64(leaf_node_num_cells(*node))
+		page_num = leaf_node_next_leaf(*node)
+		pager_end_operation(table.pager)
+		if page_num == 0 {
+			return count, nil
+		}
+	}
+}
+
+func cursor_key(cursor *Cursor) (uint32, error) {
+	page, err := get_page(cursor.table.pager, cursor.page_num)
+	if err != nil {
+		return 0, err
+	}
+
+	return leaf_node_key(*page, cursor.cell_num), nil
+}
+
+func cursor_value(cursor *Cursor) ([]byte, error) {
+	page, err := get_page(cursor.table.pager, cursor.page_num)
+	if err != nil {
+		return nil, err
+	}
+
+	return leaf_node_value(cursor.table.pager, *page, cursor.cell_num)
+}
+
+func cursor_advance(cursor *Cursor) error {
+	page_num := cursor.page_num
+	node, err := get_page(cursor.table.pager, page_num)
+	if err != nil {
+		return err
+	}
+	cursor.cell_num += 1
+	if cursor.cell_num >= leaf_node_num_cells(*node) {
+		// Move on to the next leaf
+		next_page_num := leaf_node_next_leaf(*node)
+		if next_page_num == 0 {
+			// This was the right-most leaf
+			cursor.end_of_table = true
+		} else {
+			cursor.page_num = next_page_num
+			cursor.cell_num = 0
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+// Package engine is the storage and query engine of godb: the pager with its
+// log or journal, the B-trees, the SQL parser and the executor. Package godb
+// wraps it in the API programs use, and what it exports is what that API
+// needs.
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInTransaction is returned by Database.Vacuum while a transaction is
+// active.
+var ErrInTransaction = errors.New("godb: cannot vacuum inside a transaction")
+
+// ErrNoTable is returned for a table that does not exist.
+var ErrNoTable = errors.New("godb: no such table")
+
+// Error is a statement that failed, which package godb reports as its own
+// Error.
+type Error struct {
+	Message string
+	Ran     bool  // the statement got past preparing and failed while running
+	Err     error // what errors.Is and errors.As see through the error
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+var prepare_messages = map[int]string{
+	PREPARE_STRING_TOO_LONG:       "String is too long",
+	PREPARE_NEGATIVE_ID:           "ID must be positive",
+	PREPARE_SYNTAX_ERROR:          "syntax error. could not parse statement",
+	PREPARE_UNRECOGNIZED_TABLE:    "unrecognized table",
+	PREPARE_UNRECOGNIZED_COLUMN:   "unrecognized column",
+	PREPARE_ID_NOT_UPDATABLE:      "id cannot be updated",
+	PREPARE_TYPE_MISMATCH:         "type mismatch",
+	PREPARE_UNRECOGNIZED_TYPE:     "unrecognized type",
+	PREPARE_INVALID_KEY_COLUMN:    "the first column must be an integer key",
+	PREPARE_READ_ONLY_TABLE:       "table is read only",
+	PREPARE_UNRECOGNIZED_FUNCTION: "unrecognized function",
+	PREPARE_MISUSED_AGGREGATE:     "misuse of aggregate function",
+	PREPARE_NOT_GROUPED:           "column must appear in group by or be used in an aggregate",
+	PREPARE_AMBIGUOUS_COLUMN:      "ambiguous column",
+}
+
+var execute_messages = map[int]string{
+	EXECUTE_DUPLICATE_KEY:      "Duplicate Key",
+	EXECUTE_TABLE_FULL:         "Table Full",
+	EXECUTE_TRANSACTION_ACTIVE: "A transaction is already active",
+	EXECUTE_NO_TRANSACTION:     "No transaction is active",
+	EXECUTE_TABLE_EXISTS:       "Table already exists",
+	EXECUTE_ROW_TOO_LARGE:      "Row too large",
+	EXECUTE_INDEX_EXISTS:       "Index already exists",
+}
+
+var execute_errors = map[int]error{
+	EXECUTE_DUPLICATE_KEY: ErrDuplicateKey,
+}
+
+func prepare_error(result int, statement *Statement, sql string) *Error {
+	switch {
+	case result == PREPARE_SYNTAX_ERROR && statement.syntax_error != nil:
+		return &Error{Message: statement.syntax_error.Error()}
+	case result == PREPARE_UNRECOGNIZED_STATEMENT:
+		return &Error{Message: fmt.Sprintf("unrecognized at start of %#v", sql)}
+	}
+	return &Error{Message: prepare_messages[result]}
+}
+
+// Open opens the database in the file at path, creating it if it does not
+// exist.
+func Open(path string, options Options) (*Database, error) {
+	return db_open(path, options)
+}
+
+// Close abandons a transaction left open, writes everything to the file and
+// closes it.
+func (db *Database) Close() error {
+	return db_close(db)
+}
+
+// InTransaction reports whether an explicit transaction is open.
+func (db *Database) InTransaction() bool {
+	return db.pager.in_transaction
+}
+
+// NewStatementCache makes a cache of the capacity most recently used
+// compiled statements.
+func NewStatementCache(capacity int) *StatementCache {
+	return new_statement_cache(capacity)
+}
+
+// Len is the number of statements in the cache.
+func (cache *StatementCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.lru.Len()
+}
+
+// Compile returns the compiled statement for the text, from the cache if it
+// has it.
+func (cache *StatementCache) Compile(sql string) (*CompiledStatement, error) {
+	compiled, result, syntax_error := cache_compile(cache, sql)
+	if result != PREPARE_SUCCESS {
+		return nil, prepare_error(result, &Statement{syntax_error: syntax_error}, sql)
+	}
+	return compiled, nil
+}
+
+// NumInput is the number of parameters of the statement.
+func (compiled *CompiledStatement) NumInput() int {
+	return compiled.ast.num_parameters
+}
+
+// IsSelect reports whether the statement is a select, which can read a
+// snapshot.
+func (compiled *CompiledStatement) IsSelect() bool {
+	return compiled.ast.statement_type == STATEMENT_SELECT
+}
+
+// ControlsTransaction reports whether the statement is a begin, commit or
+// rollback.
+func (compiled *CompiledStatement) ControlsTransaction() bool {
+	switch compiled.ast.statement_type {
+	case STATEMENT_BEGIN, STATEMENT_COMMIT, STATEMENT_ROLLBACK:
+		return true
+	}
+	return false
+}
+
+// Execute binds the arguments to a compiled statement, prepares it against
+// the database as it is now and executes it, either as the writer or against
+// a snapshot of the last commit. Only one writer may run at a time.
+func (db *Database) Execute(compiled *CompiledStatement, args []any, snapshot bool) (*Statement, error) {
+	compiled = compiled_acquire(compiled)
+	defer compiled_release(compiled)
+	if err := bind_parameters(compiled, args); err != nil {
+		return nil, &Error{Message: err.Error()}
+	}
+
+	database := db
+	if snapshot {
+		var err error
+		if database, err = snapshot_open(db); err != nil {
+			return nil, &Error{Message: err.Error(), Ran: true, Err: err}
+		}
+		defer snapshot_close(database)
+	}
+	statement := NewStatement()
+	if result := prepare_ast(compiled.ast, statement, database); result != PREPARE_SUCCESS {
+		return nil, prepare_error(result, statement, compiled.sql)
+	}
+	var result int
+	var err error
+	if snapshot {
+		result, err = execute_snapshot(statement, database)
+	} else {
+		result, err = execute_statement(statement, database)
+	}
+	if err != nil {
+		return nil, &Error{Message: err.Error(), Ran: true, Err: err}
+	}
+	if result != EXECUTE_SUCCESS {
+		return nil, &Error{Message: execute_messages[result], Ran: true, Err: execute_errors[result]}
+	}
+	return statement, nil
+}
+
+// Columns returns the names of the values a select returned.
+func (statement *Statement) Columns() []string {
+	return statement.columns
+}
+
+// Rows returns the rows a select returned.
+func (statement *Statement) Rows() [][]Value {
+	return statement.rows
+}
+
+// Explain reports whether the rows are the plan of an explain.
+func (statement *Statement) Explain() bool {
+	return statement.explain
+}
+
+// RowsAffected is the number of rows an insert, update or delete changed.
+func (statement *Statement) RowsAffected() int64 {
+	return statement.rows_affected
+}
+
+// Tables returns the names of the tables in the order they were created.
+func (db *Database) Tables() []string {
+	var names []string
+	for _, table := range db.tables {
+		names = append(names, table.schema.name)
+	}
+	return names
+}
+
+// Vacuum rebuilds the database without free pages and returns its size in
+// pages before and after.
+func (db *Database) Vacuum() (uint32, uint32, error) {
+	pager := db.pager
+	if pager.in_transaction {
+		return 0, 0, ErrInTransaction
+	}
+	num_pages := pager.num_pages
+	pager_begin_write(pager)
+	defer pager_end_write(pager)
+	err := vacuum(db)
+	pager_end_operation(pager)
+	if err == nil {
+		err = pager_commit(pager)
+	}
+	// A vacuum that fails part way leaves nothing behind. The rollback reads
+	// the catalog back, whose pages are released with the rest.
+	if err != nil {
+		execute_rollback(db)
+	}
+	pager_end_operation(pager)
+	if err != nil {
+		return 0, 0, err
+	}
+	return num_pages, pager.num_pages, nil
+}
+
+// WriteTree writes the shape of a table's B-tree.
+func (db *Database) WriteTree(w io.Writer, name string) error {
+	table, ok := find_table(db, name)
+	if !ok {
+		return ErrNoTable
+	}
+	err := print_tree(w, table.pager, table.root_page_num, 0)
+	pager_end_operation(table.pager)
+	return err
+}
+
+// WriteStats writes the buffer pool and I/O counters.
+func (db *Database) WriteStats(w io.Writer) {
+	print_stats(w, db.pager)
+}
+
+// WriteConstants writes the sizes of the B-tree node layout.
+func WriteConstants(w io.Writer) {
+	print_constants(w)
+}
+
+// Any is a value as the Go type that holds it: nil, int64, float64, string,
+// []byte or bool.
+func (value Value) Any() any {
+	switch value.value_type {
+	case COLUMN_TYPE_INTEGER:
+		return value.integer
+	case COLUMN_TYPE_REAL:
+		return value.real
+	case COLUMN_TYPE_TEXT:
+		return value.text
+	case COLUMN_TYPE_BLOB:
+		return []byte(value.text)
+	case COLUMN_TYPE_BOOLEAN:
+		return value.integer != 0
+	}
+	return nil
+}
+
+// Scan stores the value in the variable dest points to and reports whether
+// the types allow it. A *any takes any value; *int64, *int, *float64,
+// *string, *[]byte and *bool take values of a matching type. NULL only goes
+// into a *any or *[]byte, as nil.
+func (value Value) Scan(dest any) bool {
+	switch dest := dest.(type) {
+	case *any:
+		*dest = value.Any()
+		return true
+	case *[]byte:
+		switch value.value_type {
+		case COLUMN_TYPE_NULL:
+			*dest = nil
+			return true
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			*dest = []byte(value.text)
+			return true
+		}
+	case *string:
+		if value.value_type == COLUMN_TYPE_TEXT || value.value_type == COLUMN_TYPE_BLOB {
+			*dest = value.text
+			return true
+		}
+	case *int64:
+		if value.value_type == COLUMN_TYPE_INTEGER {
+			*dest = value.integer
+			return true
+		}
+	case *int:
+		if value.value_type == COLUMN_TYPE_INTEGER {
+			*dest = int(value.integer)
+			return true
+		}
+	case *float64:
+		if is_numeric_type(value.value_type) {
+			*dest = numeric_value(value)
+			return true
+		}
+	case *bool:
+		if value.value_type == COLUMN_TYPE_BOOLEAN {
+			*dest = value.integer != 0
+			return true
+		}
+	}
+	return false
+}
+
+// TypeName is the name of the type of the value, or null.
+func (value Value) TypeName() string {
+	if value.value_type == COLUMN_TYPE_NULL {
+		return "null"
+	}
+	return column_type_name(value.value_type)
+}
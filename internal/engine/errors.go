@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The storage layer reports failures with these errors, wrapped with the
+// details of what went wrong; errors.Is tells them apart.
+var (
+	// ErrCorrupt is a file whose contents make no sense as a database.
+	ErrCorrupt = errors.New("database file is corrupt")
+	// ErrIO is a read, write or sync of the database, its log or a temporary
+	// file that the operating system refused.
+	ErrIO = errors.New("disk I/O error")
+	// ErrPageOutOfRange is a reference to a page past the end of the database.
+	ErrPageOutOfRange = errors.New("page number out of range")
+	// ErrDuplicateKey is an insert of a key the table already holds.
+	ErrDuplicateKey = errors.New("duplicate key")
+)
+
+// io_error wraps the error of a failed system call.
+func io_error(action string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrIO, action, err)
+}
+
+func corrupt_error(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
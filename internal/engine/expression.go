@@ -0,0 +1,442 @@
+package engine
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	EXPRESSION_LITERAL = iota
+	EXPRESSION_COLUMN
+	EXPRESSION_NEGATE
+	EXPRESSION_NOT
+	EXPRESSION_AND
+	EXPRESSION_OR
+	EXPRESSION_COMPARE
+	EXPRESSION_ARITHMETIC
+	EXPRESSION_BETWEEN
+	EXPRESSION_IN
+	EXPRESSION_LIKE
+	EXPRESSION_IS_NULL
+	EXPRESSION_AGGREGATE
+)
+
+// Expression is a node of an expression tree. The parser fills in
+// expression_type, token, operator, operands and negated, and
+// prepare_expression then resolves column names and literals and works out
+// the type of every node. The operands are:
+//
+//	negate, not, is null:         value
+//	and, or, compare, arithmetic: left, right
+//	between:                      value, low, high
+//	in:                           value, items...
+//	like:                         value, pattern
+//	aggregate:                    the argument, or none for count(*)
+type Expression struct {
+	expression_type int
+	token           Token  // the literal or column name
+	qualifier       Token  // the table a column name is qualified with, if any
+	operator        string // the comparison, arithmetic operator or aggregate function
+	operands        []*Expression
+	negated         bool // NOT BETWEEN, NOT IN, NOT LIKE and IS NOT NULL
+
+	column     int
+	value      Value
+	value_type int // COLUMN_TYPE_NULL if the expression is always NULL
+}
+
+// token_value converts a literal token to a value of its own type. Integers
+// too large for 64 bits become reals.
+func token_value(literal Token) Value {
+	switch literal.token_type {
+	case TOKEN_INTEGER:
+		if integer, err := strconv.ParseInt(literal.text, 10, 64); err == nil {
+			return Value{value_type: COLUMN_TYPE_INTEGER, integer: integer}
+		}
+		real, _ := strconv.ParseFloat(literal.text, 64)
+		return Value{value_type: COLUMN_TYPE_REAL, real: real}
+	case TOKEN_REAL:
+		real, _ := strconv.ParseFloat(literal.text, 64)
+		return Value{value_type: COLUMN_TYPE_REAL, real: real}
+	case TOKEN_STRING:
+		return Value{value_type: COLUMN_TYPE_TEXT, text: literal.text}
+	case TOKEN_BLOB:
+		return Value{value_type: COLUMN_TYPE_BLOB, text: literal.text}
+	}
+	switch literal.text {
+	case "true":
+		return Value{value_type: COLUMN_TYPE_BOOLEAN, integer: 1}
+	case "false":
+		return Value{value_type: COLUMN_TYPE_BOOLEAN, integer: 0}
+	}
+	return Value{value_type: COLUMN_TYPE_NULL}
+}
+
+func is_numeric_type(value_type int) bool {
+	return value_type == COLUMN_TYPE_INTEGER || value_type == COLUMN_TYPE_REAL || value_type == COLUMN_TYPE_NULL
+}
+
+func is_boolean_type(value_type int) bool {
+	return value_type == COLUMN_TYPE_BOOLEAN || value_type == COLUMN_TYPE_NULL
+}
+
+// types_comparable reports whether values of the two types can be compared.
+// Numbers compare with each other and with booleans, other types only with
+// themselves, and NULL with anything.
+func types_comparable(a int, b int) bool {
+	if a == COLUMN_TYPE_NULL || b == COLUMN_TYPE_NULL || a == b {
+		return true
+	}
+	number := func(t int) bool { return is_numeric_type(t) || t == COLUMN_TYPE_BOOLEAN }
+	return number(a) && number(b)
+}
+
+// prepare_expression resolves the columns of an expression against the
+// tables in scope and checks the types of its operands.
+func prepare_expression(expression *Expression, scope *Scope) int {
+	for _, operand := range expression.operands {
+		if result := prepare_expression(operand, scope); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	operands := expression.operands
+
+	switch expression.expression_type {
+	case EXPRESSION_LITERAL:
+		expression.value = token_value(expression.token)
+		expression.value_type = expression.value.value_type
+	case EXPRESSION_COLUMN:
+		column, result := scope_column(scope, expression.qualifier.text, expression.token.text)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		expression.column = column
+		expression.value_type = scope_column_type(scope, column)
+	case EXPRESSION_NEGATE:
+		if !is_numeric_type(operands[0].value_type) {
+			return PREPARE_TYPE_MISMATCH
+		}
+		expression.value_type = operands[0].value_type
+	case EXPRESSION_ARITHMETIC:
+		if !is_numeric_type(operands[0].value_type) || !is_numeric_type(operands[1].value_type) {
+			return PREPARE_TYPE_MISMATCH
+		}
+		expression.value_type = COLUMN_TYPE_INTEGER
+		if operands[0].value_type == COLUMN_TYPE_REAL || operands[1].value_type == COLUMN_TYPE_REAL {
+			expression.value_type = COLUMN_TYPE_REAL
+		}
+	case EXPRESSION_NOT, EXPRESSION_AND, EXPRESSION_OR:
+		for _, operand := range operands {
+			if !is_boolean_type(operand.value_type) {
+				return PREPARE_TYPE_MISMATCH
+			}
+		}
+		expression.value_type = COLUMN_TYPE_BOOLEAN
+	case EXPRESSION_COMPARE, EXPRESSION_BETWEEN, EXPRESSION_IN:
+		for _, operand := range operands[1:] {
+			if !types_comparable(operands[0].value_type, operand.value_type) {
+				return PREPARE_TYPE_MISMATCH
+			}
+		}
+		expression.value_type = COLUMN_TYPE_BOOLEAN
+	case EXPRESSION_LIKE:
+		for _, operand := range operands {
+			if operand.value_type != COLUMN_TYPE_TEXT && operand.value_type != COLUMN_TYPE_NULL {
+				return PREPARE_TYPE_MISMATCH
+			}
+		}
+		expression.value_type = COLUMN_TYPE_BOOLEAN
+	case EXPRESSION_IS_NULL:
+		expression.value_type = COLUMN_TYPE_BOOLEAN
+	case EXPRESSION_AGGREGATE:
+		return prepare_aggregate(expression)
+	}
+	return PREPARE_SUCCESS
+}
+
+// contains_aggregate reports whether an aggregate function appears anywhere
+// in an expression.
+func contains_aggregate(expression *Expression) bool {
+	if expression.expression_type == EXPRESSION_AGGREGATE {
+		return true
+	}
+	return slices.ContainsFunc(expression.operands, contains_aggregate)
+}
+
+// expressions_equal reports whether two prepared expressions compute the same
+// thing, so that "group by id % 10" can be matched by "select id % 10".
+func expressions_equal(a *Expression, b *Expression) bool {
+	if a.expression_type != b.expression_type || a.operator != b.operator || a.negated != b.negated ||
+		len(a.operands) != len(b.operands) {
+		return false
+	}
+	switch a.expression_type {
+	case EXPRESSION_LITERAL:
+		if a.value != b.value {
+			return false
+		}
+	case EXPRESSION_COLUMN:
+		if a.column != b.column {
+			return false
+		}
+	}
+	for i := range a.operands {
+		if !expressions_equal(a.operands[i], b.operands[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func boolean_value(truth bool) Value {
+	value := Value{value_type: COLUMN_TYPE_BOOLEAN}
+	if truth {
+		value.integer = 1
+	}
+	return value
+}
+
+// is_true reports whether a condition holds. NULL, like false, does not.
+func is_true(value Value) bool {
+	return value.value_type != COLUMN_TYPE_NULL && value.integer != 0
+}
+
+// evaluate_expression computes the value of a prepared expression for a row.
+// Operations on NULL give NULL, except that AND, OR and IS NULL follow SQL's
+// three-valued logic.
+func evaluate_expression(expression *Expression, row *Row) Value {
+	operands := expression.operands
+	switch expression.expression_type {
+	case EXPRESSION_LITERAL:
+		return expression.value
+	case EXPRESSION_COLUMN:
+		return row.values[expression.column]
+	case EXPRESSION_NEGATE:
+		value := evaluate_expression(operands[0], row)
+		value.integer = -value.integer
+		value.real = -value.real
+		return value
+	case EXPRESSION_NOT:
+		value := evaluate_expression(operands[0], row)
+		if value.value_type == COLUMN_TYPE_NULL {
+			return value
+		}
+		return boolean_value(value.integer == 0)
+	case EXPRESSION_AND, EXPRESSION_OR:
+		// AND is decided by a false operand and OR by a true one, whatever
+		// the other operand is.
+		decisive := expression.expression_type == EXPRESSION_OR
+		unknown := false
+		for _, operand := range operands {
+			value := evaluate_expression(operand, row)
+			if value.value_type == COLUMN_TYPE_NULL {
+				unknown = true
+			} else if (value.integer != 0) == decisive {
+				return boolean_value(decisive)
+			}
+		}
+		if unknown {
+			return Value{value_type: COLUMN_TYPE_NULL}
+		}
+		return boolean_value(!decisive)
+	case EXPRESSION_COMPARE:
+		return compare_operands(expression.operator, evaluate_expression(operands[0], row), evaluate_expression(operands[1], row))
+	case EXPRESSION_ARITHMETIC:
+		return evaluate_arithmetic(expression, evaluate_expression(operands[0], row), evaluate_expression(operands[1], row))
+	case EXPRESSION_BETWEEN:
+		value := evaluate_expression(operands[0], row)
+		above := compare_operands(">=", value, evaluate_expression(operands[1], row))
+		below := compare_operands("<=", value, evaluate_expression(operands[2], row))
+		// Like "value >= low and value <= high", either side being false
+		// settles it even if the other is NULL.
+		switch {
+		case above.value_type != COLUMN_TYPE_NULL && above.integer == 0,
+			below.value_type != COLUMN_TYPE_NULL && below.integer == 0:
+			return boolean_value(expression.negated)
+		case above.value_type == COLUMN_TYPE_NULL || below.value_type == COLUMN_TYPE_NULL:
+			return Value{value_type: COLUMN_TYPE_NULL}
+		}
+		return boolean_value(!expression.negated)
+	case EXPRESSION_IN:
+		value := evaluate_expression(operands[0], row)
+		if value.value_type == COLUMN_TYPE_NULL {
+			return value
+		}
+		unknown := false
+		for _, operand := range operands[1:] {
+			item := evaluate_expression(operand, row)
+			if item.value_type == COLUMN_TYPE_NULL {
+				unknown = true
+			} else if compare_values(value, item) == 0 {
+				return boolean_value(!expression.negated)
+			}
+		}
+		if unknown {
+			return Value{value_type: COLUMN_TYPE_NULL}
+		}
+		return boolean_value(expression.negated)
+	case EXPRESSION_LIKE:
+		value := evaluate_expression(operands[0], row)
+		pattern := evaluate_expression(operands[1], row)
+		if value.value_type == COLUMN_TYPE_NULL || pattern.value_type == COLUMN_TYPE_NULL {
+			return Value{value_type: COLUMN_TYPE_NULL}
+		}
+		return boolean_value(like_match(pattern.text, value.text) != expression.negated)
+	case EXPRESSION_IS_NULL:
+		value := evaluate_expression(operands[0], row)
+		return boolean_value((value.value_type == COLUMN_TYPE_NULL) != expression.negated)
+	}
+	return Value{value_type: COLUMN_TYPE_NULL}
+}
+
+// evaluate_arithmetic applies an arithmetic operator. Integers stay integers
+// unless a real is involved; dividing by zero gives NULL.
+func evaluate_arithmetic(expression *Expression, left Value, right Value) Value {
+	if left.value_type == COLUMN_TYPE_NULL || right.value_type == COLUMN_TYPE_NULL {
+		return Value{value_type: COLUMN_TYPE_NULL}
+	}
+
+	if expression.value_type == COLUMN_TYPE_INTEGER {
+		a, b := left.integer, right.integer
+		result := Value{value_type: COLUMN_TYPE_INTEGER}
+		switch expression.operator {
+		case "+":
+			result.integer = a + b
+		case "-":
+			result.integer = a - b
+		case "*":
+			result.integer = a * b
+		case "/", "%":
+			if b == 0 {
+				return Value{value_type: COLUMN_TYPE_NULL}
+			}
+			if expression.operator == "/" {
+				result.integer = a / b
+			} else {
+				result.integer = a % b
+			}
+		}
+		return result
+	}
+
+	a, b := numeric_value(left), numeric_value(right)
+	result := Value{value_type: COLUMN_TYPE_REAL}
+	switch expression.operator {
+	case "+":
+		result.real = a + b
+	case "-":
+		result.real = a - b
+	case "*":
+		result.real = a * b
+	case "/", "%":
+		if b == 0 {
+			return Value{value_type: COLUMN_TYPE_NULL}
+		}
+		if expression.operator == "/" {
+			result.real = a / b
+		} else {
+			result.real = math.Mod(a, b)
+		}
+	}
+	return result
+}
+
+func numeric_value(value Value) float64 {
+	if value.value_type == COLUMN_TYPE_REAL {
+		return value.real
+	}
+	return float64(value.integer)
+}
+
+// compare_operands applies a comparison operator, giving NULL if either
+// operand is NULL.
+func compare_operands(operator string, left Value, right Value) Value {
+	if left.value_type == COLUMN_TYPE_NULL || right.value_type == COLUMN_TYPE_NULL {
+		return Value{value_type: COLUMN_TYPE_NULL}
+	}
+	return boolean_value(comparison_holds(operator, compare_values(left, right)))
+}
+
+// compare_values orders two non-NULL values of comparable types, returning
+// -1, 0 or 1.
+func compare_values(a Value, b Value) int {
+	switch {
+	case a.value_type == COLUMN_TYPE_TEXT || a.value_type == COLUMN_TYPE_BLOB:
+		return strings.Compare(a.text, b.text)
+	case a.value_type == COLUMN_TYPE_REAL || b.value_type == COLUMN_TYPE_REAL:
+		x, y := numeric_value(a), numeric_value(b)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case a.integer < b.integer:
+		return -1
+	case a.integer > b.integer:
+		return 1
+	}
+	return 0
+}
+
+func comparison_holds(operator string, order int) bool {
+	switch operator {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// like_match matches text against a LIKE pattern, where "%" stands for any
+// run of characters and "_" for any one character. Like SQLite, ASCII letters
+// match regardless of case. On a mismatch it backtracks to the last "%" and
+// lets it take one more character, so no pattern takes more than
+// len(pattern) * len(text) steps.
+func like_match(pattern string, text string) bool {
+	p, t := 0, 0
+	star, star_text := -1, 0
+	for t < len(text) {
+		if p < len(pattern) && pattern[p] == '%' {
+			star, star_text = p, t
+			p++
+			continue
+		}
+		if p < len(pattern) && pattern[p] == '_' {
+			_, size := utf8.DecodeRuneInString(text[t:])
+			p, t = p+1, t+size
+			continue
+		}
+		if p < len(pattern) && ascii_lower(pattern[p]) == ascii_lower(text[t]) {
+			p, t = p+1, t+1
+			continue
+		}
+		if star < 0 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(text[star_text:])
+		star_text += size
+		p, t = star+1, star_text
+	}
+	for p < len(pattern) && pattern[p] == '%' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func ascii_lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"encoding/binary"
+)
+
+// Pages released by the B-tree are kept in a free list so they can be reused
+// before the file grows. Like SQLite, the list is a chain of trunk pages, each
+// holding the page numbers of free leaf pages:
+//
+//	next trunk (4 bytes) | leaf count (4 bytes) | leaf page numbers...
+const (
+	FREELIST_TRUNK_NEXT_OFFSET  = 0
+	FREELIST_TRUNK_COUNT_OFFSET = 4
+	FREELIST_TRUNK_HEADER_SIZE  = 8
+	FREELIST_TRUNK_MAX_LEAVES   = (PAGE_SIZE - FREELIST_TRUNK_HEADER_SIZE) / 4
+)
+
+func freelist_trunk(pager *Pager) (uint32, error) {
+	header, err := get_page(pager, HEADER_PAGE_NUM)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32((*header)[HEADER_FREELIST_TRUNK_OFFSET:]), nil
+}
+
+func free_page_count(pager *Pager) (uint32, error) {
+	header, err := get_page(pager, HEADER_PAGE_NUM)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32((*header)[HEADER_FREELIST_COUNT_OFFSET:]), nil
+}
+
+func set_freelist(pager *Pager, trunk_page_num uint32, count uint32) error {
+	header, err := get_page_for_write(pager, HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32((*header)[HEADER_FREELIST_TRUNK_OFFSET:], trunk_page_num)
+	binary.LittleEndian.PutUint32((*header)[HEADER_FREELIST_COUNT_OFFSET:], count)
+	return nil
+}
+
+func freelist_leaf(trunk []byte, index uint32) []byte {
+	return trunk[FREELIST_TRUNK_HEADER_SIZE+index*4:]
+}
+
+// get_unused_page_num hands out a page from the free list, or a new page at
+// the end of the file when the list is empty. Reused pages come back zeroed.
+func get_unused_page_num(pager *Pager) (uint32, error) {
+	trunk_page_num, err := freelist_trunk(pager)
+	if err != nil {
+		return 0, err
+	}
+	if trunk_page_num == 0 {
+		return pager_grow(pager)
+	}
+
+	count, err := free_page_count(pager)
+	if err != nil {
+		return 0, err
+	}
+	trunk, err := get_page_for_write(pager, trunk_page_num)
+	if err != nil {
+		return 0, err
+	}
+	num_leaves := binary.LittleEndian.Uint32((*trunk)[FREELIST_TRUNK_COUNT_OFFSET:])
+	if num_leaves > FREELIST_TRUNK_MAX_LEAVES {
+		return 0, corrupt_error("free list trunk %d holds %d pages", trunk_page_num, num_leaves)
+	}
+
+	page_num := trunk_page_num
+	if num_leaves > 0 {
+		page_num = binary.LittleEndian.Uint32(freelist_leaf(*trunk, num_leaves-1))
+		binary.LittleEndian.PutUint32((*trunk)[FREELIST_TRUNK_COUNT_OFFSET:], num_leaves-1)
+		err = set_freelist(pager, trunk_page_num, count-1)
+	} else {
+		// The trunk is empty, so it is handed out itself.
+		err = set_freelist(pager, binary.LittleEndian.Uint32((*trunk)[FREELIST_TRUNK_NEXT_OFFSET:]), count-1)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	page, err := get_page_for_write(pager, page_num)
+	if err != nil {
+		return 0, err
+	}
+	clear(*page)
+	return page_num, nil
+}
+
+// free_page returns a page that is no longer referenced by the tree to the free list.
+func free_page(pager *Pager, page_num uint32) error {
+	trunk_page_num, err := freelist_trunk(pager)
+	if err != nil {
+		return err
+	}
+	count, err := free_page_count(pager)
+	if err != nil {
+		return err
+	}
+
+	if trunk_page_num != 0 {
+		trunk, err := get_page_for_write(pager, trunk_page_num)
+		if err != nil {
+			return err
+		}
+		num_leaves := binary.LittleEndian.Uint32((*trunk)[FREELIST_TRUNK_COUNT_OFFSET:])
+		if num_leaves < FREELIST_TRUNK_MAX_LEAVES {
+			binary.LittleEndian.PutUint32(freelist_leaf(*trunk, num_leaves), page_num)
+			binary.LittleEndian.PutUint32((*trunk)[FREELIST_TRUNK_COUNT_OFFSET:], num_leaves+1)
+			return set_freelist(pager, trunk_page_num, count+1)
+		}
+	}
+
+	// The current trunk is full (or there is none), so the page becomes the new trunk.
+	page, err := get_page_for_write(pager, page_num)
+	if err != nil {
+		return err
+	}
+	clear(*page)
+	binary.LittleEndian.PutUint32((*page)[FREELIST_TRUNK_NEXT_OFFSET:], trunk_page_num)
+	return set_freelist(pager, page_num, count+1)
+}
@@ -0,0 +1,561 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// An index is a B-tree of its own that maps the values of one column to the
+// keys of the rows holding them. Its entries are ordered by value and then by
+// key, so every entry is unique and the rows with a value are found together.
+// Rows whose value is NULL are left out, since no comparison matches NULL.
+//
+// Index pages use the common node header and then:
+//
+//	header: num cells (2 bytes) | right pointer (4 bytes) | content start (2 bytes)
+//	slots:  2 byte cell offsets in entry order, cells packed from the page end
+//	leaf cell:     entry
+//	internal cell: child page (4 bytes) | entry, the largest entry under the child
+//	entry:         value size (2 bytes) | value | key (4 bytes, big endian)
+//
+// The right pointer is the right-most child of an internal node and the next
+// leaf of a leaf. Values are encoded so that comparing their bytes orders them
+// like their column does. Long text and blobs are cut short, which keeps the
+// order of entries but can put unequal values together, so rows found through
+// an index are always checked against the whole condition.
+//
+// Removing entries never merges nodes; an emptied leaf stays in the tree
+// until vacuum rebuilds the index.
+const (
+	INDEX_NODE_NUM_CELLS_OFFSET     = COMMON_NODE_HEADER_SIZE
+	INDEX_NODE_RIGHT_OFFSET         = INDEX_NODE_NUM_CELLS_OFFSET + 2
+	INDEX_NODE_CONTENT_START_OFFSET = INDEX_NODE_RIGHT_OFFSET + 4
+	INDEX_NODE_HEADER_SIZE          = INDEX_NODE_CONTENT_START_OFFSET + 2
+	INDEX_NODE_SLOT_SIZE            = 2
+	INDEX_NODE_SPACE_FOR_CELLS      = PAGE_SIZE - INDEX_NODE_HEADER_SIZE
+	INDEX_CHILD_SIZE                = 4
+
+	// INDEX_MAX_VALUE_SIZE is how much of a value an entry keeps. It is small
+	// enough for every node to hold many entries.
+	INDEX_MAX_VALUE_SIZE = 255
+)
+
+// Index is a secondary index on one column of a table.
+type Index struct {
+	name          string
+	table         *Table
+	column        int
+	root_page_num uint32
+}
+
+// index_value_bytes encodes a value of the indexed column. INTEGER and
+// BOOLEAN become 8 bytes with the sign bit flipped, and REAL the bits of the
+// float with the sign bit flipped, or every bit for negative numbers.
+func index_value_bytes(column_type int, value Value) []byte {
+	switch column_type {
+	case COLUMN_TYPE_INTEGER, COLUMN_TYPE_BOOLEAN:
+		return binary.BigEndian.AppendUint64(nil, uint64(value.integer)^(1<<63))
+	case COLUMN_TYPE_REAL:
+		bits := math.Float64bits(value.real + 0) // turns -0 into 0
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(nil, bits)
+	}
+	return []byte(value.text[:min(len(value.text), INDEX_MAX_VALUE_SIZE)])
+}
+
+// index_bound encodes a value a condition compares the indexed column with.
+// A number of another type is rounded away from the range it bounds, so the
+// range never misses a row; the rows are checked afterwards anyway.
+func index_bound(column_type int, value Value, upper bool) []byte {
+	if (column_type == COLUMN_TYPE_INTEGER || column_type == COLUMN_TYPE_BOOLEAN) && value.value_type == COLUMN_TYPE_REAL {
+		bound := math.Floor(value.real)
+		if upper {
+			bound = math.Ceil(value.real)
+		}
+		value = Value{value_type: COLUMN_TYPE_INTEGER}
+		switch {
+		case bound >= math.MaxInt64:
+			value.integer = math.MaxInt64
+		case bound <= math.MinInt64:
+			value.integer = math.MinInt64
+		default:
+			value.integer = int64(bound)
+		}
+	}
+	if column_type == COLUMN_TYPE_REAL {
+		value = Value{value_type: COLUMN_TYPE_REAL, real: numeric_value(value)}
+	}
+	return index_value_bytes(column_type, value)
+}
+
+func index_entry(value []byte, key uint32) []byte {
+	entry := binary.LittleEndian.AppendUint16(nil, uint16(len(value)))
+	entry = append(entry, value...)
+	return binary.BigEndian.AppendUint32(entry, key)
+}
+
+func index_entry_value(entry []byte) []byte {
+	return entry[2 : 2+binary.LittleEndian.Uint16(entry)]
+}
+
+func index_entry_key(entry []byte) uint32 {
+	return binary.BigEndian.Uint32(entry[2+binary.LittleEndian.Uint16(entry):])
+}
+
+func index_entry_size(entry []byte) uint32 {
+	return 2 + uint32(binary.LittleEndian.Uint16(entry)) + 4
+}
+
+func compare_index_entries(a []byte, b []byte) int {
+	if result := bytes.Compare(index_entry_value(a), index_entry_value(b)); result != 0 {
+		return result
+	}
+	x, y := index_entry_key(a), index_entry_key(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func index_node_num_cells(node []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(node[INDEX_NODE_NUM_CELLS_OFFSET:]))
+}
+
+func index_node_right(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INDEX_NODE_RIGHT_OFFSET:])
+}
+
+func set_index_node_right(node []byte, page_num uint32) {
+	binary.LittleEndian.PutUint32(node[INDEX_NODE_RIGHT_OFFSET:], page_num)
+}
+
+func initialize_index_node(node []byte, node_type int) {
+	set_node_type(node, node_type)
+	set_node_root(node, false)
+	set_node_parent(node, 0)
+	set_index_node_right(node, 0)
+	index_node_fill(node, nil)
+}
+
+// index_cell_entry returns the entry of a cell that starts at the given
+// offset of an index node.
+func index_cell_entry(node []byte, offset uint32) []byte {
+	if get_node_type(node) == NODE_INTERNAL {
+		offset += INDEX_CHILD_SIZE
+	}
+	return node[offset : offset+index_entry_size(node[offset:])]
+}
+
+func index_node_cell(node []byte, cell_num uint32) []byte {
+	offset := uint32(binary.LittleEndian.Uint16(node[INDEX_NODE_HEADER_SIZE+cell_num*INDEX_NODE_SLOT_SIZE:]))
+	size := uint32(len(index_cell_entry(node, offset)))
+	if get_node_type(node) == NODE_INTERNAL {
+		size += INDEX_CHILD_SIZE
+	}
+	return node[offset : offset+size]
+}
+
+func index_node_entry(node []byte, cell_num uint32) []byte {
+	cell := index_node_cell(node, cell_num)
+	if get_node_type(node) == NODE_INTERNAL {
+		return cell[INDEX_CHILD_SIZE:]
+	}
+	return cell
+}
+
+// index_node_child returns the child at the given index, the right child
+// coming after the cells.
+func index_node_child(node []byte, child_num uint32) uint32 {
+	if child_num == index_node_num_cells(node) {
+		return index_node_right(node)
+	}
+	return binary.LittleEndian.Uint32(index_node_cell(node, child_num))
+}
+
+// index_node_cells returns copies of the cells of a node in order.
+func index_node_cells(node []byte) [][]byte {
+	num_cells := index_node_num_cells(node)
+	cells := make([][]byte, num_cells)
+	for i := uint32(0); i < num_cells; i++ {
+		cells[i] = append([]byte(nil), index_node_cell(node, i)...)
+	}
+	return cells
+}
+
+func index_cells_space(cells [][]byte) uint32 {
+	space := uint32(0)
+	for _, cell := range cells {
+		space += uint32(len(cell)) + INDEX_NODE_SLOT_SIZE
+	}
+	return space
+}
+
+// index_node_fill replaces the cells of a node. The caller makes sure they
+// fit.
+func index_node_fill(node []byte, cells [][]byte) {
+	offset := uint32(PAGE_SIZE)
+	for i, cell := range cells {
+		offset -= uint32(len(cell))
+		copy(node[offset:], cell)
+		binary.LittleEndian.PutUint16(node[INDEX_NODE_HEADER_SIZE+uint32(i)*INDEX_NODE_SLOT_SIZE:], uint16(offset))
+	}
+	binary.LittleEndian.PutUint16(node[INDEX_NODE_NUM_CELLS_OFFSET:], uint16(len(cells)))
+	binary.LittleEndian.PutUint16(node[INDEX_NODE_CONTENT_START_OFFSET:], uint16(offset))
+}
+
+// index_node_check makes sure a page read from the file looks like an index
+// node before its slots are followed.
+func index_node_check(node []byte, page_num uint32) error {
+	node_type := get_node_type(node)
+	slots_end := uint64(INDEX_NODE_HEADER_SIZE) + uint64(index_node_num_cells(node))*uint64(INDEX_NODE_SLOT_SIZE)
+	content_start := uint64(binary.LittleEndian.Uint16(node[INDEX_NODE_CONTENT_START_OFFSET:]))
+	if (node_type != NODE_LEAF && node_type != NODE_INTERNAL) || content_start < slots_end {
+		return corrupt_error("page %d is not a valid index node", page_num)
+	}
+	return nil
+}
+
+// index_node_search returns the first cell whose entry is not less than the
+// given one, or the number of cells if there is none.
+func index_node_search(node []byte, entry []byte) uint32 {
+	low, high := uint32(0), index_node_num_cells(node)
+	for low != high {
+		middle := (low + high) / 2
+		if compare_index_entries(index_node_entry(node, middle), entry) < 0 {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	return low
+}
+
+// index_insert adds an entry to the index. A root that splits moves its
+// left half to a new page, so the root page never changes.
+func index_insert(index *Index, entry []byte) error {
+	pager := index.table.pager
+	right_page_num, separator, split, err := index_node_insert(index, index.root_page_num, entry)
+	if err != nil || !split {
+		return err
+	}
+
+	root, err := get_page_for_write(pager, index.root_page_num)
+	if err != nil {
+		return err
+	}
+	left_page_num, err := get_unused_page_num(pager)
+	if err != nil {
+		return err
+	}
+	left, err := get_page_for_write(pager, left_page_num)
+	if err != nil {
+		return err
+	}
+	copy(*left, *root)
+	set_node_root(*left, false)
+
+	initialize_index_node(*root, NODE_INTERNAL)
+	set_node_root(*root, true)
+	cell := binary.LittleEndian.AppendUint32(nil, left_page_num)
+	index_node_fill(*root, [][]byte{append(cell, separator...)})
+	set_index_node_right(*root, right_page_num)
+	return nil
+}
+
+// index_node_insert adds an entry under the node. If the node has to split it
+// keeps the left half and returns the new page holding the right half, along
+// with the largest entry of the left half.
+func index_node_insert(index *Index, page_num uint32, entry []byte) (uint32, []byte, bool, error) {
+	pager := index.table.pager
+	node, err := get_page_for_write(pager, page_num)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if err := index_node_check(*node, page_num); err != nil {
+		return 0, nil, false, err
+	}
+	position := index_node_search(*node, entry)
+	cells := index_node_cells(*node)
+	right := index_node_right(*node)
+
+	if get_node_type(*node) == NODE_LEAF {
+		cells = append(cells[:position], append([][]byte{entry}, cells[position:]...)...)
+		return index_node_store(index, page_num, cells, right, position)
+	}
+
+	child_page_num := index_node_child(*node, position)
+	split_page_num, separator, split, err := index_node_insert(index, child_page_num, entry)
+	if err != nil || !split {
+		return 0, nil, false, err
+	}
+	// The child keeps the entries up to the separator and the new page takes
+	// over the child's place for the rest.
+	left := append(binary.LittleEndian.AppendUint32(nil, child_page_num), separator...)
+	if position < uint32(len(cells)) {
+		moved := append(binary.LittleEndian.AppendUint32(nil, split_page_num), cells[position][INDEX_CHILD_SIZE:]...)
+		cells[position] = moved
+	} else {
+		right = split_page_num
+	}
+	cells = append(cells[:position], append([][]byte{left}, cells[position:]...)...)
+	return index_node_store(index, page_num, cells, right, position)
+}
+
+// index_node_store writes cells back into a node, splitting it in two by the
+// space its cells use if they no longer fit. Entries added to the end of the
+// last leaf, as when an index is built in order, split off on their own so
+// that the leaves behind them stay full.
+func index_node_store(index *Index, page_num uint32, cells [][]byte, right uint32, inserted uint32) (uint32, []byte, bool, error) {
+	pager := index.table.pager
+	node, err := get_page_for_write(pager, page_num)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if index_cells_space(cells) <= INDEX_NODE_SPACE_FOR_CELLS {
+		index_node_fill(*node, cells)
+		set_index_node_right(*node, right)
+		return 0, nil, false, nil
+	}
+
+	node_type := get_node_type(*node)
+	new_page_num, err := get_unused_page_num(pager)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	new_node, err := get_page_for_write(pager, new_page_num)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	initialize_index_node(*new_node, node_type)
+
+	if node_type == NODE_LEAF {
+		left_count := leaf_node_split_point(cells)
+		if right == 0 && inserted == uint32(len(cells))-1 {
+			left_count = inserted
+		}
+		index_node_fill(*new_node, cells[left_count:])
+		set_index_node_right(*new_node, right)
+		index_node_fill(*node, cells[:left_count])
+		set_index_node_right(*node, new_page_num)
+		return new_page_num, cells[left_count-1], true, nil
+	}
+
+	// The middle cell's child becomes the right child of the left half, and
+	// its entry the separator between the halves.
+	middle := leaf_node_split_point(cells)
+	index_node_fill(*new_node, cells[middle+1:])
+	set_index_node_right(*new_node, right)
+	index_node_fill(*node, cells[:middle])
+	set_index_node_right(*node, binary.LittleEndian.Uint32(cells[middle]))
+	return new_page_num, cells[middle][INDEX_CHILD_SIZE:], true, nil
+}
+
+// index_delete removes an entry from the index, if it is there.
+func index_delete(index *Index, entry []byte) error {
+	pager := index.table.pager
+	page_num := index.root_page_num
+	for {
+		node, err := get_page(pager, page_num)
+		if err != nil {
+			return err
+		}
+		if err := index_node_check(*node, page_num); err != nil {
+			return err
+		}
+		position := index_node_search(*node, entry)
+		if get_node_type(*node) == NODE_INTERNAL {
+			page_num = index_node_child(*node, position)
+			continue
+		}
+		if position < index_node_num_cells(*node) && compare_index_entries(index_node_entry(*node, position), entry) == 0 {
+			if node, err = get_page_for_write(pager, page_num); err != nil {
+				return err
+			}
+			cells := index_node_cells(*node)
+			index_node_fill(*node, append(cells[:position], cells[position+1:]...))
+		}
+		return nil
+	}
+}
+
+// IndexCursor is a position among the entries of an index.
+type IndexCursor struct {
+	index    *Index
+	page_num uint32
+	cell_num uint32
+	end      bool
+}
+
+// index_seek returns a cursor on the first entry not less than the given one.
+func index_seek(index *Index, entry []byte) (*IndexCursor, error) {
+	pager := index.table.pager
+	cursor := &IndexCursor{index: index, page_num: index.root_page_num}
+	for {
+		node, err := get_page(pager, cursor.page_num)
+		if err != nil {
+			return nil, err
+		}
+		if err := index_node_check(*node, cursor.page_num); err != nil {
+			return nil, err
+		}
+		position := index_node_search(*node, entry)
+		if get_node_type(*node) == NODE_LEAF {
+			cursor.cell_num = position
+			if err := index_cursor_settle(cursor); err != nil {
+				return nil, err
+			}
+			return cursor, nil
+		}
+		cursor.page_num = index_node_child(*node, position)
+	}
+}
+
+// index_cursor_settle moves a cursor that is past the end of its leaf to the
+// first entry of the next leaf that has any.
+func index_cursor_settle(cursor *IndexCursor) error {
+	pager := cursor.index.table.pager
+	for {
+		node, err := get_page(pager, cursor.page_num)
+		if err != nil {
+			return err
+		}
+		if err := index_node_check(*node, cursor.page_num); err != nil {
+			return err
+		}
+		if cursor.cell_num < index_node_num_cells(*node) {
+			return nil
+		}
+		next_page_num := index_node_right(*node)
+		if next_page_num == 0 {
+			cursor.end = true
+			return nil
+		}
+		cursor.page_num = next_page_num
+		cursor.cell_num = 0
+	}
+}
+
+func index_cursor_advance(cursor *IndexCursor) error {
+	cursor.cell_num++
+	return index_cursor_settle(cursor)
+}
+
+func index_cursor_entry(cursor *IndexCursor) ([]byte, error) {
+	node, err := get_page(cursor.index.table.pager, cursor.page_num)
+	if err != nil {
+		return nil, err
+	}
+	return index_node_entry(*node, cursor.cell_num), nil
+}
+
+// index_row_entry returns the entry of a row in an index, or false if the
+// indexed value is NULL.
+func index_row_entry(index *Index, row *Row) ([]byte, bool) {
+	value := row.values[index.column]
+	if value.value_type == COLUMN_TYPE_NULL {
+		return nil, false
+	}
+	column_type := index.table.schema.columns[index.column].column_type
+	return index_entry(index_value_bytes(column_type, value), uint32(row.values[KEY_COLUMN].integer)), true
+}
+
+// index_add_row adds a new row to every index of its table.
+func index_add_row(table *Table, row *Row) error {
+	for _, index := range table.indexes {
+		if entry, ok := index_row_entry(index, row); ok {
+			if err := index_insert(index, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// index_remove_row takes a deleted row out of every index of its table.
+func index_remove_row(table *Table, row *Row) error {
+	for _, index := range table.indexes {
+		if entry, ok := index_row_entry(index, row); ok {
+			if err := index_delete(index, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// index_update_row moves a row to its new place in every index whose column
+// changed.
+func index_update_row(table *Table, old_row *Row, new_row *Row) error {
+	for _, index := range table.indexes {
+		old_entry, old_ok := index_row_entry(index, old_row)
+		new_entry, new_ok := index_row_entry(index, new_row)
+		if old_ok && new_ok && bytes.Equal(old_entry, new_entry) {
+			continue
+		}
+		if old_ok {
+			if err := index_delete(index, old_entry); err != nil {
+				return err
+			}
+		}
+		if new_ok {
+			if err := index_insert(index, new_entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// index_build fills a new index with the rows already in its table. The
+// entries are sorted first, so they are added in order and pack the leaves.
+func index_build(index *Index, sort_memory int) error {
+	table := index.table
+	column_type := table.schema.columns[index.column].column_type
+	value := &Expression{expression_type: EXPRESSION_COLUMN, column: index.column, value_type: column_type}
+	key := &Expression{expression_type: EXPRESSION_COLUMN, column: KEY_COLUMN, value_type: COLUMN_TYPE_INTEGER}
+	sorter := new_sorter([]Ordering{{expression: value}, {expression: key}}, sort_memory)
+	defer sorter_close(sorter)
+
+	var row Row
+	cursor, err := table_start(table)
+	if err != nil {
+		return err
+	}
+	for !cursor.end_of_table {
+		source, err := cursor_value(cursor)
+		if err != nil {
+			return err
+		}
+		if err := deserialize_row(table.schema, source, &row); err != nil {
+			return err
+		}
+		if row.values[index.column].value_type != COLUMN_TYPE_NULL {
+			if err := sorter_add(sorter, []Value{row.values[index.column], row.values[KEY_COLUMN]}); err != nil {
+				return err
+			}
+		}
+		if err := cursor_advance(cursor); err != nil {
+			return err
+		}
+		pager_end_operation(table.pager)
+	}
+
+	for {
+		values, err := sorter_next(sorter)
+		if err != nil || values == nil {
+			return err
+		}
+		if err := index_insert(index, index_entry(index_value_bytes(column_type, values[0]), uint32(values[1].integer))); err != nil {
+			return err
+		}
+		pager_end_operation(table.pager)
+	}
+}
@@ -0,0 +1,508 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Source is one table a select reads, under the name it is referred to by.
+// The joined row holds the values of every source in join order, and offset
+// is where this source's values start.
+type Source struct {
+	table  *Table
+	name   string
+	offset int
+}
+
+// Scope is the sources column names are looked up in. Statements on a single
+// table have a scope of one source.
+type Scope struct {
+	sources []*Source
+	width   int
+}
+
+func new_scope(table *Table, name string) *Scope {
+	scope := &Scope{}
+	scope_add(scope, table, name)
+	return scope
+}
+
+func scope_add(scope *Scope, table *Table, name string) *Source {
+	source := &Source{table: table, name: name, offset: scope.width}
+	scope.sources = append(scope.sources, source)
+	scope.width += len(table.schema.columns)
+	return source
+}
+
+// scope_column finds a column of the joined row. A name without a qualifier
+// has to belong to exactly one source.
+func scope_column(scope *Scope, qualifier string, name string) (int, int) {
+	found := -1
+	for _, source := range scope.sources {
+		if qualifier != "" && qualifier != source.name {
+			continue
+		}
+		column, ok := column_index(source.table.schema, name)
+		if !ok {
+			continue
+		}
+		if found >= 0 {
+			return 0, PREPARE_AMBIGUOUS_COLUMN
+		}
+		found = source.offset + column
+	}
+	if found < 0 {
+		return 0, PREPARE_UNRECOGNIZED_COLUMN
+	}
+	return found, PREPARE_SUCCESS
+}
+
+// scope_column_name is the name of a column of the joined row.
+func scope_column_name(scope *Scope, column int) string {
+	for _, source := range scope.sources {
+		if column < source.offset+len(source.table.schema.columns) {
+			return source.table.schema.columns[column-source.offset].name
+		}
+	}
+	return ""
+}
+
+// scope_column_type is the type of a column of the joined row.
+func scope_column_type(scope *Scope, column int) int {
+	for _, source := range scope.sources {
+		if column < source.offset+len(source.table.schema.columns) {
+			return source.table.schema.columns[column-source.offset].column_type
+		}
+	}
+	return COLUMN_TYPE_NULL
+}
+
+const (
+	JOIN_NESTED_LOOP = iota
+	JOIN_KEY_LOOKUP
+	JOIN_HASH
+)
+
+// Join is one "[left] join table on condition" of a select, and how it is
+// carried out:
+//
+//	nested loop: every row of the table is read for every row before it
+//	key lookup:  the condition gives the key of the row to find, computed
+//	             from the rows before it, so each is found with table_find
+//	hash:        the condition equates expressions of the table with
+//	             expressions of the rows before it; the table is read once
+//	             into a hash table and probed with the earlier rows
+//
+// Whatever the strategy, the rows it finds are checked against the whole
+// condition.
+type Join struct {
+	source    *Source
+	left      bool
+	condition *Expression
+	strategy  int
+	estimate  float64 // rows the join is expected to produce
+
+	lookup     *Expression   // key lookup: the key to find
+	outer_keys []*Expression // hash: expressions of the rows before
+	inner_keys []*Expression // hash: the equal expressions of the table
+
+	hash map[string][][]Value // hash: built on first use
+}
+
+// within reports whether an expression only reads columns in [low, high).
+func within(expression *Expression, low int, high int) bool {
+	if expression.expression_type == EXPRESSION_COLUMN && (expression.column < low || expression.column >= high) {
+		return false
+	}
+	for _, operand := range expression.operands {
+		if !within(operand, low, high) {
+			return false
+		}
+	}
+	return true
+}
+
+// conjuncts splits a condition into the parts joined by AND.
+func conjuncts(condition *Expression) []*Expression {
+	if condition.expression_type == EXPRESSION_AND {
+		return append(conjuncts(condition.operands[0]), conjuncts(condition.operands[1])...)
+	}
+	return []*Expression{condition}
+}
+
+// table_estimate_rows guesses how many rows a table has, and returns the
+// depth of its tree, by following the left-most path from the root and
+// assuming every node is as full as the ones on it.
+func table_estimate_rows(table *Table) (float64, int, error) {
+	rows := 1.0
+	depth := 1
+	page_num := table.root_page_num
+	for {
+		node, err := get_page(table.pager, page_num)
+		if err != nil {
+			return 0, 0, err
+		}
+		if get_node_type(*node) == NODE_LEAF {
+			rows *= float64(leaf_node_num_cells(*node))
+			pager_end_operation(table.pager)
+			return rows, depth, nil
+		}
+		rows *= float64(internal_node_num_keys(*node) + 1)
+		page_num, err = internal_node_child_page(*node, 0)
+		pager_end_operation(table.pager)
+		if err != nil {
+			return 0, 0, err
+		}
+		depth++
+	}
+}
+
+// plan_join picks the cheapest way to carry out a join after outer_rows rows,
+// counting rows read: a nested loop reads the whole table for each outer
+// row, a key lookup one path down the tree, and a hash join the table once
+// and then one probe per outer row.
+func plan_join(join *Join, outer_rows float64) error {
+	offset := join.source.offset
+	end := offset + len(join.source.table.schema.columns)
+	inner_rows, depth, err := table_estimate_rows(join.source.table)
+	if err != nil {
+		return err
+	}
+
+	join.strategy = JOIN_NESTED_LOOP
+	cost := outer_rows * max(inner_rows, 1)
+	join.estimate = outer_rows * max(inner_rows, 1)
+
+	var lookup *Expression
+	join.outer_keys, join.inner_keys = nil, nil
+	for _, condition := range conjuncts(join.condition) {
+		if condition.expression_type != EXPRESSION_COMPARE || condition.operator != "=" {
+			continue
+		}
+		left, right := condition.operands[0], condition.operands[1]
+		if !within(left, offset, end) {
+			left, right = right, left
+		}
+		if !within(left, offset, end) || !within(right, 0, offset) {
+			continue
+		}
+		if left.expression_type == EXPRESSION_COLUMN && left.column == offset+KEY_COLUMN && lookup == nil {
+			lookup = right
+		}
+		join.inner_keys = append(join.inner_keys, left)
+		join.outer_keys = append(join.outer_keys, right)
+	}
+
+	if join.inner_keys != nil {
+		// An equality matches about one row of the table per outer row.
+		join.estimate = max(outer_rows, 1)
+		if hash_cost := inner_rows + outer_rows; hash_cost < cost {
+			join.strategy, cost = JOIN_HASH, hash_cost
+		}
+	}
+	if lookup != nil {
+		if lookup_cost := outer_rows * float64(depth); lookup_cost <= cost {
+			join.strategy, cost = JOIN_KEY_LOOKUP, lookup_cost
+			join.lookup = lookup
+		}
+	}
+	if join.left {
+		join.estimate = max(join.estimate, outer_rows)
+	}
+	return nil
+}
+
+// prepare_joins sets up the scope of a select and plans its joins. The
+// condition of a join can only refer to its own table and those before it.
+func prepare_joins(ast *Ast, statement *Statement, db *Database) int {
+	name := ast.table.text
+	if ast.alias.text != "" {
+		name = ast.alias.text
+	}
+	statement.scope = new_scope(statement.table, name)
+	statement.joins = nil
+
+	for _, node := range ast.joins {
+		table, ok := find_table(db, node.table.text)
+		if !ok {
+			return PREPARE_UNRECOGNIZED_TABLE
+		}
+		name := node.table.text
+		if node.alias.text != "" {
+			name = node.alias.text
+		}
+		join := &Join{source: scope_add(statement.scope, table, name), left: node.left, condition: node.condition}
+		if result := prepare_expression(join.condition, statement.scope); result != PREPARE_SUCCESS {
+			return result
+		}
+		if !is_boolean_type(join.condition.value_type) {
+			return PREPARE_TYPE_MISMATCH
+		}
+		if contains_aggregate(join.condition) {
+			return PREPARE_MISUSED_AGGREGATE
+		}
+		statement.joins = append(statement.joins, join)
+	}
+	return PREPARE_SUCCESS
+}
+
+// plan_joins chooses the strategy of each join in order, starting from the
+// rows the where clause leaves of the first table.
+func plan_joins(statement *Statement) error {
+	rows, _, err := table_estimate_rows(statement.table)
+	if err != nil {
+		return err
+	}
+	key_range := statement.where.key_range
+	rows = min(rows, float64(key_range.max)-float64(key_range.min)+1)
+	rows = max(rows, 0)
+	if where := statement.where; where.index != nil && where.index_high != nil &&
+		bytes.Equal(index_entry_value(where.index_low), index_entry_value(where.index_high)) {
+		// Looking a value up in an index is taken to find about one row.
+		rows = min(rows, 1)
+	}
+	for _, join := range statement.joins {
+		if err := plan_join(join, rows); err != nil {
+			return err
+		}
+		rows = join.estimate
+	}
+	return nil
+}
+
+// join_scan passes every joined row that satisfies the where clause to
+// visit, in the order the first table is read. It stops early if visit
+// returns false.
+func join_scan(statement *Statement, visit func(row *Row) bool) error {
+	table := statement.table
+	for _, join := range statement.joins {
+		join.hash = nil
+	}
+	// Only the key or index range applies to the first table alone; the
+	// condition is checked on the joined rows.
+	first := statement.where
+	first.condition = nil
+	cursor, err := predicate_start(table, &first)
+	if err != nil {
+		return err
+	}
+	var row Row
+	for {
+		found, err := predicate_find(cursor, &first, &row)
+		if err != nil || !found {
+			return err
+		}
+		joined := Row{values: make([]Value, len(row.values), statement.scope.width)}
+		copy(joined.values, row.values)
+		if keep_going, err := join_next(statement, 0, &joined, visit); err != nil || !keep_going {
+			return err
+		}
+		if err := predicate_advance(cursor); err != nil {
+			return err
+		}
+		pager_end_operation(table.pager)
+	}
+}
+
+// join_next extends a joined row with the rows of the next join that match
+// it, or with NULLs if a left join finds none.
+func join_next(statement *Statement, level int, row *Row, visit func(row *Row) bool) (bool, error) {
+	if level == len(statement.joins) {
+		if predicate_matches(&statement.where, row) {
+			return visit(row), nil
+		}
+		return true, nil
+	}
+
+	join := statement.joins[level]
+	columns := len(join.source.table.schema.columns)
+	matched := false
+	next := Row{values: make([]Value, join.source.offset, statement.scope.width)}
+	copy(next.values, row.values)
+
+	keep_going, err := join_candidates(join, row, func(inner []Value) (bool, error) {
+		next.values = append(next.values[:join.source.offset], inner...)
+		if !is_true(evaluate_expression(join.condition, &next)) {
+			return true, nil
+		}
+		matched = true
+		return join_next(statement, level+1, &next, visit)
+	})
+	if err != nil || !keep_going {
+		return false, err
+	}
+
+	if !matched && join.left {
+		next.values = next.values[:join.source.offset]
+		for i := 0; i < columns; i++ {
+			next.values = append(next.values, Value{value_type: COLUMN_TYPE_NULL})
+		}
+		return join_next(statement, level+1, &next, visit)
+	}
+	return true, nil
+}
+
+// join_candidates passes the rows of the joined table that the strategy finds
+// for an outer row to visit.
+func join_candidates(join *Join, outer *Row, visit func(inner []Value) (bool, error)) (bool, error) {
+	table := join.source.table
+	var row Row
+
+	switch join.strategy {
+	case JOIN_KEY_LOOKUP:
+		key := evaluate_expression(join.lookup, outer)
+		if key.value_type == COLUMN_TYPE_NULL {
+			return true, nil
+		}
+		value := numeric_value(key)
+		if value != math.Trunc(value) || value < 0 || value > math.MaxUint32 {
+			return true, nil
+		}
+		lookup := Predicate{key_range: KeyRange{min: uint32(value), max: uint32(value)}}
+		cursor, err := predicate_start(table, &lookup)
+		if err != nil {
+			return false, err
+		}
+		found, err := predicate_find(cursor, &lookup, &row)
+		pager_end_operation(table.pager)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return visit(row.values)
+		}
+		return true, nil
+
+	case JOIN_HASH:
+		if join.hash == nil {
+			if err := join_build_hash(join); err != nil {
+				return false, err
+			}
+		}
+		keys := project_row(join.outer_keys, outer)
+		hash, ok := hash_key(keys)
+		if !ok {
+			return true, nil
+		}
+		for _, inner := range join.hash[hash] {
+			if keep_going, err := visit(inner); err != nil || !keep_going {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	cursor, err := table_start(table)
+	if err != nil {
+		return false, err
+	}
+	for !cursor.end_of_table {
+		source, err := cursor_value(cursor)
+		if err != nil {
+			return false, err
+		}
+		if err := deserialize_row(table.schema, source, &row); err != nil {
+			return false, err
+		}
+		if err := cursor_advance(cursor); err != nil {
+			return false, err
+		}
+		pager_end_operation(table.pager)
+		if keep_going, err := visit(row.values); err != nil || !keep_going {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// hash_key encodes join key values so that values that compare equal encode
+// the same. It returns false if a key is NULL, which equals nothing.
+func hash_key(keys []Value) (string, bool) {
+	normalized := make([]Value, len(keys))
+	for i, key := range keys {
+		switch key.value_type {
+		case COLUMN_TYPE_NULL:
+			return "", false
+		case COLUMN_TYPE_BOOLEAN:
+			key.value_type = COLUMN_TYPE_INTEGER
+		case COLUMN_TYPE_REAL:
+			if key.real == math.Trunc(key.real) && math.Abs(key.real) < 1<<53 {
+				key = Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(key.real)}
+			}
+		}
+		normalized[i] = key
+	}
+	return string(encode_sort_row(normalized)), true
+}
+
+// join_build_hash reads the joined table into a hash table keyed by its join
+// expressions.
+func join_build_hash(join *Join) error {
+	table := join.source.table
+	join.hash = map[string][][]Value{}
+	// The join expressions read the table's columns at its offset in the
+	// joined row.
+	padded := Row{values: make([]Value, join.source.offset)}
+	var row Row
+	cursor, err := table_start(table)
+	if err != nil {
+		return err
+	}
+	for !cursor.end_of_table {
+		source, err := cursor_value(cursor)
+		if err != nil {
+			return err
+		}
+		if err := deserialize_row(table.schema, source, &row); err != nil {
+			return err
+		}
+		inner := make([]Value, len(row.values))
+		copy(inner, row.values)
+		padded.values = append(padded.values[:join.source.offset], inner...)
+		if hash, ok := hash_key(project_row(join.inner_keys, &padded)); ok {
+			join.hash[hash] = append(join.hash[hash], inner)
+		}
+		if err := cursor_advance(cursor); err != nil {
+			return err
+		}
+		pager_end_operation(table.pager)
+	}
+	return nil
+}
+
+// explain_select describes how a select reads its tables, one line per
+// table.
+func explain_select(statement *Statement) []string {
+	var lines []string
+	first := statement.scope.sources[0]
+	key_range := statement.where.key_range
+	switch {
+	case statement.where.index != nil:
+		lines = append(lines, fmt.Sprintf("search %s by index %s", first.name, statement.where.index.name))
+	case key_range.empty():
+		lines = append(lines, fmt.Sprintf("search %s: no rows", first.name))
+	case key_range.min == key_range.max:
+		lines = append(lines, fmt.Sprintf("search %s by key", first.name))
+	case key_range != FULL_KEY_RANGE:
+		lines = append(lines, fmt.Sprintf("search %s by key range", first.name))
+	default:
+		lines = append(lines, fmt.Sprintf("scan %s", first.name))
+	}
+
+	for _, join := range statement.joins {
+		kind := "join"
+		if join.left {
+			kind = "left join"
+		}
+		strategy := "nested loop"
+		switch join.strategy {
+		case JOIN_KEY_LOOKUP:
+			strategy = "key lookup"
+		case JOIN_HASH:
+			strategy = "hash"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s by %s", kind, join.source.name, strategy))
+	}
+	return lines
+}
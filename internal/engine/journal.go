@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"syscall"
+)
+
+// In rollback journal mode the database file is changed in place. Before a
+// page is first modified in a transaction its original image is appended to a
+// journal next to the database, and the journal is synced before any modified
+// page reaches the file. Committing deletes the journal; a journal found when
+// the database is opened belongs to a transaction that never finished and is
+// played back to undo it:
+//
+//	header: magic (16 bytes) | page size (4 bytes) | database size (4 bytes)
+//	record: page number (4 bytes) | checksum (4 bytes) | page (PAGE_SIZE bytes)
+//
+// A record that fails its checksum was torn while being written, which means
+// its page was never modified on disk, so playback stops there.
+const (
+	JOURNAL_MAGIC                   = "godb journal 1\x00"
+	JOURNAL_MAGIC_SIZE              = 16
+	JOURNAL_HEADER_PAGE_SIZE_OFFSET = JOURNAL_MAGIC_SIZE
+	JOURNAL_HEADER_DB_SIZE_OFFSET   = JOURNAL_HEADER_PAGE_SIZE_OFFSET + 4
+	JOURNAL_HEADER_SIZE             = JOURNAL_HEADER_DB_SIZE_OFFSET + 4
+	JOURNAL_RECORD_PAGE_NUM_OFFSET  = 0
+	JOURNAL_RECORD_CHECKSUM_OFFSET  = JOURNAL_RECORD_PAGE_NUM_OFFSET + 4
+	JOURNAL_RECORD_HEADER_SIZE      = JOURNAL_RECORD_CHECKSUM_OFFSET + 4
+	JOURNAL_RECORD_SIZE             = JOURNAL_RECORD_HEADER_SIZE + PAGE_SIZE
+)
+
+type Journal struct {
+	fileDescriptor int // -1 until the transaction modifies a page
+	filename       string
+	length         int64
+	synced         bool
+	// db_size is the size of the database in pages when the transaction
+	// started; pages past it have no original to save.
+	db_size uint32
+	pages   map[uint32]bool // pages whose original image is in the journal
+}
+
+func journal_filename(filename string) string {
+	return filename + "-journal"
+}
+
+// journal_recover plays back a journal left behind by a transaction that did
+// not finish, restoring the database file to its state before the transaction.
+func journal_recover(pager *Pager, filename string) error {
+	fd, err := syscall.Open(journal_filename(filename), syscall.O_RDWR, 0)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return io_error("opening journal file", err)
+	}
+
+	// A journal without a complete header was never synced, so nothing it
+	// protects was written yet.
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	n, _ := syscall.Pread(fd, header, 0)
+	if n == JOURNAL_HEADER_SIZE && string(header[:len(JOURNAL_MAGIC)]) == JOURNAL_MAGIC &&
+		binary.LittleEndian.Uint32(header[JOURNAL_HEADER_PAGE_SIZE_OFFSET:]) == PAGE_SIZE {
+		err = journal_playback(pager, fd, binary.LittleEndian.Uint32(header[JOURNAL_HEADER_DB_SIZE_OFFSET:]))
+	}
+
+	syscall.Close(fd)
+	if err != nil {
+		// The journal stays behind, to be played back by the next open.
+		return err
+	}
+	if err := syscall.Unlink(journal_filename(filename)); err != nil {
+		return io_error("removing journal file", err)
+	}
+	return nil
+}
+
+// journal_playback writes every original page image in the journal back to
+// the database file and truncates the file to its size before the transaction.
+func journal_playback(pager *Pager, fd int, db_size uint32) error {
+	record := make([]byte, JOURNAL_RECORD_SIZE)
+	for offset := int64(JOURNAL_HEADER_SIZE); ; offset += JOURNAL_RECORD_SIZE {
+		n, _ := syscall.Pread(fd, record, offset)
+		if n < JOURNAL_RECORD_SIZE {
+			break
+		}
+		if binary.LittleEndian.Uint32(record[JOURNAL_RECORD_CHECKSUM_OFFSET:]) != journal_checksum(record) {
+			break
+		}
+		if err := pager_write(pager, binary.LittleEndian.Uint32(record[JOURNAL_RECORD_PAGE_NUM_OFFSET:]), record[JOURNAL_RECORD_HEADER_SIZE:]); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Ftruncate(pager.fileDescriptor, int64(db_size)*PAGE_SIZE); err != nil {
+		return io_error("truncating file", err)
+	}
+	pager.fileLength = int64(db_size) * PAGE_SIZE
+	if err := syscall.Fsync(pager.fileDescriptor); err != nil {
+		return io_error("syncing file", err)
+	}
+	return nil
+}
+
+func journal_checksum(record []byte) uint32 {
+	checksum := crc32.ChecksumIEEE(record[:JOURNAL_RECORD_CHECKSUM_OFFSET])
+	return crc32.Update(checksum, crc32.IEEETable, record[JOURNAL_RECORD_HEADER_SIZE:])
+}
+
+// journal_page saves the original image of a page that is about to be
+// modified, starting the journal on the first write of a transaction.
+func journal_page(pager *Pager, page_num uint32, data []byte) error {
+	journal := pager.journal
+	if journal.fileDescriptor < 0 {
+		fd, err := syscall.Open(journal.filename, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0666)
+		if err != nil {
+			return io_error("opening journal file", err)
+		}
+		header := make([]byte, JOURNAL_HEADER_SIZE)
+		copy(header, JOURNAL_MAGIC)
+		binary.LittleEndian.PutUint32(header[JOURNAL_HEADER_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+		binary.LittleEndian.PutUint32(header[JOURNAL_HEADER_DB_SIZE_OFFSET:], journal.db_size)
+		if _, err := syscall.Pwrite(fd, header, 0); err != nil {
+			syscall.Close(fd)
+			return io_error("writing journal file", err)
+		}
+
+		journal.fileDescriptor = fd
+		journal.length = JOURNAL_HEADER_SIZE
+		journal.synced = false
+	}
+
+	if page_num >= journal.db_size || journal.pages[page_num] {
+		return nil
+	}
+
+	record := make([]byte, JOURNAL_RECORD_SIZE)
+	binary.LittleEndian.PutUint32(record[JOURNAL_RECORD_PAGE_NUM_OFFSET:], page_num)
+	copy(record[JOURNAL_RECORD_HEADER_SIZE:], data)
+	binary.LittleEndian.PutUint32(record[JOURNAL_RECORD_CHECKSUM_OFFSET:], journal_checksum(record))
+	if _, err := syscall.Pwrite(journal.fileDescriptor, record, journal.length); err != nil {
+		return io_error("writing journal file", err)
+	}
+
+	journal.length += JOURNAL_RECORD_SIZE
+	journal.synced = false
+	journal.pages[page_num] = true
+	return nil
+}
+
+// journal_sync makes sure the journal is on disk before the database file is
+// modified.
+func journal_sync(journal *Journal) error {
+	if journal.synced {
+		return nil
+	}
+	if err := syscall.Fsync(journal.fileDescriptor); err != nil {
+		return io_error("syncing journal file", err)
+	}
+	journal.synced = true
+	return nil
+}
+
+// journal_spill writes a modified page straight into the database file when it
+// is evicted before its transaction commits.
+func journal_spill(pager *Pager, frame *Frame) error {
+	if err := journal_sync(pager.journal); err != nil {
+		return err
+	}
+	return pager_write(pager, frame.page_num, frame.data)
+}
+
+// journal_commit writes the modified pages into the database file, syncs it
+// and deletes the journal, which is the moment the transaction commits.
+func journal_commit(pager *Pager) error {
+	journal := pager.journal
+	if journal.fileDescriptor < 0 {
+		return nil
+	}
+
+	var dirty []uint32
+	for page_num, frame := range pager.frames {
+		if frame.dirty {
+			dirty = append(dirty, page_num)
+		}
+	}
+	slices.Sort(dirty)
+
+	if err := journal_sync(journal); err != nil {
+		return err
+	}
+	for _, page_num := range dirty {
+		frame := pager.frames[page_num]
+		if err := pager_write(pager, page_num, frame.data); err != nil {
+			return err
+		}
+		frame.dirty = false
+	}
+
+	size := int64(pager.num_pages) * PAGE_SIZE
+	if pager.fileLength > size {
+		if err := syscall.Ftruncate(pager.fileDescriptor, size); err != nil {
+			return io_error("truncating file", err)
+		}
+		pager.fileLength = size
+	}
+	if err := syscall.Fsync(pager.fileDescriptor); err != nil {
+		return io_error("syncing file", err)
+	}
+
+	if err := journal_delete(journal); err != nil {
+		return err
+	}
+	journal.db_size = pager.num_pages
+	return nil
+}
+
+// journal_rollback undoes the transaction by playing its journal back.
+func journal_rollback(pager *Pager) error {
+	journal := pager.journal
+	if journal.fileDescriptor < 0 {
+		return nil
+	}
+
+	if err := journal_playback(pager, journal.fileDescriptor, journal.db_size); err != nil {
+		return err
+	}
+	return journal_delete(journal)
+}
+
+// journal_delete closes and removes the journal of a finished transaction.
+func journal_delete(journal *Journal) error {
+	if journal.fileDescriptor < 0 {
+		return nil
+	}
+	err := syscall.Close(journal.fileDescriptor)
+	journal.fileDescriptor = -1
+	clear(journal.pages)
+	if err != nil {
+		return io_error("closing journal file", err)
+	}
+	if err := syscall.Unlink(journal.filename); err != nil {
+		return io_error("removing journal file", err)
+	}
+	return nil
+}
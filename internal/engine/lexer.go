@@ -0,0 +1,266 @@
+package engine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	TOKEN_EOF = iota
+	TOKEN_KEYWORD
+	TOKEN_IDENTIFIER
+	TOKEN_INTEGER
+	TOKEN_REAL
+	TOKEN_STRING
+	TOKEN_BLOB
+	TOKEN_SYMBOL
+	TOKEN_PARAMETER
+)
+
+// keywords are matched without regard to case. Any other word is an
+// identifier; a keyword can still be used as a name by quoting it.
+var keywords = map[string]bool{
+	"and": true, "as": true, "asc": true, "begin": true, "between": true,
+	"by": true, "commit": true, "create": true, "delete": true, "desc": true,
+	"explain": true, "false": true, "from": true, "group": true, "having": true,
+	"in": true, "index": true, "inner": true, "insert": true, "into": true, "is": true,
+	"join": true, "left": true, "like": true, "limit": true, "not": true,
+	"null": true, "offset": true, "on": true, "or": true, "order": true,
+	"outer": true, "rollback": true, "select": true, "set": true, "table": true,
+	"transaction": true, "true": true, "update": true, "values": true,
+	"where": true,
+}
+
+// Token is one lexeme of a statement. Keywords are lower case, string and
+// identifier tokens hold their unescaped text and blob tokens their bytes.
+// Parameter tokens are "?" or "$" and a number; the parser numbers them all.
+type Token struct {
+	token_type int
+	text       string
+	line       int
+	column     int
+	offset     int // where the token starts in the statement
+	end        int // where it ends
+}
+
+// SyntaxError is a statement that could not be tokenized or parsed, with the
+// position of the offending token.
+type SyntaxError struct {
+	line    int
+	column  int
+	message string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", err.line, err.column, err.message)
+}
+
+type Lexer struct {
+	input  string
+	offset int
+	line   int
+	column int
+}
+
+func lexer_peek(lexer *Lexer, ahead int) byte {
+	if lexer.offset+ahead >= len(lexer.input) {
+		return 0
+	}
+	return lexer.input[lexer.offset+ahead]
+}
+
+func lexer_advance(lexer *Lexer) byte {
+	c := lexer.input[lexer.offset]
+	lexer.offset++
+	if c == '\n' {
+		lexer.line++
+		lexer.column = 1
+	} else {
+		lexer.column++
+	}
+	return c
+}
+
+func is_identifier_start(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func is_digit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// tokenize splits a statement into tokens, ending with a TOKEN_EOF.
+func tokenize(input string) ([]Token, *SyntaxError) {
+	lexer := &Lexer{input: input, line: 1, column: 1}
+	var tokens []Token
+	for {
+		if err := skip_space_and_comments(lexer); err != nil {
+			return nil, err
+		}
+		token := Token{line: lexer.line, column: lexer.column, offset: lexer.offset}
+		if lexer.offset >= len(input) {
+			token.token_type = TOKEN_EOF
+			token.end = lexer.offset
+			return append(tokens, token), nil
+		}
+
+		c := lexer_peek(lexer, 0)
+		var err *SyntaxError
+		switch {
+		case (c == 'x' || c == 'X') && lexer_peek(lexer, 1) == '\'':
+			lexer_advance(lexer)
+			token.token_type = TOKEN_BLOB
+			token.text, err = lex_blob(lexer, token)
+		case is_identifier_start(c):
+			token.text = lex_word(lexer)
+			token.token_type = TOKEN_IDENTIFIER
+			if keywords[strings.ToLower(token.text)] {
+				token.token_type = TOKEN_KEYWORD
+				token.text = strings.ToLower(token.text)
+			}
+		case is_digit(c) || (c == '.' && is_digit(lexer_peek(lexer, 1))):
+			token.token_type, token.text = lex_number(lexer)
+		case c == '\'':
+			token.token_type = TOKEN_STRING
+			token.text, err = lex_quoted(lexer, token, "string")
+		case c == '"':
+			token.token_type = TOKEN_IDENTIFIER
+			token.text, err = lex_quoted(lexer, token, "identifier")
+		case c == '?' || (c == '$' && is_digit(lexer_peek(lexer, 1))):
+			token.token_type = TOKEN_PARAMETER
+			token.text = lex_parameter(lexer)
+		default:
+			token.token_type = TOKEN_SYMBOL
+			token.text, err = lex_symbol(lexer, token)
+		}
+		if err != nil {
+			return nil, err
+		}
+		token.end = lexer.offset
+		tokens = append(tokens, token)
+	}
+}
+
+// skip_space_and_comments skips white space, "-- line" and "/* block */"
+// comments.
+func skip_space_and_comments(lexer *Lexer) *SyntaxError {
+	for lexer.offset < len(lexer.input) {
+		c := lexer_peek(lexer, 0)
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			lexer_advance(lexer)
+		case c == '-' && lexer_peek(lexer, 1) == '-':
+			for lexer.offset < len(lexer.input) && lexer_peek(lexer, 0) != '\n' {
+				lexer_advance(lexer)
+			}
+		case c == '/' && lexer_peek(lexer, 1) == '*':
+			line, column := lexer.line, lexer.column
+			lexer_advance(lexer)
+			lexer_advance(lexer)
+			for !(lexer_peek(lexer, 0) == '*' && lexer_peek(lexer, 1) == '/') {
+				if lexer.offset >= len(lexer.input) {
+					return &SyntaxError{line: line, column: column, message: "unterminated comment"}
+				}
+				lexer_advance(lexer)
+			}
+			lexer_advance(lexer)
+			lexer_advance(lexer)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func lex_word(lexer *Lexer) string {
+	start := lexer.offset
+	for is_identifier_start(lexer_peek(lexer, 0)) || is_digit(lexer_peek(lexer, 0)) {
+		lexer_advance(lexer)
+	}
+	return lexer.input[start:lexer.offset]
+}
+
+// lex_number reads an integer, or a real with a fraction or an exponent.
+func lex_number(lexer *Lexer) (int, string) {
+	start := lexer.offset
+	token_type := TOKEN_INTEGER
+	for is_digit(lexer_peek(lexer, 0)) {
+		lexer_advance(lexer)
+	}
+	if lexer_peek(lexer, 0) == '.' {
+		token_type = TOKEN_REAL
+		lexer_advance(lexer)
+		for is_digit(lexer_peek(lexer, 0)) {
+			lexer_advance(lexer)
+		}
+	}
+	if c := lexer_peek(lexer, 0); c == 'e' || c == 'E' {
+		sign := lexer_peek(lexer, 1)
+		if is_digit(sign) || ((sign == '+' || sign == '-') && is_digit(lexer_peek(lexer, 2))) {
+			token_type = TOKEN_REAL
+			lexer_advance(lexer)
+			lexer_advance(lexer)
+			for is_digit(lexer_peek(lexer, 0)) {
+				lexer_advance(lexer)
+			}
+		}
+	}
+	return token_type, lexer.input[start:lexer.offset]
+}
+
+func lex_parameter(lexer *Lexer) string {
+	start := lexer.offset
+	lexer_advance(lexer)
+	for lexer.input[start] == '$' && is_digit(lexer_peek(lexer, 0)) {
+		lexer_advance(lexer)
+	}
+	return lexer.input[start:lexer.offset]
+}
+
+// lex_quoted reads text between quotes, where a doubled quote stands for
+// one quote character.
+func lex_quoted(lexer *Lexer, token Token, what string) (string, *SyntaxError) {
+	quote := lexer_advance(lexer)
+	var text strings.Builder
+	for {
+		if lexer.offset >= len(lexer.input) {
+			return "", &SyntaxError{line: token.line, column: token.column, message: "unterminated " + what}
+		}
+		c := lexer_advance(lexer)
+		if c == quote {
+			if lexer_peek(lexer, 0) != quote {
+				return text.String(), nil
+			}
+			lexer_advance(lexer)
+		}
+		text.WriteByte(c)
+	}
+}
+
+func lex_blob(lexer *Lexer, token Token) (string, *SyntaxError) {
+	digits, err := lex_quoted(lexer, token, "blob")
+	if err != nil {
+		return "", err
+	}
+	data, decode_err := hex.DecodeString(digits)
+	if decode_err != nil {
+		return "", &SyntaxError{line: token.line, column: token.column, message: "invalid blob literal"}
+	}
+	return string(data), nil
+}
+
+var symbols = []string{"<=", ">=", "<>", "!=", "==", "(", ")", ",", ";", "*", "=", "<", ">", "+", "-", "/", "%", "."}
+
+func lex_symbol(lexer *Lexer, token Token) (string, *SyntaxError) {
+	for _, symbol := range symbols {
+		if strings.HasPrefix(lexer.input[lexer.offset:], symbol) {
+			for range symbol {
+				lexer_advance(lexer)
+			}
+			return symbol, nil
+		}
+	}
+	message := fmt.Sprintf("unexpected character %q", lexer_peek(lexer, 0))
+	return "", &SyntaxError{line: token.line, column: token.column, message: message}
+}
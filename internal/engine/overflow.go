@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"encoding/binary"
+)
+
+// A record too large for a leaf cell spills into a chain of overflow pages.
+// The cell keeps the first LEAF_NODE_MAX_LOCAL bytes of the record followed by
+// the number of the first overflow page, and each overflow page holds the next
+// part of the record:
+//
+//	cell:     key (4 bytes) | record size (4 bytes) | local part | first overflow page (4 bytes)
+//	overflow: next overflow page (4 bytes, 0 on the last page) | record bytes...
+const (
+	OVERFLOW_POINTER_SIZE = 4
+	OVERFLOW_NEXT_OFFSET  = 0
+	OVERFLOW_HEADER_SIZE  = OVERFLOW_NEXT_OFFSET + 4
+	OVERFLOW_SPACE        = PAGE_SIZE - OVERFLOW_HEADER_SIZE
+)
+
+// leaf_cell_local_size returns how much of a record is kept in its cell.
+func leaf_cell_local_size(record_size uint32) uint32 {
+	return min(record_size, LEAF_NODE_MAX_LOCAL)
+}
+
+// leaf_cell_overflow_page returns the first overflow page of a cell, or 0 if
+// the whole record is in the cell.
+func leaf_cell_overflow_page(cell []byte) uint32 {
+	record_size := binary.LittleEndian.Uint32(cell[LEAF_NODE_RECORD_SIZE_OFFSET:])
+	if record_size <= LEAF_NODE_MAX_LOCAL {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(cell[len(cell)-OVERFLOW_POINTER_SIZE:])
+}
+
+// leaf_cell_build makes the cell for a record, writing the part that does not
+// fit into new overflow pages.
+func leaf_cell_build(pager *Pager, key uint32, record []byte) ([]byte, error) {
+	record_size := uint32(len(record))
+	local_size := leaf_cell_local_size(record_size)
+	cell_size := LEAF_NODE_CELL_HEADER_SIZE + local_size
+	if local_size < record_size {
+		cell_size += OVERFLOW_POINTER_SIZE
+	}
+
+	cell := make([]byte, cell_size)
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_KEY_OFFSET:], key)
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_RECORD_SIZE_OFFSET:], record_size)
+	copy(cell[LEAF_NODE_VALUE_OFFSET:], record[:local_size])
+	if local_size < record_size {
+		first_page_num, err := overflow_write(pager, record[local_size:])
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint32(cell[cell_size-OVERFLOW_POINTER_SIZE:], first_page_num)
+	}
+	return cell, nil
+}
+
+// leaf_cell_record returns the whole record of a cell, reassembling it from
+// its overflow pages if it spilled.
+func leaf_cell_record(pager *Pager, cell []byte) ([]byte, error) {
+	record_size := binary.LittleEndian.Uint32(cell[LEAF_NODE_RECORD_SIZE_OFFSET:])
+	local_size := leaf_cell_local_size(record_size)
+	if local_size == record_size {
+		return cell[LEAF_NODE_VALUE_OFFSET:], nil
+	}
+
+	record := make([]byte, record_size)
+	copy(record, cell[LEAF_NODE_VALUE_OFFSET:LEAF_NODE_VALUE_OFFSET+local_size])
+	if err := overflow_read(pager, leaf_cell_overflow_page(cell), record[local_size:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// overflow_write stores data in a new chain of overflow pages and returns the
+// first page of the chain.
+func overflow_write(pager *Pager, data []byte) (uint32, error) {
+	first_page_num := uint32(0)
+	var previous []byte
+	for len(data) > 0 {
+		page_num, err := get_unused_page_num(pager)
+		if err != nil {
+			return 0, err
+		}
+		page, err := get_page_for_write(pager, page_num)
+		if err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint32((*page)[OVERFLOW_NEXT_OFFSET:], 0)
+		n := copy((*page)[OVERFLOW_HEADER_SIZE:], data)
+		data = data[n:]
+
+		if previous == nil {
+			first_page_num = page_num
+		} else {
+			binary.LittleEndian.PutUint32(previous[OVERFLOW_NEXT_OFFSET:], page_num)
+		}
+		previous = *page
+	}
+	return first_page_num, nil
+}
+
+// overflow_read fills data from the chain starting at page_num.
+func overflow_read(pager *Pager, page_num uint32, data []byte) error {
+	for len(data) > 0 {
+		if page_num == 0 {
+			return corrupt_error("overflow chain ends %d bytes early", len(data))
+		}
+		page, err := get_page(pager, page_num)
+		if err != nil {
+			return err
+		}
+		n := copy(data, (*page)[OVERFLOW_HEADER_SIZE:])
+		data = data[n:]
+		page_num = binary.LittleEndian.Uint32((*page)[OVERFLOW_NEXT_OFFSET:])
+	}
+	return nil
+}
+
+// overflow_free returns every page of a chain to the free list.
+func overflow_free(pager *Pager, page_num uint32) error {
+	for page_num != 0 {
+		page, err := get_page(pager, page_num)
+		if err != nil {
+			return err
+		}
+		next_page_num := binary.LittleEndian.Uint32((*page)[OVERFLOW_NEXT_OFFSET:])
+		if err := free_page(pager, page_num); err != nil {
+			return err
+		}
+		page_num = next_page_num
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package engine
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// DEFAULT_CACHE_PAGES is the size of the buffer pool when none is configured (4 MB).
+const DEFAULT_CACHE_PAGES = 1024
+
+// Frame is a slot of the buffer pool holding one page of the file.
+type Frame struct {
+	page_num  uint32
+	data      []byte
+	pin_count int
+	dirty     bool
+	// pinned_by_operation is set while the current operation holds a pin on the frame.
+	pinned_by_operation bool
+	element             *list.Element
+	// latch is held exclusively while a frame of the read pool is read in,
+	// and err is set if that failed.
+	latch   sync.RWMutex
+	err     error
+	version PageVersion // the version a frame of the read pool holds
+}
+
+// The pager caches pages in a buffer pool of at most capacity frames and
+// evicts the least recently used unpinned frame when it needs a free one.
+//
+// Every page fetched with get_page stays pinned until pager_end_operation is
+// called, so the B-tree can keep using the slices it holds while it restructures
+// the tree. If every frame is pinned the pool temporarily grows past capacity.
+//
+// In WAL mode the database file is only written by checkpoints. Evicted and
+// committed pages go to the write-ahead log, and reads look there first. In
+// rollback journal mode pages are written to the file itself once their
+// original images are safe in the journal. Exactly one of wal and journal is set.
+type Pager struct {
+	fileDescriptor   int
+	fileLength       int64
+	num_pages        uint32
+	capacity         int
+	frames           map[uint32]*Frame
+	lru              *list.List // front is the most recently used frame
+	operation_frames []*Frame
+	wal              *Wal
+	journal          *Journal
+	in_transaction   bool
+	stats            PagerStats
+	// broken is set when a rollback failed part way, leaving the cache and
+	// the file out of step; every later access returns it.
+	broken error
+	// readers is shared with the pagers of the snapshots readers take. A
+	// snapshot's pager has no buffer pool of its own and reads only the
+	// version of each page its snapshot names.
+	readers     *Readers
+	snapshot    *Snapshot
+	file_locked bool // the writer holds readers.lock exclusively
+}
+
+// PagerStats counts the work done by the pager since the database was opened.
+type PagerStats struct {
+	pages_read    uint64
+	pages_written uint64
+	cache_hits    uint64
+	cache_misses  uint64
+	evictions     uint64
+	wal_frames    uint64
+}
+
+// get_page fetches a page of the database through the buffer pool. A page
+// number past the end, which only a corrupt pointer can hold, is refused.
+func get_page(pager *Pager, page_num uint32) (*[]byte, error) {
+	if pager.snapshot != nil {
+		return snapshot_get_page(pager, page_num)
+	}
+	if pager.broken == nil && page_num >= pager.num_pages {
+		return nil, fmt.Errorf("%w: page %d of %d", ErrPageOutOfRange, page_num, pager.num_pages)
+	}
+	return pager_fetch(pager, page_num)
+}
+
+// pager_grow adds a zeroed page at the end of the database and returns its
+// number. Like a page from get_page it is pinned until the operation ends.
+func pager_grow(pager *Pager) (uint32, error) {
+	page_num := pager.num_pages
+	if _, err := pager_fetch(pager, page_num); err != nil {
+		return 0, err
+	}
+	return page_num, nil
+}
+
+// pager_fetch brings a page into the buffer pool and pins it. The page just
+// past the end of the database grows it by one.
+func pager_fetch(pager *Pager, page_num uint32) (*[]byte, error) {
+	if pager.broken != nil {
+		return nil, pager.broken
+	}
+
+	frame, ok := pager.frames[page_num]
+	if ok {
+		pager.stats.cache_hits++
+		pager.lru.MoveToFront(frame.element)
+	} else {
+		pager.stats.cache_misses++
+		if len(pager.frames) >= pager.capacity {
+			if _, err := pager_evict(pager); err != nil {
+				return nil, err
+			}
+		}
+
+		// Pages past the end of the database start out zeroed, even if an
+		// older copy is still on disk.
+		frame = &Frame{page_num: page_num, data: make([]byte, PAGE_SIZE)}
+		in_wal := false
+		if pager.wal != nil && page_num < pager.num_pages {
+			var err error
+			if in_wal, err = wal_read(pager.wal, page_num, frame.data); err != nil {
+				return nil, err
+			}
+		}
+		if !in_wal && page_num < pager.num_pages && int64(page_num) < pager.fileLength/PAGE_SIZE {
+			_, err := syscall.Seek(pager.fileDescriptor, int64(page_num)*PAGE_SIZE, 0)
+			if err != nil {
+				return nil, io_error("seeking file", err)
+			}
+
+			_, err = syscall.Read(pager.fileDescriptor, frame.data)
+			if err != nil {
+				return nil, io_error("reading file", err)
+			}
+			pager.stats.pages_read++
+		}
+
+		frame.element = pager.lru.PushFront(frame)
+		pager.frames[page_num] = frame
+
+		if page_num >= pager.num_pages {
+			pager.num_pages = page_num + 1
+		}
+	}
+
+	if !frame.pinned_by_operation {
+		frame.pinned_by_operation = true
+		frame.pin_count++
+		pager.operation_frames = append(pager.operation_frames, frame)
+	}
+
+	return &frame.data, nil
+}
+
+// get_page_for_write fetches a page the caller is about to modify and marks it
+// dirty. Only dirty pages are ever written to the log.
+func get_page_for_write(pager *Pager, page_num uint32) (*[]byte, error) {
+	if pager.snapshot != nil {
+		return nil, errors.New("a snapshot cannot be written")
+	}
+	page, err := get_page(pager, page_num)
+	if err != nil {
+		return nil, err
+	}
+	if pager.journal != nil {
+		if err := journal_page(pager, page_num, *page); err != nil {
+			return nil, err
+		}
+	}
+	pager.frames[page_num].dirty = true
+	return page, nil
+}
+
+// pager_end_operation releases the pins taken since the previous call. It must
+// only be called when no page slices are held by code that still writes to them.
+// A frame that fails to be evicted stays in the pool; writing it fails again,
+// and is reported, at the next get_page or commit.
+func pager_end_operation(pager *Pager) {
+	if pager.snapshot != nil {
+		snapshot_end_operation(pager)
+		return
+	}
+	for _, frame := range pager.operation_frames {
+		frame.pinned_by_operation = false
+		frame.pin_count--
+	}
+	pager.operation_frames = pager.operation_frames[:0]
+
+	for len(pager.frames) > pager.capacity {
+		if evicted, err := pager_evict(pager); !evicted || err != nil {
+			break
+		}
+	}
+}
+
+// pager_evict drops the least recently used unpinned frame. A modified frame is
+// spilled to the log or the journaled file first; the change only counts once
+// the statement commits. It returns false if every frame is pinned.
+func pager_evict(pager *Pager) (bool, error) {
+	for element := pager.lru.Back(); element != nil; element = element.Prev() {
+		frame := element.Value.(*Frame)
+		if frame.pin_count > 0 {
+			continue
+		}
+
+		if frame.dirty && pager.wal != nil {
+			if err := wal_append(pager, frame.page_num, frame.data, 0); err != nil {
+				return false, err
+			}
+			pager.wal.uncommitted = true
+		} else if frame.dirty {
+			if err := journal_spill(pager, frame); err != nil {
+				return false, err
+			}
+		}
+		pager.lru.Remove(element)
+		delete(pager.frames, frame.page_num)
+		pager.stats.evictions++
+		return true, nil
+	}
+	return false, nil
+}
+
+// pager_drop discards a cached page without writing it back.
+func pager_drop(pager *Pager, page_num uint32) error {
+	frame, ok := pager.frames[page_num]
+	if !ok {
+		return nil
+	}
+	if frame.pin_count > 0 {
+		return fmt.Errorf("page %d is pinned and cannot be dropped", page_num)
+	}
+	pager.lru.Remove(frame.element)
+	delete(pager.frames, page_num)
+	return nil
+}
+
+// pager_rollback throws away every change since the last commit. The cache is
+// emptied, since frames may hold pages modified by the transaction, and the
+// committed copies are read back from the log or the file as they are needed.
+// A rollback that fails leaves the pager broken.
+func pager_rollback(pager *Pager) error {
+	err := pager_rollback_pages(pager)
+	if err != nil && pager.broken == nil {
+		pager.broken = err
+	}
+	return err
+}
+
+func pager_rollback_pages(pager *Pager) error {
+	for page_num := range pager.frames {
+		if err := pager_drop(pager, page_num); err != nil {
+			return err
+		}
+	}
+	if pager.wal != nil {
+		if err := wal_rollback(pager.wal); err != nil {
+			return err
+		}
+		pager.num_pages = pager.wal.db_size
+	} else {
+		if err := journal_rollback(pager); err != nil {
+			return err
+		}
+		pager.num_pages = pager.journal.db_size
+	}
+	return nil
+}
+
+// pager_commit makes every change since the previous commit durable. A commit
+// that fails has to be rolled back.
+func pager_commit(pager *Pager) error {
+	if pager.broken != nil {
+		return pager.broken
+	}
+	if pager.wal != nil {
+		return wal_commit(pager)
+	}
+	return journal_commit(pager)
+}
+
+// pager_open opens the database file in the given journal mode. Whatever a
+// previous process left behind is recovered first: a hot journal is played
+// back, and a write-ahead log is checkpointed into the file.
+func pager_open(filename string, options Options) (*Pager, error) {
+	fd, err := syscall.Open(filename, syscall.O_RDWR|syscall.O_CREAT, 0666)
+	if err != nil {
+		return nil, io_error("opening file", err)
+	}
+
+	pager := &Pager{
+		fileDescriptor: fd,
+		capacity:       options.CachePages,
+		frames:         make(map[uint32]*Frame),
+		lru:            list.New(),
+		readers:        new_readers(options.CachePages),
+	}
+	fail := func(err error) (*Pager, error) {
+		pager_abandon(pager)
+		return nil, err
+	}
+	if err := journal_recover(pager, filename); err != nil {
+		return fail(err)
+	}
+
+	file_length, _ := syscall.Seek(fd, 0, 2)
+	pager.fileLength = file_length
+	pager.num_pages = uint32(file_length / int64(PAGE_SIZE))
+
+	if (file_length % PAGE_SIZE) != 0 {
+		return fail(corrupt_error("file is not a whole number of pages"))
+	}
+
+	if options.JournalMode == JOURNAL_MODE_WAL {
+		if err := wal_open(pager, filename); err != nil {
+			return fail(err)
+		}
+	} else {
+		var stat syscall.Stat_t
+		if syscall.Stat(wal_filename(filename), &stat) == nil {
+			if err := wal_open(pager, filename); err != nil {
+				return fail(err)
+			}
+			if err := wal_close(pager.wal); err != nil {
+				pager.wal = nil
+				return fail(err)
+			}
+			pager.wal = nil
+		}
+		pager.journal = &Journal{
+			fileDescriptor: -1,
+			filename:       journal_filename(filename),
+			db_size:        pager.num_pages,
+			pages:          make(map[uint32]bool),
+		}
+	}
+
+	return pager, nil
+}
+
+// pager_abandon closes the files of a pager that failed without writing
+// anything more to them. A log or journal left behind is recovered on the
+// next open.
+func pager_abandon(pager *Pager) {
+	if pager.wal != nil {
+		syscall.Close(pager.wal.fileDescriptor)
+	}
+	if pager.journal != nil && pager.journal.fileDescriptor >= 0 {
+		syscall.Close(pager.journal.fileDescriptor)
+	}
+	syscall.Close(pager.fileDescriptor)
+}
+
+// pager_write writes a page to its place in the database file.
+func pager_write(pager *Pager, page_num uint32, data []byte) error {
+	offset, err := syscall.Seek(pager.fileDescriptor, int64(page_num)*PAGE_SIZE, 0)
+	if err != nil || offset == -1 {
+		return io_error("seeking file", err)
+	}
+
+	bytes_written, err := syscall.Write(pager.fileDescriptor, data[:PAGE_SIZE])
+	if err != nil || bytes_written == -1 {
+		return io_error("writing file", err)
+	}
+
+	if end := int64(page_num+1) * PAGE_SIZE; end > pager.fileLength {
+		pager.fileLength = end
+	}
+	pager.stats.pages_written++
+	return nil
+}
+
+func print_stats(w io.Writer, pager *Pager) {
+	dirty := 0
+	for _, frame := range pager.frames {
+		if frame.dirty {
+			dirty++
+		}
+	}
+
+	// Readers count in the totals, and their pool in the cached pages.
+	pool := &pager.readers.pool
+	pool.mutex.Lock()
+	stats := pool.stats
+	cached := len(pager.frames) + len(pool.frames)
+	pool.mutex.Unlock()
+
+	fmt.Fprintf(w, "pages read: %d\n", pager.stats.pages_read+stats.pages_read)
+	fmt.Fprintf(w, "pages written: %d\n", pager.stats.pages_written)
+	fmt.Fprintf(w, "cache hits: %d\n", pager.stats.cache_hits+stats.cache_hits)
+	fmt.Fprintf(w, "cache misses: %d\n", pager.stats.cache_misses+stats.cache_misses)
+	fmt.Fprintf(w, "evictions: %d\n", pager.stats.evictions+stats.evictions)
+	fmt.Fprintf(w, "cached pages: %d (%d dirty)\n", cached, dirty)
+	if pager.wal != nil {
+		fmt.Fprintf(w, "wal frames: %d (%d since checkpoint)\n", pager.stats.wal_frames, pager.wal.num_frames)
+	}
+}
@@ -0,0 +1,719 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MAX_PARAMETERS is the largest number a parameter can have.
+const MAX_PARAMETERS = 999
+
+// Ast is a parsed statement. statement_type says which of the other fields
+// are used:
+//
+//	insert:       table, values
+//	select:       table, alias, joins, projection, names, where, group_by,
+//	              having, order_by, limit, offset, explain
+//	delete:       table, where
+//	update:       table, assignments, where
+//	create table: table, columns
+//	create index: index, table, column
+//
+// Parameters can stand wherever a literal can, except in a limit or offset.
+// num_parameters is the largest parameter number.
+type Ast struct {
+	statement_type int
+	num_parameters int
+	table          Token
+	alias          Token
+	joins          []JoinNode
+	explain        bool
+	values         []Token
+	assignments    []AssignmentNode
+	where          *Expression
+	columns        []ColumnNode
+	index          Token // empty if the create index names none
+	column         Token
+	projection     []*Expression // nil for "*"
+	names          []string      // the text of each projection expression
+	group_by       []*Expression
+	having         *Expression
+	order_by       []OrderingNode
+	limit          *Token
+	offset         *Token
+}
+
+// AssignmentNode is one "column = value" of an update.
+type AssignmentNode struct {
+	column Token
+	value  Token
+}
+
+// JoinNode is one "[inner|left [outer]] join table [[as] alias] on condition".
+type JoinNode struct {
+	table     Token
+	alias     Token
+	left      bool
+	condition *Expression
+}
+
+// OrderingNode is one "expression [asc|desc]" of an order by.
+type OrderingNode struct {
+	expression *Expression
+	descending bool
+}
+
+// ColumnNode is one "name type" of a create table.
+type ColumnNode struct {
+	name        Token
+	column_type Token
+}
+
+type Parser struct {
+	input    string
+	tokens   []Token
+	position int
+}
+
+// parse_sql turns a statement into its Ast. A trailing semicolon is allowed.
+// It returns PREPARE_UNRECOGNIZED_STATEMENT if the statement does not start
+// with a known keyword and PREPARE_SYNTAX_ERROR, with the error, if it does
+// not follow the grammar.
+func parse_sql(sql string) (*Ast, int, *SyntaxError) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return nil, PREPARE_SYNTAX_ERROR, err
+	}
+	parser := &Parser{input: sql, tokens: tokens}
+	ast := &Ast{}
+	if ast.num_parameters, err = number_parameters(tokens); err != nil {
+		return nil, PREPARE_SYNTAX_ERROR, err
+	}
+
+	first := parser_next(parser)
+	if first.token_type != TOKEN_KEYWORD {
+		return nil, PREPARE_UNRECOGNIZED_STATEMENT, nil
+	}
+
+	switch first.text {
+	case "insert":
+		ast.statement_type = STATEMENT_INSERT
+		err = parse_insert(parser, ast)
+	case "select":
+		ast.statement_type = STATEMENT_SELECT
+		err = parse_select(parser, ast)
+	case "explain":
+		ast.statement_type = STATEMENT_SELECT
+		ast.explain = true
+		if err = parser_expect_keyword(parser, "select"); err == nil {
+			err = parse_select(parser, ast)
+		}
+	case "delete":
+		ast.statement_type = STATEMENT_DELETE
+		err = parse_delete(parser, ast)
+	case "update":
+		ast.statement_type = STATEMENT_UPDATE
+		err = parse_update(parser, ast)
+	case "create":
+		err = parse_create(parser, ast)
+	case "begin":
+		ast.statement_type = STATEMENT_BEGIN
+		parser_accept_keyword(parser, "transaction")
+	case "commit":
+		ast.statement_type = STATEMENT_COMMIT
+		parser_accept_keyword(parser, "transaction")
+	case "rollback":
+		ast.statement_type = STATEMENT_ROLLBACK
+		parser_accept_keyword(parser, "transaction")
+	default:
+		return nil, PREPARE_UNRECOGNIZED_STATEMENT, nil
+	}
+	if err == nil {
+		err = parse_end(parser)
+	}
+	if err != nil {
+		return nil, PREPARE_SYNTAX_ERROR, err
+	}
+	return ast, PREPARE_SUCCESS, nil
+}
+
+// number_parameters rewrites every "?" as "$" and its number, which is one
+// more than the largest number before it, and returns the largest number.
+func number_parameters(tokens []Token) (int, *SyntaxError) {
+	largest := 0
+	for i, token := range tokens {
+		if token.token_type != TOKEN_PARAMETER {
+			continue
+		}
+		number := largest + 1
+		if token.text != "?" {
+			number, _ = strconv.Atoi(token.text[1:])
+		}
+		if number < 1 || number > MAX_PARAMETERS {
+			return 0, &SyntaxError{line: token.line, column: token.column, message: fmt.Sprintf("parameter %s out of range", token.text)}
+		}
+		tokens[i].text = "$" + strconv.Itoa(number)
+		largest = max(largest, number)
+	}
+	return largest, nil
+}
+
+func parser_peek(parser *Parser) Token {
+	return parser.tokens[parser.position]
+}
+
+func parser_next(parser *Parser) Token {
+	token := parser.tokens[parser.position]
+	if token.token_type != TOKEN_EOF {
+		parser.position++
+	}
+	return token
+}
+
+func token_description(token Token) string {
+	switch token.token_type {
+	case TOKEN_EOF:
+		return "end of statement"
+	case TOKEN_STRING:
+		return fmt.Sprintf("'%s'", token.text)
+	case TOKEN_BLOB:
+		return "blob"
+	case TOKEN_PARAMETER:
+		return "parameter " + token.text
+	}
+	return fmt.Sprintf("%q", token.text)
+}
+
+// parser_error reports that the next token is not what the grammar expects.
+func parser_error(parser *Parser, expected string) *SyntaxError {
+	token := parser_peek(parser)
+	message := fmt.Sprintf("expected %s but found %s", expected, token_description(token))
+	return &SyntaxError{line: token.line, column: token.column, message: message}
+}
+
+func parser_is(parser *Parser, token_type int, text string) bool {
+	token := parser_peek(parser)
+	return token.token_type == token_type && token.text == text
+}
+
+func parser_accept_keyword(parser *Parser, keyword string) bool {
+	if parser_is(parser, TOKEN_KEYWORD, keyword) {
+		parser_next(parser)
+		return true
+	}
+	return false
+}
+
+func parser_expect_keyword(parser *Parser, keyword string) *SyntaxError {
+	if !parser_accept_keyword(parser, keyword) {
+		return parser_error(parser, fmt.Sprintf("%q", keyword))
+	}
+	return nil
+}
+
+func parser_accept_symbol(parser *Parser, symbol string) bool {
+	if parser_is(parser, TOKEN_SYMBOL, symbol) {
+		parser_next(parser)
+		return true
+	}
+	return false
+}
+
+func parser_expect_symbol(parser *Parser, symbol string) *SyntaxError {
+	if !parser_accept_symbol(parser, symbol) {
+		return parser_error(parser, fmt.Sprintf("%q", symbol))
+	}
+	return nil
+}
+
+func parse_identifier(parser *Parser, what string) (Token, *SyntaxError) {
+	if parser_peek(parser).token_type != TOKEN_IDENTIFIER {
+		return Token{}, parser_error(parser, what)
+	}
+	return parser_next(parser), nil
+}
+
+// parse_literal reads a constant: a number with an optional sign, a string,
+// a blob, true, false, null or a parameter.
+func parse_literal(parser *Parser) (Token, *SyntaxError) {
+	token := parser_peek(parser)
+	if parser_is(parser, TOKEN_SYMBOL, "-") || parser_is(parser, TOKEN_SYMBOL, "+") {
+		parser_next(parser)
+		number := parser_peek(parser)
+		if number.token_type != TOKEN_INTEGER && number.token_type != TOKEN_REAL {
+			return Token{}, parser_error(parser, "a number")
+		}
+		parser_next(parser)
+		if token.text == "-" {
+			number.text = "-" + number.text
+		}
+		number.line, number.column = token.line, token.column
+		return number, nil
+	}
+
+	switch token.token_type {
+	case TOKEN_INTEGER, TOKEN_REAL, TOKEN_STRING, TOKEN_BLOB, TOKEN_PARAMETER:
+		return parser_next(parser), nil
+	case TOKEN_KEYWORD:
+		if token.text == "true" || token.text == "false" || token.text == "null" {
+			return parser_next(parser), nil
+		}
+	}
+	return Token{}, parser_error(parser, "a value")
+}
+
+func parse_end(parser *Parser) *SyntaxError {
+	parser_accept_symbol(parser, ";")
+	if parser_peek(parser).token_type != TOKEN_EOF {
+		return parser_error(parser, "end of statement")
+	}
+	return nil
+}
+
+// parse_insert parses "insert into table values (value, ...)".
+func parse_insert(parser *Parser, ast *Ast) *SyntaxError {
+	var err *SyntaxError
+	if err = parser_expect_keyword(parser, "into"); err != nil {
+		return err
+	}
+	if ast.table, err = parse_identifier(parser, "a table name"); err != nil {
+		return err
+	}
+	if err = parser_expect_keyword(parser, "values"); err != nil {
+		return err
+	}
+	if err = parser_expect_symbol(parser, "("); err != nil {
+		return err
+	}
+	for {
+		value, err := parse_literal(parser)
+		if err != nil {
+			return err
+		}
+		ast.values = append(ast.values, value)
+		if !parser_accept_symbol(parser, ",") {
+			break
+		}
+	}
+	return parser_expect_symbol(parser, ")")
+}
+
+// parse_select parses "select * | expression, ... from table [[as] alias]
+// [join ...] [where ...] [group by expression, ...] [having condition]
+// [order by expression [asc|desc], ...] [limit count [offset skip]]".
+func parse_select(parser *Parser, ast *Ast) *SyntaxError {
+	var err *SyntaxError
+	if !parser_accept_symbol(parser, "*") {
+		for {
+			start := parser.tokens[parser.position].offset
+			expression, err := parse_expression(parser)
+			if err != nil {
+				return err
+			}
+			ast.projection = append(ast.projection, expression)
+			ast.names = append(ast.names, parser.input[start:parser.tokens[parser.position-1].end])
+			if !parser_accept_symbol(parser, ",") {
+				break
+			}
+		}
+	}
+	if err = parser_expect_keyword(parser, "from"); err != nil {
+		return err
+	}
+	if ast.table, ast.alias, err = parse_table_reference(parser); err != nil {
+		return err
+	}
+	for {
+		var join JoinNode
+		if parser_accept_keyword(parser, "left") {
+			join.left = true
+			parser_accept_keyword(parser, "outer")
+		} else if !parser_accept_keyword(parser, "inner") && !parser_is(parser, TOKEN_KEYWORD, "join") {
+			break
+		}
+		if err = parser_expect_keyword(parser, "join"); err != nil {
+			return err
+		}
+		if join.table, join.alias, err = parse_table_reference(parser); err != nil {
+			return err
+		}
+		if err = parser_expect_keyword(parser, "on"); err != nil {
+			return err
+		}
+		if join.condition, err = parse_expression(parser); err != nil {
+			return err
+		}
+		ast.joins = append(ast.joins, join)
+	}
+	if err = parse_where(parser, ast); err != nil {
+		return err
+	}
+
+	if parser_accept_keyword(parser, "group") {
+		if err = parser_expect_keyword(parser, "by"); err != nil {
+			return err
+		}
+		for {
+			expression, err := parse_expression(parser)
+			if err != nil {
+				return err
+			}
+			ast.group_by = append(ast.group_by, expression)
+			if !parser_accept_symbol(parser, ",") {
+				break
+			}
+		}
+	}
+	if parser_accept_keyword(parser, "having") {
+		if ast.having, err = parse_expression(parser); err != nil {
+			return err
+		}
+	}
+
+	if parser_accept_keyword(parser, "order") {
+		if err = parser_expect_keyword(parser, "by"); err != nil {
+			return err
+		}
+		for {
+			var ordering OrderingNode
+			if ordering.expression, err = parse_expression(parser); err != nil {
+				return err
+			}
+			if !parser_accept_keyword(parser, "asc") {
+				ordering.descending = parser_accept_keyword(parser, "desc")
+			}
+			ast.order_by = append(ast.order_by, ordering)
+			if !parser_accept_symbol(parser, ",") {
+				break
+			}
+		}
+	}
+
+	if parser_accept_keyword(parser, "limit") {
+		if ast.limit, err = parse_count(parser); err != nil {
+			return err
+		}
+		if parser_accept_keyword(parser, "offset") {
+			if ast.offset, err = parse_count(parser); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parse_table_reference reads a table name with an optional alias.
+func parse_table_reference(parser *Parser) (Token, Token, *SyntaxError) {
+	table, err := parse_identifier(parser, "a table name")
+	if err != nil {
+		return Token{}, Token{}, err
+	}
+	var alias Token
+	if parser_accept_keyword(parser, "as") {
+		alias, err = parse_identifier(parser, "an alias")
+	} else if parser_peek(parser).token_type == TOKEN_IDENTIFIER {
+		alias = parser_next(parser)
+	}
+	return table, alias, err
+}
+
+// parse_count reads the integer of a limit or offset.
+func parse_count(parser *Parser) (*Token, *SyntaxError) {
+	if parser_peek(parser).token_type != TOKEN_INTEGER {
+		return nil, parser_error(parser, "a whole number")
+	}
+	count := parser_next(parser)
+	return &count, nil
+}
+
+// parse_delete parses "delete from table [where ...]".
+func parse_delete(parser *Parser, ast *Ast) *SyntaxError {
+	var err *SyntaxError
+	if err = parser_expect_keyword(parser, "from"); err != nil {
+		return err
+	}
+	if ast.table, err = parse_identifier(parser, "a table name"); err != nil {
+		return err
+	}
+	return parse_where(parser, ast)
+}
+
+// parse_update parses "update table set column = value[, ...] [where ...]".
+func parse_update(parser *Parser, ast *Ast) *SyntaxError {
+	var err *SyntaxError
+	if ast.table, err = parse_identifier(parser, "a table name"); err != nil {
+		return err
+	}
+	if err = parser_expect_keyword(parser, "set"); err != nil {
+		return err
+	}
+	for {
+		var assignment AssignmentNode
+		if assignment.column, err = parse_identifier(parser, "a column name"); err != nil {
+			return err
+		}
+		if err = parser_expect_symbol(parser, "="); err != nil {
+			return err
+		}
+		if assignment.value, err = parse_literal(parser); err != nil {
+			return err
+		}
+		ast.assignments = append(ast.assignments, assignment)
+		if !parser_accept_symbol(parser, ",") {
+			break
+		}
+	}
+	return parse_where(parser, ast)
+}
+
+// parse_where parses an optional "where expression".
+func parse_where(parser *Parser, ast *Ast) *SyntaxError {
+	if !parser_accept_keyword(parser, "where") {
+		return nil
+	}
+	var err *SyntaxError
+	ast.where, err = parse_expression(parser)
+	return err
+}
+
+// parse_expression parses an expression. From loosest to tightest binding the
+// operators are OR, AND, NOT, comparisons (with BETWEEN, IN, LIKE and IS
+// NULL), + and -, then *, / and %, then a unary sign.
+func parse_expression(parser *Parser) (*Expression, *SyntaxError) {
+	left, err := parse_and(parser)
+	for err == nil && parser_accept_keyword(parser, "or") {
+		var right *Expression
+		right, err = parse_and(parser)
+		left = &Expression{expression_type: EXPRESSION_OR, operands: []*Expression{left, right}}
+	}
+	return left, err
+}
+
+func parse_and(parser *Parser) (*Expression, *SyntaxError) {
+	left, err := parse_not(parser)
+	for err == nil && parser_accept_keyword(parser, "and") {
+		var right *Expression
+		right, err = parse_not(parser)
+		left = &Expression{expression_type: EXPRESSION_AND, operands: []*Expression{left, right}}
+	}
+	return left, err
+}
+
+func parse_not(parser *Parser) (*Expression, *SyntaxError) {
+	if !parser_accept_keyword(parser, "not") {
+		return parse_comparison(parser)
+	}
+	operand, err := parse_not(parser)
+	return &Expression{expression_type: EXPRESSION_NOT, operands: []*Expression{operand}}, err
+}
+
+var comparison_operators = map[string]string{
+	"=": "=", "==": "=", "!=": "!=", "<>": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+}
+
+// parse_comparison parses an arithmetic expression followed by at most one
+// comparison, "[not] between low and high", "[not] in (item, ...)",
+// "[not] like pattern" or "is [not] null".
+func parse_comparison(parser *Parser) (*Expression, *SyntaxError) {
+	left, err := parse_additive(parser)
+	if err != nil {
+		return nil, err
+	}
+
+	token := parser_peek(parser)
+	if operator, ok := comparison_operators[token.text]; ok && token.token_type == TOKEN_SYMBOL {
+		parser_next(parser)
+		right, err := parse_additive(parser)
+		return &Expression{expression_type: EXPRESSION_COMPARE, operator: operator, operands: []*Expression{left, right}}, err
+	}
+
+	if parser_accept_keyword(parser, "is") {
+		expression := &Expression{expression_type: EXPRESSION_IS_NULL, operands: []*Expression{left}}
+		expression.negated = parser_accept_keyword(parser, "not")
+		return expression, parser_expect_keyword(parser, "null")
+	}
+
+	negated := parser_accept_keyword(parser, "not")
+	expression := &Expression{negated: negated, operands: []*Expression{left}}
+	switch {
+	case parser_accept_keyword(parser, "between"):
+		expression.expression_type = EXPRESSION_BETWEEN
+		low, err := parse_additive(parser)
+		if err != nil {
+			return nil, err
+		}
+		if err = parser_expect_keyword(parser, "and"); err != nil {
+			return nil, err
+		}
+		high, err := parse_additive(parser)
+		expression.operands = append(expression.operands, low, high)
+		return expression, err
+	case parser_accept_keyword(parser, "in"):
+		expression.expression_type = EXPRESSION_IN
+		if err = parser_expect_symbol(parser, "("); err != nil {
+			return nil, err
+		}
+		for {
+			item, err := parse_expression(parser)
+			if err != nil {
+				return nil, err
+			}
+			expression.operands = append(expression.operands, item)
+			if !parser_accept_symbol(parser, ",") {
+				break
+			}
+		}
+		return expression, parser_expect_symbol(parser, ")")
+	case parser_accept_keyword(parser, "like"):
+		expression.expression_type = EXPRESSION_LIKE
+		pattern, err := parse_additive(parser)
+		expression.operands = append(expression.operands, pattern)
+		return expression, err
+	case negated:
+		return nil, parser_error(parser, "\"between\", \"in\" or \"like\"")
+	}
+	return left, nil
+}
+
+func parse_additive(parser *Parser) (*Expression, *SyntaxError) {
+	return parse_binary(parser, []string{"+", "-"}, parse_multiplicative)
+}
+
+func parse_multiplicative(parser *Parser) (*Expression, *SyntaxError) {
+	return parse_binary(parser, []string{"*", "/", "%"}, parse_unary)
+}
+
+// parse_binary parses a left-associative chain of the given operators.
+func parse_binary(parser *Parser, operators []string, parse_operand func(*Parser) (*Expression, *SyntaxError)) (*Expression, *SyntaxError) {
+	left, err := parse_operand(parser)
+	for err == nil {
+		token := parser_peek(parser)
+		if token.token_type != TOKEN_SYMBOL || !slices.Contains(operators, token.text) {
+			break
+		}
+		parser_next(parser)
+		var right *Expression
+		right, err = parse_operand(parser)
+		left = &Expression{expression_type: EXPRESSION_ARITHMETIC, operator: token.text, operands: []*Expression{left, right}}
+	}
+	return left, err
+}
+
+// parse_unary parses a signed operand. A sign in front of a number is part
+// of the literal.
+func parse_unary(parser *Parser) (*Expression, *SyntaxError) {
+	if !parser_is(parser, TOKEN_SYMBOL, "-") && !parser_is(parser, TOKEN_SYMBOL, "+") {
+		return parse_primary(parser)
+	}
+	next := parser.tokens[parser.position+1]
+	if next.token_type == TOKEN_INTEGER || next.token_type == TOKEN_REAL {
+		literal, err := parse_literal(parser)
+		return &Expression{expression_type: EXPRESSION_LITERAL, token: literal}, err
+	}
+
+	sign := parser_next(parser)
+	operand, err := parse_unary(parser)
+	if sign.text == "+" {
+		return operand, err
+	}
+	return &Expression{expression_type: EXPRESSION_NEGATE, operands: []*Expression{operand}}, err
+}
+
+// parse_primary parses a literal, a column name with an optional table, a
+// function call or a parenthesized expression.
+func parse_primary(parser *Parser) (*Expression, *SyntaxError) {
+	if parser_accept_symbol(parser, "(") {
+		expression, err := parse_expression(parser)
+		if err != nil {
+			return nil, err
+		}
+		return expression, parser_expect_symbol(parser, ")")
+	}
+	if parser_peek(parser).token_type == TOKEN_IDENTIFIER {
+		name := parser_next(parser)
+		if parser_accept_symbol(parser, "(") {
+			return parse_call(parser, name)
+		}
+		if parser_accept_symbol(parser, ".") {
+			column, err := parse_identifier(parser, "a column name")
+			return &Expression{expression_type: EXPRESSION_COLUMN, token: column, qualifier: name}, err
+		}
+		return &Expression{expression_type: EXPRESSION_COLUMN, token: name}, nil
+	}
+	literal, err := parse_literal(parser)
+	if err != nil {
+		return nil, parser_error(parser, "an expression")
+	}
+	return &Expression{expression_type: EXPRESSION_LITERAL, token: literal}, nil
+}
+
+// parse_call parses the arguments of an aggregate function after its
+// opening parenthesis: "count(*)" or "name(expression)".
+func parse_call(parser *Parser, name Token) (*Expression, *SyntaxError) {
+	expression := &Expression{expression_type: EXPRESSION_AGGREGATE, token: name, operator: strings.ToLower(name.text)}
+	if !parser_accept_symbol(parser, "*") {
+		argument, err := parse_expression(parser)
+		if err != nil {
+			return nil, err
+		}
+		expression.operands = []*Expression{argument}
+	}
+	return expression, parser_expect_symbol(parser, ")")
+}
+
+// parse_create parses "create table name (column type, ...)" and create
+// index.
+func parse_create(parser *Parser, ast *Ast) *SyntaxError {
+	var err *SyntaxError
+	if parser_accept_keyword(parser, "index") {
+		ast.statement_type = STATEMENT_CREATE_INDEX
+		return parse_create_index(parser, ast)
+	}
+	ast.statement_type = STATEMENT_CREATE_TABLE
+	if err = parser_expect_keyword(parser, "table"); err != nil {
+		return err
+	}
+	if ast.table, err = parse_identifier(parser, "a table name"); err != nil {
+		return err
+	}
+	if err = parser_expect_symbol(parser, "("); err != nil {
+		return err
+	}
+	for {
+		var column ColumnNode
+		if column.name, err = parse_identifier(parser, "a column name"); err != nil {
+			return err
+		}
+		if column.column_type, err = parse_identifier(parser, "a column type"); err != nil {
+			return err
+		}
+		ast.columns = append(ast.columns, column)
+		if !parser_accept_symbol(parser, ",") {
+			break
+		}
+	}
+	return parser_expect_symbol(parser, ")")
+}
+
+// parse_create_index reads "create index [name] on table (column)".
+func parse_create_index(parser *Parser, ast *Ast) *SyntaxError {
+	var err *SyntaxError
+	if parser_peek(parser).token_type == TOKEN_IDENTIFIER {
+		ast.index = parser_next(parser)
+	}
+	if err = parser_expect_keyword(parser, "on"); err != nil {
+		return err
+	}
+	if ast.table, err = parse_identifier(parser, "a table name"); err != nil {
+		return err
+	}
+	if err = parser_expect_symbol(parser, "("); err != nil {
+		return err
+	}
+	if ast.column, err = parse_identifier(parser, "a column name"); err != nil {
+		return err
+	}
+	return parser_expect_symbol(parser, ")")
+}
@@ -0,0 +1,421 @@
+package engine
+
+import (
+	"math"
+)
+
+// KeyRange is the inclusive range of ids selected by a where clause.
+type KeyRange struct {
+	min uint32
+	max uint32
+}
+
+// EMPTY_KEY_RANGE is inverted so that it contains no key.
+var EMPTY_KEY_RANGE = KeyRange{min: 1, max: 0}
+
+var FULL_KEY_RANGE = KeyRange{min: 0, max: math.MaxUint32}
+
+func (key_range KeyRange) empty() bool {
+	return key_range.min > key_range.max
+}
+
+func (key_range KeyRange) intersect(other KeyRange) KeyRange {
+	return KeyRange{min: max(key_range.min, other.min), max: min(key_range.max, other.max)}
+}
+
+// hull returns the smallest range holding both ranges.
+func (key_range KeyRange) hull(other KeyRange) KeyRange {
+	if key_range.empty() {
+		return other
+	}
+	if other.empty() {
+		return key_range
+	}
+	return KeyRange{min: min(key_range.min, other.min), max: max(key_range.max, other.max)}
+}
+
+// key_range_between returns the keys between two bounds, which need not be
+// whole numbers or fit in a key.
+func key_range_between(low float64, high float64) KeyRange {
+	low = max(math.Ceil(low), 0)
+	high = min(math.Floor(high), math.MaxUint32)
+	if low > high {
+		return EMPTY_KEY_RANGE
+	}
+	return KeyRange{min: uint32(low), max: uint32(high)}
+}
+
+// Predicate is a parsed where clause. key_range holds the keys the condition
+// can possibly match, so only that part of the tree is read; every row in it
+// is then checked against the whole condition. When the key is not narrowed
+// but the value of an indexed column is, the rows are found through the
+// index instead, between two entries of it.
+type Predicate struct {
+	key_range  KeyRange
+	index      *Index
+	index_low  []byte
+	index_high []byte // nil if the range has no upper end
+	condition  *Expression
+}
+
+// prepare_where turns a where clause into a predicate. Without a where clause
+// every row is selected.
+func prepare_where(where *Expression, predicate *Predicate, scope *Scope) int {
+	*predicate = Predicate{key_range: FULL_KEY_RANGE}
+	if where == nil {
+		return PREPARE_SUCCESS
+	}
+
+	if result := prepare_expression(where, scope); result != PREPARE_SUCCESS {
+		return result
+	}
+	if contains_aggregate(where) {
+		return PREPARE_MISUSED_AGGREGATE
+	}
+	if !is_boolean_type(where.value_type) {
+		return PREPARE_TYPE_MISMATCH
+	}
+	predicate.condition = where
+	predicate.key_range = plan_key_range(where)
+	if predicate.key_range == FULL_KEY_RANGE {
+		plan_index(predicate, scope.sources[0].table)
+	}
+	return PREPARE_SUCCESS
+}
+
+// mirrored_operators gives the comparison that holds with its operands
+// swapped, so "5 < id" can be read as "id > 5".
+var mirrored_operators = map[string]string{
+	"=": "=", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<=",
+}
+
+// plan_key_range works out which keys a condition can match. Comparisons of
+// the key column with numbers, BETWEEN and IN narrow the range. An AND keeps
+// the keys both sides can match and an OR the keys either side can; anything
+// else may match any key.
+func plan_key_range(condition *Expression) KeyRange {
+	operands := condition.operands
+	switch condition.expression_type {
+	case EXPRESSION_AND:
+		return plan_key_range(operands[0]).intersect(plan_key_range(operands[1]))
+	case EXPRESSION_OR:
+		return plan_key_range(operands[0]).hull(plan_key_range(operands[1]))
+	case EXPRESSION_COMPARE:
+		operator := condition.operator
+		column, bound := operands[0], operands[1]
+		if !is_key_column(column) {
+			column, bound = bound, column
+			operator = mirrored_operators[operator]
+		}
+		if !is_key_column(column) || !is_number_literal(bound) {
+			return FULL_KEY_RANGE
+		}
+		value := numeric_value(bound.value)
+		switch operator {
+		case "=":
+			return key_range_between(value, value)
+		case "<":
+			return key_range_between(0, math.Ceil(value)-1)
+		case "<=":
+			return key_range_between(0, value)
+		case ">":
+			return key_range_between(math.Floor(value)+1, math.MaxUint32)
+		case ">=":
+			return key_range_between(value, math.MaxUint32)
+		}
+	case EXPRESSION_BETWEEN:
+		if condition.negated || !is_key_column(operands[0]) || !is_number_literal(operands[1]) || !is_number_literal(operands[2]) {
+			return FULL_KEY_RANGE
+		}
+		return key_range_between(numeric_value(operands[1].value), numeric_value(operands[2].value))
+	case EXPRESSION_IN:
+		if condition.negated || !is_key_column(operands[0]) {
+			return FULL_KEY_RANGE
+		}
+		key_range := EMPTY_KEY_RANGE
+		for _, item := range operands[1:] {
+			if !is_number_literal(item) {
+				return FULL_KEY_RANGE
+			}
+			value := numeric_value(item.value)
+			key_range = key_range.hull(key_range_between(value, value))
+		}
+		return key_range
+	}
+	return FULL_KEY_RANGE
+}
+
+// IndexRange is the inclusive range of values of an indexed column that a
+// condition can match. A NULL bound leaves that end open.
+type IndexRange struct {
+	low   Value
+	high  Value
+	empty bool
+}
+
+var FULL_INDEX_RANGE = IndexRange{}
+
+func index_range_point(value Value) IndexRange {
+	return IndexRange{low: value, high: value}
+}
+
+// bound_before reports whether a lower bound a starts before b, or an upper
+// bound a ends after b when upper is set. An open bound reaches furthest.
+func bound_before(a Value, b Value, upper bool) bool {
+	if a.value_type == COLUMN_TYPE_NULL || b.value_type == COLUMN_TYPE_NULL {
+		return a.value_type == COLUMN_TYPE_NULL
+	}
+	if upper {
+		return compare_values(a, b) > 0
+	}
+	return compare_values(a, b) < 0
+}
+
+func (index_range IndexRange) intersect(other IndexRange) IndexRange {
+	result := IndexRange{low: index_range.low, high: index_range.high, empty: index_range.empty || other.empty}
+	if bound_before(result.low, other.low, false) {
+		result.low = other.low
+	}
+	if bound_before(result.high, other.high, true) {
+		result.high = other.high
+	}
+	if result.low.value_type != COLUMN_TYPE_NULL && result.high.value_type != COLUMN_TYPE_NULL && compare_values(result.low, result.high) > 0 {
+		result.empty = true
+	}
+	return result
+}
+
+func (index_range IndexRange) hull(other IndexRange) IndexRange {
+	if index_range.empty {
+		return other
+	}
+	if other.empty {
+		return index_range
+	}
+	result := index_range
+	if bound_before(other.low, result.low, false) {
+		result.low = other.low
+	}
+	if bound_before(other.high, result.high, true) {
+		result.high = other.high
+	}
+	return result
+}
+
+// plan_index_range works out which values of a column a condition can match,
+// the way plan_key_range does for the key.
+func plan_index_range(condition *Expression, column int) IndexRange {
+	operands := condition.operands
+	is_column := func(expression *Expression) bool {
+		return expression.expression_type == EXPRESSION_COLUMN && expression.column == column
+	}
+	is_bound := func(expression *Expression) bool {
+		return expression.expression_type == EXPRESSION_LITERAL && expression.value_type != COLUMN_TYPE_NULL
+	}
+
+	switch condition.expression_type {
+	case EXPRESSION_AND:
+		return plan_index_range(operands[0], column).intersect(plan_index_range(operands[1], column))
+	case EXPRESSION_OR:
+		return plan_index_range(operands[0], column).hull(plan_index_range(operands[1], column))
+	case EXPRESSION_COMPARE:
+		operator := condition.operator
+		indexed, bound := operands[0], operands[1]
+		if !is_column(indexed) {
+			indexed, bound = bound, indexed
+			operator = mirrored_operators[operator]
+		}
+		if !is_column(indexed) || !is_bound(bound) {
+			return FULL_INDEX_RANGE
+		}
+		switch operator {
+		case "=":
+			return index_range_point(bound.value)
+		case "<", "<=":
+			return IndexRange{high: bound.value}
+		case ">", ">=":
+			return IndexRange{low: bound.value}
+		}
+	case EXPRESSION_BETWEEN:
+		if condition.negated || !is_column(operands[0]) || !is_bound(operands[1]) || !is_bound(operands[2]) {
+			return FULL_INDEX_RANGE
+		}
+		return IndexRange{low: operands[1].value, high: operands[2].value}.intersect(FULL_INDEX_RANGE)
+	case EXPRESSION_IN:
+		if condition.negated || !is_column(operands[0]) {
+			return FULL_INDEX_RANGE
+		}
+		index_range := IndexRange{empty: true}
+		for _, item := range operands[1:] {
+			if !is_bound(item) {
+				return FULL_INDEX_RANGE
+			}
+			index_range = index_range.hull(index_range_point(item.value))
+		}
+		return index_range
+	}
+	return FULL_INDEX_RANGE
+}
+
+// plan_index picks the index that narrows the condition most: one that
+// leaves no rows, then one limited to a single value, then any other with a
+// bound.
+func plan_index(predicate *Predicate, table *Table) {
+	best := -1
+	var best_index *Index
+	var best_range IndexRange
+	for _, index := range table.indexes {
+		index_range := plan_index_range(predicate.condition, index.column)
+		rank := 0
+		switch {
+		case index_range.empty:
+			rank = 3
+		case index_range.low.value_type == COLUMN_TYPE_NULL && index_range.high.value_type == COLUMN_TYPE_NULL:
+			continue
+		case index_range.low.value_type != COLUMN_TYPE_NULL && index_range.high.value_type != COLUMN_TYPE_NULL &&
+			compare_values(index_range.low, index_range.high) == 0:
+			rank = 2
+		case index_range.low.value_type != COLUMN_TYPE_NULL && index_range.high.value_type != COLUMN_TYPE_NULL:
+			rank = 1
+		}
+		if rank > best {
+			best, best_index, best_range = rank, index, index_range
+		}
+	}
+
+	if best_index == nil {
+		return
+	}
+	if best_range.empty {
+		predicate.key_range = EMPTY_KEY_RANGE
+		return
+	}
+	column_type := table.schema.columns[best_index.column].column_type
+	predicate.index = best_index
+	predicate.index_low = index_entry(nil, 0)
+	if best_range.low.value_type != COLUMN_TYPE_NULL {
+		predicate.index_low = index_entry(index_bound(column_type, best_range.low, false), 0)
+	}
+	if best_range.high.value_type != COLUMN_TYPE_NULL {
+		predicate.index_high = index_entry(index_bound(column_type, best_range.high, true), math.MaxUint32)
+	}
+}
+
+func is_key_column(expression *Expression) bool {
+	return expression.expression_type == EXPRESSION_COLUMN && expression.column == KEY_COLUMN
+}
+
+func is_number_literal(expression *Expression) bool {
+	return expression.expression_type == EXPRESSION_LITERAL &&
+		(expression.value_type == COLUMN_TYPE_INTEGER || expression.value_type == COLUMN_TYPE_REAL)
+}
+
+func predicate_matches(predicate *Predicate, row *Row) bool {
+	return predicate.condition == nil || is_true(evaluate_expression(predicate.condition, row))
+}
+
+// predicate_start returns a cursor on the first row of the predicate's key
+// range. A range of one key is a point lookup with table_find; a wider one is
+// read from table_seek until the cursor passes its end. With an index the
+// cursor walks its entries from the lower end of the range instead.
+func predicate_start(table *Table, predicate *Predicate) (*Cursor, error) {
+	key_range := predicate.key_range
+	if key_range.empty() {
+		return &Cursor{table: table, end_of_table: true}, nil
+	}
+	if predicate.index != nil {
+		index_cursor, err := index_seek(predicate.index, predicate.index_low)
+		if err != nil {
+			return nil, err
+		}
+		return &Cursor{table: table, index: index_cursor}, nil
+	}
+	if key_range.min != key_range.max {
+		return table_seek(table, key_range.min)
+	}
+
+	cursor, err := table_find(table, key_range.min)
+	if err != nil {
+		return nil, err
+	}
+	node, err := get_page(table.pager, cursor.page_num)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.cell_num >= leaf_node_num_cells(*node) || leaf_node_key(*node, cursor.cell_num) != key_range.min {
+		cursor.end_of_table = true
+	}
+	return cursor, nil
+}
+
+// predicate_find moves the cursor forward to the next row that matches the
+// predicate, reading it into row. It returns false once the key range is
+// exhausted.
+func predicate_find(cursor *Cursor, predicate *Predicate, row *Row) (bool, error) {
+	table := cursor.table
+	for !cursor.end_of_table {
+		if cursor.index != nil {
+			if err := predicate_index_row(cursor, predicate); err != nil {
+				return false, err
+			}
+			if cursor.end_of_table {
+				break
+			}
+		} else {
+			key, err := cursor_key(cursor)
+			if err != nil {
+				return false, err
+			}
+			if key > predicate.key_range.max {
+				cursor.end_of_table = true
+				break
+			}
+		}
+		source, err := cursor_value(cursor)
+		if err != nil {
+			return false, err
+		}
+		if err := deserialize_row(table.schema, source, row); err != nil {
+			return false, err
+		}
+		if predicate_matches(predicate, row) {
+			return true, nil
+		}
+		if err := predicate_advance(cursor); err != nil {
+			return false, err
+		}
+		pager_end_operation(table.pager)
+	}
+	return false, nil
+}
+
+// predicate_index_row puts the cursor on the row of the index entry it is at,
+// or ends it once the entries pass the range.
+func predicate_index_row(cursor *Cursor, predicate *Predicate) error {
+	if cursor.index.end {
+		cursor.end_of_table = true
+		return nil
+	}
+	entry, err := index_cursor_entry(cursor.index)
+	if err != nil {
+		return err
+	}
+	if predicate.index_high != nil && compare_index_entries(entry, predicate.index_high) > 0 {
+		cursor.end_of_table = true
+		return nil
+	}
+	found, err := table_find(cursor.table, index_entry_key(entry))
+	if err != nil {
+		return err
+	}
+	cursor.page_num, cursor.cell_num = found.page_num, found.cell_num
+	return nil
+}
+
+// predicate_advance moves past the row predicate_find returned.
+func predicate_advance(cursor *Cursor) error {
+	if cursor.index != nil {
+		return index_cursor_advance(cursor.index)
+	}
+	return cursor_advance(cursor)
+}
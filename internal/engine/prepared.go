@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// A compiled statement is parsed once and run any number of times with
+// different values for its parameters. Binding writes each value into the
+// Ast as a literal token of its type, so a value is never read as SQL. The
+// names in the statement are resolved each time it runs, which keeps it
+// valid when a rollback reloads the catalog or a table or index is created.
+type CompiledStatement struct {
+	sql        string
+	ast        *Ast
+	parameters []Parameter
+	busy       sync.Mutex // held while it runs, since binding and preparing change the Ast
+}
+
+// Parameter is where a parameter appears in the Ast of a compiled statement.
+// A number can appear more than once.
+type Parameter struct {
+	number int
+	token  *Token
+}
+
+// DEFAULT_STATEMENT_CACHE_SIZE is how many compiled statements a database
+// keeps for reuse.
+const DEFAULT_STATEMENT_CACHE_SIZE = 64
+
+// StatementCache keeps the most recently used compiled statements by their
+// text.
+type StatementCache struct {
+	mutex      sync.Mutex
+	capacity   int
+	statements map[string]*list.Element
+	lru        *list.List // front is most recently used
+}
+
+func new_statement_cache(capacity int) *StatementCache {
+	return &StatementCache{capacity: capacity, statements: make(map[string]*list.Element), lru: list.New()}
+}
+
+// compile_statement parses a statement and finds its parameters.
+func compile_statement(sql string) (*CompiledStatement, int, *SyntaxError) {
+	ast, result, err := parse_sql(sql)
+	if result != PREPARE_SUCCESS {
+		return nil, result, err
+	}
+	compiled := &CompiledStatement{sql: sql, ast: ast}
+	if ast.num_parameters > 0 {
+		compiled.parameters = ast_parameters(ast)
+	}
+	return compiled, PREPARE_SUCCESS, nil
+}
+
+// cache_compile returns the compiled statement for the text, compiling it
+// if the cache does not have it. Statements that fail to parse are not kept.
+func cache_compile(cache *StatementCache, sql string) (*CompiledStatement, int, *SyntaxError) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, ok := cache.statements[sql]; ok {
+		cache.lru.MoveToFront(element)
+		return element.Value.(*CompiledStatement), PREPARE_SUCCESS, nil
+	}
+	compiled, result, err := compile_statement(sql)
+	if result != PREPARE_SUCCESS {
+		return nil, result, err
+	}
+	cache.statements[sql] = cache.lru.PushFront(compiled)
+	if cache.lru.Len() > cache.capacity {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.statements, oldest.Value.(*CompiledStatement).sql)
+	}
+	return compiled, PREPARE_SUCCESS, nil
+}
+
+// compiled_acquire takes a compiled statement for one run, which releases
+// it. A statement already running in another goroutine is compiled again
+// rather than waited for.
+func compiled_acquire(compiled *CompiledStatement) *CompiledStatement {
+	if compiled.busy.TryLock() {
+		return compiled
+	}
+	fresh, _, _ := compile_statement(compiled.sql)
+	fresh.busy.Lock()
+	return fresh
+}
+
+func compiled_release(compiled *CompiledStatement) {
+	compiled.busy.Unlock()
+}
+
+// ast_parameters finds the parameter tokens of an Ast.
+func ast_parameters(ast *Ast) []Parameter {
+	var parameters []Parameter
+	add := func(token *Token) {
+		if token.token_type == TOKEN_PARAMETER {
+			number, _ := strconv.Atoi(token.text[1:])
+			parameters = append(parameters, Parameter{number: number, token: token})
+		}
+	}
+	var walk func(expression *Expression)
+	walk = func(expression *Expression) {
+		if expression == nil {
+			return
+		}
+		if expression.expression_type == EXPRESSION_LITERAL {
+			add(&expression.token)
+		}
+		for _, operand := range expression.operands {
+			walk(operand)
+		}
+	}
+
+	for i := range ast.values {
+		add(&ast.values[i])
+	}
+	for i := range ast.assignments {
+		add(&ast.assignments[i].value)
+	}
+	for _, expression := range ast.projection {
+		walk(expression)
+	}
+	for _, join := range ast.joins {
+		walk(join.condition)
+	}
+	walk(ast.where)
+	for _, expression := range ast.group_by {
+		walk(expression)
+	}
+	walk(ast.having)
+	for _, ordering := range ast.order_by {
+		walk(ordering.expression)
+	}
+	return parameters
+}
+
+// bind_parameters writes the arguments into the parameters of a compiled
+// statement, the first argument for $1 and so on.
+func bind_parameters(compiled *CompiledStatement, arguments []any) error {
+	if len(arguments) != compiled.ast.num_parameters {
+		return fmt.Errorf("expected %d arguments, got %d", compiled.ast.num_parameters, len(arguments))
+	}
+	values := make([]Value, len(arguments))
+	for i, argument := range arguments {
+		value, err := argument_value(argument)
+		if err != nil {
+			return fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		values[i] = value
+	}
+	for _, parameter := range compiled.parameters {
+		token := value_token(values[parameter.number-1])
+		token.line, token.column = parameter.token.line, parameter.token.column
+		token.offset, token.end = parameter.token.offset, parameter.token.end
+		*parameter.token = token
+	}
+	return nil
+}
+
+// value_token is the literal token of a value. Numbers are written so that
+// they read back exactly.
+func value_token(value Value) Token {
+	switch value.value_type {
+	case COLUMN_TYPE_INTEGER:
+		return Token{token_type: TOKEN_INTEGER, text: strconv.FormatInt(value.integer, 10)}
+	case COLUMN_TYPE_REAL:
+		return Token{token_type: TOKEN_REAL, text: strconv.FormatFloat(value.real, 'g', -1, 64)}
+	case COLUMN_TYPE_TEXT:
+		return Token{token_type: TOKEN_STRING, text: value.text}
+	case COLUMN_TYPE_BLOB:
+		return Token{token_type: TOKEN_BLOB, text: value.text}
+	case COLUMN_TYPE_BOOLEAN:
+		if value.integer != 0 {
+			return Token{token_type: TOKEN_KEYWORD, text: "true"}
+		}
+		return Token{token_type: TOKEN_KEYWORD, text: "false"}
+	}
+	return Token{token_type: TOKEN_KEYWORD, text: "null"}
+}
+
+// argument_value converts a Go value passed for a parameter: nil, a Value,
+// an integer, a float, a bool, a string or a []byte.
+func argument_value(argument any) (Value, error) {
+	switch argument := argument.(type) {
+	case nil:
+		return Value{value_type: COLUMN_TYPE_NULL}, nil
+	case Value:
+		return argument, nil
+	case int:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case int8:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case int16:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case int32:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case int64:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: argument}, nil
+	case uint8:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case uint16:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case uint32:
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case uint:
+		if uint64(argument) > math.MaxInt64 {
+			return Value{}, fmt.Errorf("%d is too large for an integer", argument)
+		}
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case uint64:
+		if argument > math.MaxInt64 {
+			return Value{}, fmt.Errorf("%d is too large for an integer", argument)
+		}
+		return Value{value_type: COLUMN_TYPE_INTEGER, integer: int64(argument)}, nil
+	case float32:
+		return argument_value(float64(argument))
+	case float64:
+		if math.IsNaN(argument) || math.IsInf(argument, 0) {
+			return Value{}, fmt.Errorf("%v is not a number the database can store", argument)
+		}
+		return Value{value_type: COLUMN_TYPE_REAL, real: argument}, nil
+	case bool:
+		return boolean_value(argument), nil
+	case string:
+		return Value{value_type: COLUMN_TYPE_TEXT, text: argument}, nil
+	case []byte:
+		return Value{value_type: COLUMN_TYPE_BLOB, text: string(argument)}, nil
+	}
+	return Value{}, fmt.Errorf("unsupported type %T", argument)
+}
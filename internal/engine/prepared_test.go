@@ -0,0 +1,28 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_statement_cache(t *testing.T) {
+	cache := new_statement_cache(DEFAULT_STATEMENT_CACHE_SIZE)
+	first, _, _ := cache_compile(cache, "select * from users where id = 0")
+	if again, _, _ := cache_compile(cache, "select * from users where id = 0"); again != first {
+		t.Errorf("expected the statement to be compiled once")
+	}
+
+	// The cache keeps the most recently used statements.
+	for i := 0; i < DEFAULT_STATEMENT_CACHE_SIZE+10; i++ {
+		cache_compile(cache, fmt.Sprintf("select * from users where id = %d", i))
+	}
+	if cache.lru.Len() != DEFAULT_STATEMENT_CACHE_SIZE || len(cache.statements) != DEFAULT_STATEMENT_CACHE_SIZE {
+		t.Errorf("expected the cache to hold %d statements, got %d", DEFAULT_STATEMENT_CACHE_SIZE, cache.lru.Len())
+	}
+	if _, ok := cache.statements["select * from users where id = 0"]; ok {
+		t.Errorf("expected the oldest statement to have been evicted")
+	}
+	if _, _, err := cache_compile(cache, "select from"); err == nil || len(cache.statements) != DEFAULT_STATEMENT_CACHE_SIZE {
+		t.Errorf("expected a statement that fails to parse not to be cached")
+	}
+}
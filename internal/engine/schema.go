@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// COLUMN_TYPE_NULL is the type of a missing value. No column has it, but any
+// column other than the key can hold a NULL.
+const (
+	COLUMN_TYPE_NULL = iota
+	COLUMN_TYPE_INTEGER
+	COLUMN_TYPE_TEXT
+	COLUMN_TYPE_REAL
+	COLUMN_TYPE_BLOB
+	COLUMN_TYPE_BOOLEAN
+)
+
+// KEY_COLUMN is the column rows are keyed by in the B-tree. It has to be an
+// INTEGER and every value must fit in a uint32.
+const KEY_COLUMN = 0
+
+const MAX_NAME_LENGTH = 255
+
+// MAX_VALUE_LENGTH is the longest TEXT or BLOB value a record can hold.
+const MAX_VALUE_LENGTH = math.MaxUint16
+
+type Column struct {
+	name        string
+	column_type int
+}
+
+// Schema describes a table created with "create table".
+type Schema struct {
+	name    string
+	columns []Column
+}
+
+// Value is one field of a row. INTEGER and BOOLEAN use integer, REAL uses
+// real, and TEXT and BLOB keep their bytes in text. A NULL has value_type
+// COLUMN_TYPE_NULL.
+type Value struct {
+	value_type int
+	integer    int64
+	real       float64
+	text       string
+}
+
+func column_type_from_name(name string) (int, bool) {
+	switch strings.ToLower(name) {
+	case "integer", "int":
+		return COLUMN_TYPE_INTEGER, true
+	case "text":
+		return COLUMN_TYPE_TEXT, true
+	case "real":
+		return COLUMN_TYPE_REAL, true
+	case "blob":
+		return COLUMN_TYPE_BLOB, true
+	case "boolean", "bool":
+		return COLUMN_TYPE_BOOLEAN, true
+	}
+	return 0, false
+}
+
+func column_type_name(column_type int) string {
+	switch column_type {
+	case COLUMN_TYPE_INTEGER:
+		return "integer"
+	case COLUMN_TYPE_TEXT:
+		return "text"
+	case COLUMN_TYPE_REAL:
+		return "real"
+	case COLUMN_TYPE_BLOB:
+		return "blob"
+	}
+	return "boolean"
+}
+
+func column_index(schema *Schema, name string) (int, bool) {
+	for i, column := range schema.columns {
+		if column.name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// literal_value converts a literal to a value of the given column type.
+// REAL columns also take integers, and BOOLEAN columns true/false or 1/0.
+// NULL fits any column.
+func literal_value(column_type int, literal Token) (Value, bool) {
+	if literal.token_type == TOKEN_KEYWORD && literal.text == "null" {
+		return Value{value_type: COLUMN_TYPE_NULL}, true
+	}
+	value := Value{value_type: column_type}
+	switch column_type {
+	case COLUMN_TYPE_INTEGER:
+		if literal.token_type != TOKEN_INTEGER {
+			return value, false
+		}
+		integer, err := strconv.ParseInt(literal.text, 10, 64)
+		if err != nil {
+			return value, false
+		}
+		value.integer = integer
+	case COLUMN_TYPE_REAL:
+		if literal.token_type != TOKEN_INTEGER && literal.token_type != TOKEN_REAL {
+			return value, false
+		}
+		real, err := strconv.ParseFloat(literal.text, 64)
+		if err != nil {
+			return value, false
+		}
+		value.real = real
+	case COLUMN_TYPE_BOOLEAN:
+		switch {
+		case literal.token_type == TOKEN_KEYWORD && literal.text == "true",
+			literal.token_type == TOKEN_INTEGER && literal.text == "1":
+			value.integer = 1
+		case literal.token_type == TOKEN_KEYWORD && literal.text == "false",
+			literal.token_type == TOKEN_INTEGER && literal.text == "0":
+			value.integer = 0
+		default:
+			return value, false
+		}
+	case COLUMN_TYPE_TEXT:
+		if literal.token_type != TOKEN_STRING {
+			return value, false
+		}
+		value.text = literal.text
+	case COLUMN_TYPE_BLOB:
+		if literal.token_type != TOKEN_BLOB {
+			return value, false
+		}
+		value.text = literal.text
+	}
+	return value, true
+}
+
+// String formats a value the way the REPL prints it.
+func (value Value) String() string {
+	return format_value(value)
+}
+
+func format_value(value Value) string {
+	switch value.value_type {
+	case COLUMN_TYPE_NULL:
+		return "null"
+	case COLUMN_TYPE_INTEGER:
+		return strconv.FormatInt(value.integer, 10)
+	case COLUMN_TYPE_REAL:
+		text := strconv.FormatFloat(value.real, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".eIN") {
+			text += ".0"
+		}
+		return text
+	case COLUMN_TYPE_BOOLEAN:
+		if value.integer != 0 {
+			return "true"
+		}
+		return "false"
+	case COLUMN_TYPE_BLOB:
+		return "x'" + hex.EncodeToString([]byte(value.text)) + "'"
+	}
+	return value.text
+}
+
+// Records start with a bitmap with one bit per column, set if the value is
+// NULL, followed by the other values in column order. INTEGER and REAL take
+// 8 bytes, BOOLEAN 1 byte, and TEXT and BLOB a 2 byte length and their bytes.
+func null_bitmap_size(schema *Schema) int {
+	return (len(schema.columns) + 7) / 8
+}
+
+func record_size(schema *Schema, row *Row) uint32 {
+	size := uint32(null_bitmap_size(schema))
+	for i, column := range schema.columns {
+		if row.values[i].value_type == COLUMN_TYPE_NULL {
+			continue
+		}
+		switch column.column_type {
+		case COLUMN_TYPE_INTEGER, COLUMN_TYPE_REAL:
+			size += 8
+		case COLUMN_TYPE_BOOLEAN:
+			size += 1
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			size += 2 + uint32(len(row.values[i].text))
+		}
+	}
+	return size
+}
+
+// record_fits reports whether every TEXT and BLOB value of the row fits in
+// its 2 byte length.
+func record_fits(schema *Schema, row *Row) bool {
+	for i, column := range schema.columns {
+		if (column.column_type == COLUMN_TYPE_TEXT || column.column_type == COLUMN_TYPE_BLOB) && len(row.values[i].text) > MAX_VALUE_LENGTH {
+			return false
+		}
+	}
+	return true
+}
+
+func serialize_row(schema *Schema, source *Row, destination []byte) {
+	offset := null_bitmap_size(schema)
+	clear(destination[:offset])
+	for i, column := range schema.columns {
+		value := source.values[i]
+		if value.value_type == COLUMN_TYPE_NULL {
+			destination[i/8] |= 1 << (i % 8)
+			continue
+		}
+		switch column.column_type {
+		case COLUMN_TYPE_INTEGER:
+			binary.LittleEndian.PutUint64(destination[offset:], uint64(value.integer))
+			offset += 8
+		case COLUMN_TYPE_REAL:
+			binary.LittleEndian.PutUint64(destination[offset:], math.Float64bits(value.real))
+			offset += 8
+		case COLUMN_TYPE_BOOLEAN:
+			destination[offset] = byte(value.integer)
+			offset += 1
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			binary.LittleEndian.PutUint16(destination[offset:], uint16(len(value.text)))
+			offset += 2 + copy(destination[offset+2:], value.text)
+		}
+	}
+}
+
+// deserialize_row decodes a record read from a page. A record too short for
+// its schema means the page is corrupt.
+func deserialize_row(schema *Schema, source []byte, destination *Row) error {
+	destination.values = destination.values[:0]
+	offset := null_bitmap_size(schema)
+	if len(source) < offset {
+		return corrupt_error("record of %d bytes is too short", len(source))
+	}
+	for i, column := range schema.columns {
+		if source[i/8]&(1<<(i%8)) != 0 {
+			destination.values = append(destination.values, Value{value_type: COLUMN_TYPE_NULL})
+			continue
+		}
+		size := 8
+		switch column.column_type {
+		case COLUMN_TYPE_BOOLEAN:
+			size = 1
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			size = 2
+			if len(source) >= offset+2 {
+				size += int(binary.LittleEndian.Uint16(source[offset:]))
+			}
+		}
+		if len(source) < offset+size {
+			return corrupt_error("record of %d bytes is too short", len(source))
+		}
+		value := Value{value_type: column.column_type}
+		switch column.column_type {
+		case COLUMN_TYPE_INTEGER:
+			value.integer = int64(binary.LittleEndian.Uint64(source[offset:]))
+		case COLUMN_TYPE_REAL:
+			value.real = math.Float64frombits(binary.LittleEndian.Uint64(source[offset:]))
+		case COLUMN_TYPE_BOOLEAN:
+			value.integer = int64(source[offset])
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			value.text = string(source[offset+2 : offset+size])
+		}
+		offset += size
+		destination.values = append(destination.values, value)
+	}
+	return nil
+}
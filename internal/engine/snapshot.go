@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Many goroutines can read a database while one of them writes to it.
+//
+// The writer is whoever holds the write lock of the godb.DB. It alone uses
+// the pager's buffer pool, and a transaction belongs to the database as a
+// whole, not to the goroutine that began it.
+//
+// A select outside a transaction reads a snapshot instead: the database as
+// of the last commit before it started, whatever commits after that. In WAL
+// mode a snapshot is the log index of that commit, and the pages it names
+// are never written again until a checkpoint, which needs every reader gone.
+// A commit that finds readers leaves the checkpoint to a later one, until
+// the log holds WAL_CHECKPOINT_WAIT_FRAMES frames; then it keeps new readers
+// out and waits for those reading to finish. In rollback journal mode the
+// file itself is changed, so the writer keeps the readers out from its first
+// statement until it commits or rolls back.
+//
+// Readers share a pool of the page versions they have read, keyed by page
+// and log offset, so a version never changes once it is in the pool. A frame
+// is latched exclusively while it is read in, and a reader that finds it
+// waits on the latch.
+
+// Snapshot is the database as of one commit.
+type Snapshot struct {
+	num_pages uint32
+	// wal_index maps each page in the log to the offset of its newest
+	// committed frame.
+	wal_index map[uint32]int64
+	file_fd   int
+	wal_fd    int
+}
+
+// PageVersion names one version of a page: a frame of the log, or the page
+// in the database file when offset is 0.
+type PageVersion struct {
+	page_num uint32
+	offset   int64
+}
+
+// Readers is what the pager of the writer shares with the snapshots of it.
+type Readers struct {
+	// lock is held shared by every reader and exclusively to change the
+	// database file.
+	lock     sync.RWMutex
+	snapshot atomic.Pointer[Snapshot] // the last commit
+	pool     ReadPool
+}
+
+// ReadPool caches the page versions readers have read. Like the buffer pool
+// it evicts the least recently used unpinned frame, and grows past capacity
+// if every frame is pinned.
+type ReadPool struct {
+	mutex    sync.Mutex // guards frames, lru, pin counts and stats
+	capacity int
+	frames   map[PageVersion]*Frame
+	lru      *list.List // front is the most recently used frame
+	stats    PagerStats
+}
+
+func new_readers(capacity int) *Readers {
+	readers := &Readers{}
+	readers.pool.capacity = capacity
+	readers.pool.frames = make(map[PageVersion]*Frame)
+	readers.pool.lru = list.New()
+	return readers
+}
+
+// pager_publish makes the last commit the snapshot new readers take.
+func pager_publish(pager *Pager) {
+	snapshot := &Snapshot{num_pages: pager.num_pages, file_fd: pager.fileDescriptor, wal_fd: -1}
+	if pager.wal != nil {
+		snapshot.wal_index = maps.Clone(pager.wal.index)
+		snapshot.wal_fd = pager.wal.fileDescriptor
+	}
+	pager.readers.snapshot.Store(snapshot)
+}
+
+// pager_lock_file keeps readers out of the database file, waiting for those
+// reading it to finish. Their pool is emptied, since the versions it holds
+// may be about to change.
+func pager_lock_file(pager *Pager) {
+	if pager.file_locked {
+		return
+	}
+	pager.readers.lock.Lock()
+	pager.file_locked = true
+	pool_clear(&pager.readers.pool)
+}
+
+// pager_unlock_file publishes the last commit and lets readers back in.
+func pager_unlock_file(pager *Pager) {
+	if !pager.file_locked {
+		return
+	}
+	pager_publish(pager)
+	pager.file_locked = false
+	pager.readers.lock.Unlock()
+}
+
+// pager_begin_write is called before the writer runs a statement. In
+// rollback journal mode it keeps readers out until the transaction ends.
+func pager_begin_write(pager *Pager) {
+	if pager.journal != nil {
+		pager_lock_file(pager)
+	}
+}
+
+// pager_end_write is called once a statement outside a transaction has
+// committed or rolled back.
+func pager_end_write(pager *Pager) {
+	pager_unlock_file(pager)
+}
+
+// WAL_CHECKPOINT_WAIT_FRAMES is how long the log may grow while readers
+// keep a checkpoint from starting.
+const WAL_CHECKPOINT_WAIT_FRAMES = 2 * WAL_CHECKPOINT_FRAMES
+
+// pager_checkpoint checkpoints the log unless readers are using it and it is
+// not too long yet.
+func pager_checkpoint(pager *Pager) error {
+	if !pager.file_locked {
+		if pager.wal.num_frames >= WAL_CHECKPOINT_WAIT_FRAMES {
+			pager.readers.lock.Lock()
+		} else if !pager.readers.lock.TryLock() {
+			return nil
+		}
+		pager.file_locked = true
+		pool_clear(&pager.readers.pool)
+		defer pager_unlock_file(pager)
+	}
+	return wal_checkpoint(pager)
+}
+
+// snapshot_open takes a snapshot of the last commit and reads its catalog.
+// The snapshot has to be closed.
+func snapshot_open(db *Database) (*Database, error) {
+	readers := db.pager.readers
+	readers.lock.RLock()
+	pager := &Pager{readers: readers, snapshot: readers.snapshot.Load()}
+	snapshot := &Database{
+		pager:       pager,
+		catalog:     &Table{pager: pager, root_page_num: CATALOG_ROOT_PAGE_NUM, schema: catalog_schema},
+		sort_memory: db.sort_memory,
+	}
+	if err := catalog_load(snapshot); err != nil {
+		snapshot_close(snapshot)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func snapshot_close(db *Database) {
+	pager_end_operation(db.pager)
+	db.pager.readers.lock.RUnlock()
+}
+
+// execute_snapshot runs a select against a snapshot. There is nothing to
+// commit or roll back.
+func execute_snapshot(statement *Statement, db *Database) (int, error) {
+	statement.rows = nil
+	statement.rows_affected = 0
+	result, err := execute_select(statement, db)
+	pager_end_operation(db.pager)
+	if err != nil {
+		statement.rows = nil
+	}
+	return result, err
+}
+
+// snapshot_get_page fetches the version of a page in the snapshot through
+// the read pool. The page must not be modified.
+func snapshot_get_page(pager *Pager, page_num uint32) (*[]byte, error) {
+	snapshot := pager.snapshot
+	if page_num >= snapshot.num_pages {
+		return nil, fmt.Errorf("%w: page %d of %d", ErrPageOutOfRange, page_num, snapshot.num_pages)
+	}
+	version := PageVersion{page_num: page_num, offset: snapshot.wal_index[page_num]}
+
+	pool := &pager.readers.pool
+	pool.mutex.Lock()
+	frame, cached := pool.frames[version]
+	if cached {
+		pool.stats.cache_hits++
+		pool.lru.MoveToFront(frame.element)
+	} else {
+		pool.stats.cache_misses++
+		pool.stats.pages_read++
+		if len(pool.frames) >= pool.capacity {
+			pool_evict(pool)
+		}
+		frame = &Frame{page_num: page_num, data: make([]byte, PAGE_SIZE), version: version}
+		frame.latch.Lock()
+		frame.element = pool.lru.PushFront(frame)
+		pool.frames[version] = frame
+	}
+	frame.pin_count++
+	pool.mutex.Unlock()
+	pager.operation_frames = append(pager.operation_frames, frame)
+
+	if cached {
+		frame.latch.RLock()
+		err := frame.err
+		frame.latch.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		return &frame.data, nil
+	}
+
+	// A page past the end of the file reads as zeros.
+	var err error
+	if version.offset != 0 {
+		if _, read_err := syscall.Pread(snapshot.wal_fd, frame.data, version.offset+WAL_FRAME_HEADER_SIZE); read_err != nil {
+			err = io_error("reading wal file", read_err)
+		}
+	} else if _, read_err := syscall.Pread(snapshot.file_fd, frame.data, int64(page_num)*PAGE_SIZE); read_err != nil {
+		err = io_error("reading file", read_err)
+	}
+	if err != nil {
+		// The frame is dropped so that the next reader tries again.
+		frame.err = err
+		pool.mutex.Lock()
+		if pool.frames[version] == frame {
+			pool.lru.Remove(frame.element)
+			delete(pool.frames, version)
+		}
+		pool.mutex.Unlock()
+	}
+	frame.latch.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &frame.data, nil
+}
+
+// snapshot_end_operation releases the pins a reader took since the previous
+// call.
+func snapshot_end_operation(pager *Pager) {
+	pool := &pager.readers.pool
+	pool.mutex.Lock()
+	for _, frame := range pager.operation_frames {
+		frame.pin_count--
+	}
+	for len(pool.frames) > pool.capacity && pool_evict(pool) {
+	}
+	pool.mutex.Unlock()
+	pager.operation_frames = pager.operation_frames[:0]
+}
+
+// pool_evict drops the least recently used unpinned frame of the read pool.
+// Its mutex must be held.
+func pool_evict(pool *ReadPool) bool {
+	for element := pool.lru.Back(); element != nil; element = element.Prev() {
+		frame := element.Value.(*Frame)
+		if frame.pin_count > 0 {
+			continue
+		}
+		pool.lru.Remove(element)
+		delete(pool.frames, frame.version)
+		pool.stats.evictions++
+		return true
+	}
+	return false
+}
+
+// pool_clear empties the read pool. No reader may be using it.
+func pool_clear(pool *ReadPool) {
+	pool.mutex.Lock()
+	clear(pool.frames)
+	pool.lru.Init()
+	pool.mutex.Unlock()
+}
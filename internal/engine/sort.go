@@ -0,0 +1,347 @@
+package engine
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// DEFAULT_SORT_MEMORY is how many bytes of rows a sort holds in memory before
+// it spills them to a temporary file (4 MB).
+const DEFAULT_SORT_MEMORY = 4 << 20
+
+// SORT_MAX_RUNS is how many runs are merged at once. A sort that spills
+// more than that merges its runs into one as it goes, so that it never holds
+// too many files open.
+const SORT_MAX_RUNS = 64
+
+// SORT_ROW_OVERHEAD is what a sorted row costs on top of its text and blob
+// bytes, counted per value.
+const SORT_ROW_OVERHEAD = 40
+
+// Ordering is one "expression [asc|desc]" of an order by.
+type Ordering struct {
+	expression *Expression
+	descending bool
+}
+
+// Sorter is an external merge sort. Rows are values whose first
+// len(ordering) entries are the sort keys. They are gathered in memory, and
+// whenever they outgrow memory_limit they are sorted and written to a
+// temporary file as a run. Reading merges the runs with what is left in
+// memory. Rows with equal keys come out in the order they were added.
+type Sorter struct {
+	ordering     []Ordering
+	memory_limit int
+	rows         [][]Value
+	memory       int
+	runs         []*os.File
+
+	merge *SortMerge
+}
+
+func new_sorter(ordering []Ordering, memory_limit int) *Sorter {
+	return &Sorter{ordering: ordering, memory_limit: memory_limit}
+}
+
+// compare_sort_keys orders two rows by the sort keys. NULL comes before any
+// other value.
+func compare_sort_keys(ordering []Ordering, a []Value, b []Value) int {
+	for i, order := range ordering {
+		a_null := a[i].value_type == COLUMN_TYPE_NULL
+		b_null := b[i].value_type == COLUMN_TYPE_NULL
+		result := 0
+		switch {
+		case a_null && b_null:
+		case a_null:
+			result = -1
+		case b_null:
+			result = 1
+		default:
+			result = compare_values(a[i], b[i])
+		}
+		if order.descending {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+func sort_row_memory(values []Value) int {
+	size := 0
+	for _, value := range values {
+		size += SORT_ROW_OVERHEAD + len(value.text)
+	}
+	return size
+}
+
+func sorter_add(sorter *Sorter, values []Value) error {
+	sorter.rows = append(sorter.rows, values)
+	sorter.memory += sort_row_memory(values)
+	if sorter.memory > sorter.memory_limit {
+		return sorter_spill(sorter)
+	}
+	return nil
+}
+
+func sorter_sort_rows(sorter *Sorter) {
+	sort.SliceStable(sorter.rows, func(i, j int) bool {
+		return compare_sort_keys(sorter.ordering, sorter.rows[i], sorter.rows[j]) < 0
+	})
+}
+
+// sorter_spill writes the rows in memory to a new run. Once there are
+// SORT_MAX_RUNS runs they are merged into one.
+func sorter_spill(sorter *Sorter) error {
+	sorter_sort_rows(sorter)
+	rows := sorter.rows
+	err := sorter_write_run(sorter, func() ([]Value, error) {
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, nil
+	})
+	if err != nil {
+		return err
+	}
+	sorter.rows = nil
+	sorter.memory = 0
+	if len(sorter.runs) >= SORT_MAX_RUNS {
+		return sorter_merge_runs(sorter)
+	}
+	return nil
+}
+
+// sorter_merge_runs replaces the runs with a single run of their rows.
+func sorter_merge_runs(sorter *Sorter) error {
+	sources := make([]*SortSource, 0, len(sorter.runs))
+	for i, run := range sorter.runs {
+		sources = append(sources, &SortSource{reader: bufio.NewReader(run), index: i})
+	}
+	merge, err := sort_merge_open(sorter.ordering, sources)
+	if err != nil {
+		return err
+	}
+	if err := sorter_write_run(sorter, func() ([]Value, error) { return sort_merge_next(merge) }); err != nil {
+		return err
+	}
+	merged := len(sorter.runs) - 1
+	for _, run := range sorter.runs[:merged] {
+		run.Close()
+	}
+	sorter.runs = append(sorter.runs[:0], sorter.runs[merged])
+	return nil
+}
+
+// sorter_write_run writes the rows next returns, until it returns nil, to a
+// new run and adds it to the runs.
+func sorter_write_run(sorter *Sorter, next func() ([]Value, error)) error {
+	file, err := os.CreateTemp("", "godb-sort-*")
+	if err != nil {
+		return io_error("creating sort file", err)
+	}
+	// The file is only reached through its descriptor from now on, and
+	// sorter_close closes it even if writing it fails.
+	os.Remove(file.Name())
+	sorter.runs = append(sorter.runs, file)
+
+	writer := bufio.NewWriter(file)
+	for {
+		values, err := next()
+		if err != nil {
+			return err
+		}
+		if values == nil {
+			break
+		}
+		if _, err := writer.Write(encode_sort_row(values)); err != nil {
+			return io_error("writing sort file", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return io_error("writing sort file", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return io_error("seeking sort file", err)
+	}
+	return nil
+}
+
+// Sort rows are written as a 4 byte length followed by the values, each a
+// type byte and then 8 bytes for numbers and booleans or a 4 byte length and
+// the bytes for text and blobs.
+func encode_sort_row(values []Value) []byte {
+	record := make([]byte, 4, 4+sort_row_memory(values))
+	for _, value := range values {
+		record = append(record, byte(value.value_type))
+		switch value.value_type {
+		case COLUMN_TYPE_INTEGER, COLUMN_TYPE_BOOLEAN:
+			record = binary.LittleEndian.AppendUint64(record, uint64(value.integer))
+		case COLUMN_TYPE_REAL:
+			record = binary.LittleEndian.AppendUint64(record, math.Float64bits(value.real))
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			record = binary.LittleEndian.AppendUint32(record, uint32(len(value.text)))
+			record = append(record, value.text...)
+		}
+	}
+	binary.LittleEndian.PutUint32(record, uint32(len(record)-4))
+	return record
+}
+
+func decode_sort_row(record []byte) []Value {
+	var values []Value
+	for offset := 0; offset < len(record); {
+		value := Value{value_type: int(record[offset])}
+		offset++
+		switch value.value_type {
+		case COLUMN_TYPE_INTEGER, COLUMN_TYPE_BOOLEAN:
+			value.integer = int64(binary.LittleEndian.Uint64(record[offset:]))
+			offset += 8
+		case COLUMN_TYPE_REAL:
+			value.real = math.Float64frombits(binary.LittleEndian.Uint64(record[offset:]))
+			offset += 8
+		case COLUMN_TYPE_TEXT, COLUMN_TYPE_BLOB:
+			length := int(binary.LittleEndian.Uint32(record[offset:]))
+			value.text = string(record[offset+4 : offset+4+length])
+			offset += 4 + length
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// SortSource is one sorted sequence being merged: a run on disk, or the rows
+// still in memory.
+type SortSource struct {
+	reader *bufio.Reader
+	rows   [][]Value
+	row    []Value
+	index  int // the order sources were created in, to keep equal rows stable
+}
+
+func sort_source_advance(source *SortSource) (bool, error) {
+	if source.reader == nil {
+		if len(source.rows) == 0 {
+			return false, nil
+		}
+		source.row, source.rows = source.rows[0], source.rows[1:]
+		return true, nil
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(source.reader, length[:]); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, io_error("reading sort file", err)
+	}
+	record := make([]byte, binary.LittleEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(source.reader, record); err != nil {
+		return false, io_error("reading sort file", err)
+	}
+	source.row = decode_sort_row(record)
+	return true, nil
+}
+
+// SortMerge is a heap of sources ordered by their current rows.
+type SortMerge struct {
+	ordering []Ordering
+	sources  []*SortSource
+}
+
+func (merge *SortMerge) Len() int { return len(merge.sources) }
+
+func (merge *SortMerge) Less(i, j int) bool {
+	a, b := merge.sources[i], merge.sources[j]
+	result := compare_sort_keys(merge.ordering, a.row, b.row)
+	if result != 0 {
+		return result < 0
+	}
+	return a.index < b.index
+}
+
+func (merge *SortMerge) Swap(i, j int) {
+	merge.sources[i], merge.sources[j] = merge.sources[j], merge.sources[i]
+}
+
+func (merge *SortMerge) Push(source any) {
+	merge.sources = append(merge.sources, source.(*SortSource))
+}
+
+func (merge *SortMerge) Pop() any {
+	last := merge.sources[len(merge.sources)-1]
+	merge.sources = merge.sources[:len(merge.sources)-1]
+	return last
+}
+
+// sort_merge_open starts merging the sources.
+func sort_merge_open(ordering []Ordering, sources []*SortSource) (*SortMerge, error) {
+	merge := &SortMerge{ordering: ordering}
+	for _, source := range sources {
+		ok, err := sort_source_advance(source)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			merge.sources = append(merge.sources, source)
+		}
+	}
+	heap.Init(merge)
+	return merge, nil
+}
+
+// sort_merge_next returns the smallest row of the sources, or nil once they
+// are all used up.
+func sort_merge_next(merge *SortMerge) ([]Value, error) {
+	if merge.Len() == 0 {
+		return nil, nil
+	}
+	source := merge.sources[0]
+	row := source.row
+	ok, err := sort_source_advance(source)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		heap.Fix(merge, 0)
+	} else {
+		heap.Pop(merge)
+	}
+	return row, nil
+}
+
+// sorter_next returns the rows in order, then nil. The first call ends the
+// input.
+func sorter_next(sorter *Sorter) ([]Value, error) {
+	if sorter.merge == nil {
+		sorter_sort_rows(sorter)
+		sources := make([]*SortSource, 0, len(sorter.runs)+1)
+		for i, run := range sorter.runs {
+			sources = append(sources, &SortSource{reader: bufio.NewReader(run), index: i})
+		}
+		sources = append(sources, &SortSource{rows: sorter.rows, index: len(sorter.runs)})
+		sorter.rows = nil
+		merge, err := sort_merge_open(sorter.ordering, sources)
+		if err != nil {
+			return nil, err
+		}
+		sorter.merge = merge
+	}
+	return sort_merge_next(sorter.merge)
+}
+
+// sorter_close deletes the runs.
+func sorter_close(sorter *Sorter) {
+	for _, run := range sorter.runs {
+		run.Close()
+	}
+	sorter.runs = nil
+}
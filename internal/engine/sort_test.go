@@ -0,0 +1,39 @@
+package engine
+
+import "testing"
+
+func Test_sort_merge_fan_in(t *testing.T) {
+	// Every row spills on its own, so the runs are merged several times.
+	sorter := new_sorter([]Ordering{{}}, 1)
+	defer sorter_close(sorter)
+	for i := 0; i < 5*SORT_MAX_RUNS; i++ {
+		values := []Value{{value_type: COLUMN_TYPE_INTEGER, integer: int64(i % 7)}, {value_type: COLUMN_TYPE_INTEGER, integer: int64(i)}}
+		if err := sorter_add(sorter, values); err != nil {
+			t.Fatal(err)
+		}
+		if len(sorter.runs) >= SORT_MAX_RUNS {
+			t.Fatalf("expected at most %d runs, got %d", SORT_MAX_RUNS-1, len(sorter.runs))
+		}
+	}
+
+	var previous []Value
+	count := 0
+	for {
+		values, err := sorter_next(sorter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values == nil {
+			break
+		}
+		if previous != nil && (values[0].integer < previous[0].integer ||
+			values[0].integer == previous[0].integer && values[1].integer < previous[1].integer) {
+			t.Fatalf("%v came after %v", values, previous)
+		}
+		previous = values
+		count++
+	}
+	if count != 5*SORT_MAX_RUNS {
+		t.Errorf("expected %d rows, got %d", 5*SORT_MAX_RUNS, count)
+	}
+}
@@ -0,0 +1,767 @@
+package engine
+
+import (
+	"math"
+	"slices"
+	"strconv"
+)
+
+const (
+	PREPARE_SUCCESS = iota
+	PREPARE_NEGATIVE_ID
+	PREPARE_STRING_TOO_LONG
+	PREPARE_SYNTAX_ERROR
+	PREPARE_UNRECOGNIZED_STATEMENT
+	PREPARE_UNRECOGNIZED_TABLE
+	PREPARE_UNRECOGNIZED_COLUMN
+	PREPARE_ID_NOT_UPDATABLE
+	PREPARE_TYPE_MISMATCH
+	PREPARE_UNRECOGNIZED_TYPE
+	PREPARE_INVALID_KEY_COLUMN
+	PREPARE_READ_ONLY_TABLE
+	PREPARE_UNRECOGNIZED_FUNCTION
+	PREPARE_MISUSED_AGGREGATE
+	PREPARE_NOT_GROUPED
+	PREPARE_AMBIGUOUS_COLUMN
+)
+
+const (
+	STATEMENT_INSERT = 0
+	STATEMENT_SELECT = 1
+	STATEMENT_DELETE = 2
+	STATEMENT_UPDATE = 3
+	STATEMENT_BEGIN = 4
+	STATEMENT_COMMIT = 5
+	STATEMENT_ROLLBACK = 6
+	STATEMENT_CREATE_TABLE = 7
+	STATEMENT_CREATE_INDEX = 8
+)
+
+const (
+	EXECUTE_SUCCESS = iota
+	EXECUTE_TABLE_FULL
+	EXECUTE_DUPLICATE_KEY
+	EXECUTE_TRANSACTION_ACTIVE
+	EXECUTE_NO_TRANSACTION
+	EXECUTE_TABLE_EXISTS
+	EXECUTE_ROW_TOO_LARGE
+	EXECUTE_INDEX_EXISTS
+)
+
+type Statement struct {
+	statement_type int
+	row_to_insert Row
+	where Predicate
+	assignments []Assignment
+	table *Table
+	schema *Schema // the table a create table statement defines
+	index *Index // the index a create index statement defines
+	syntax_error *SyntaxError
+	projection []*Expression
+	ordering []Ordering
+	limit int64
+	offset int64
+	grouped bool // the select has group by, having or aggregates
+	group_by []*Expression
+	having *Expression
+	aggregates []*Expression
+	scope *Scope // the tables a select, update or delete reads
+	joins []*Join
+	explain bool
+	columns []string // the names of the values a select returns
+	rows [][]Value // the rows the last execution returned
+	rows_affected int64 // the rows the last insert, update or delete changed
+}
+
+// Assignment is one "column = value" pair of an update statement.
+type Assignment struct {
+	column int
+	value  Value
+}
+
+func NewStatement() *Statement {
+	return &Statement{}
+}
+
+// prepare_table looks up the table a statement targets. Only select may name
+// the catalog.
+func prepare_table(db *Database, name string, statement *Statement) int {
+	table, ok := find_table(db, name)
+	if !ok {
+		return PREPARE_UNRECOGNIZED_TABLE
+	}
+	if table == db.catalog && statement.statement_type != STATEMENT_SELECT {
+		return PREPARE_READ_ONLY_TABLE
+	}
+	statement.table = table
+	return PREPARE_SUCCESS
+}
+
+// prepare_insert checks the values of an insert against the table, one
+// value per column.
+func prepare_insert(ast *Ast, statement *Statement, db *Database) int {
+	if result := prepare_table(db, ast.table.text, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	schema := statement.table.schema
+	if len(ast.values) != len(schema.columns) {
+		return PREPARE_SYNTAX_ERROR
+	}
+
+	statement.row_to_insert.values = nil
+	for i, column := range schema.columns {
+		value, ok := literal_value(column.column_type, ast.values[i])
+		if !ok {
+			return PREPARE_TYPE_MISMATCH
+		}
+		statement.row_to_insert.values = append(statement.row_to_insert.values, value)
+	}
+
+	if statement.row_to_insert.values[KEY_COLUMN].value_type == COLUMN_TYPE_NULL {
+		return PREPARE_TYPE_MISMATCH
+	}
+	key := statement.row_to_insert.values[KEY_COLUMN].integer
+	if key < 0 {
+		return PREPARE_NEGATIVE_ID
+	}
+	if key > math.MaxUint32 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	if !record_fits(schema, &statement.row_to_insert) {
+		return PREPARE_STRING_TOO_LONG
+	}
+
+	return PREPARE_SUCCESS
+}
+
+// parse_create_table reads the schema back from a create table statement,
+// as stored in the catalog.
+func parse_create_table(sql string) (*Schema, int) {
+	ast, result, _ := parse_sql(sql)
+	if result != PREPARE_SUCCESS {
+		return nil, result
+	}
+	if ast.statement_type != STATEMENT_CREATE_TABLE {
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+	return build_schema(ast)
+}
+
+// build_schema makes the schema a create table defines. The first column is
+// the key and has to be an INTEGER.
+func build_schema(ast *Ast) (*Schema, int) {
+	schema := &Schema{name: ast.table.text}
+	if len(schema.name) == 0 || len(schema.name) > MAX_NAME_LENGTH {
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+
+	for _, definition := range ast.columns {
+		if len(definition.name.text) == 0 || len(definition.name.text) > MAX_NAME_LENGTH {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+		if _, exists := column_index(schema, definition.name.text); exists {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+		column_type, ok := column_type_from_name(definition.column_type.text)
+		if !ok {
+			return nil, PREPARE_UNRECOGNIZED_TYPE
+		}
+		schema.columns = append(schema.columns, Column{name: definition.name.text, column_type: column_type})
+	}
+
+	if schema.columns[KEY_COLUMN].column_type != COLUMN_TYPE_INTEGER {
+		return nil, PREPARE_INVALID_KEY_COLUMN
+	}
+	return schema, PREPARE_SUCCESS
+}
+
+func prepare_create_table(ast *Ast, statement *Statement) int {
+	schema, result := build_schema(ast)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	// The definition is kept in a catalog row, so it has to fit in one.
+	if !record_fits(catalog_schema, catalog_row(0, schema, 0)) {
+		return PREPARE_STRING_TOO_LONG
+	}
+
+	statement.schema = schema
+	return PREPARE_SUCCESS
+}
+
+// prepare_create_index checks the column a create index is on. An index
+// without a name is named after its table and column.
+func prepare_create_index(ast *Ast, statement *Statement, db *Database) int {
+	if result := prepare_table(db, ast.table.text, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	column, ok := column_index(statement.table.schema, ast.column.text)
+	if !ok {
+		return PREPARE_UNRECOGNIZED_COLUMN
+	}
+
+	name := ast.index.text
+	if name == "" {
+		name = statement.table.schema.name + "_" + ast.column.text + "_index"
+	}
+	if len(name) > MAX_NAME_LENGTH {
+		return PREPARE_SYNTAX_ERROR
+	}
+	statement.index = &Index{name: name, table: statement.table, column: column}
+	if !record_fits(catalog_schema, catalog_index_row(0, statement.index)) {
+		return PREPARE_STRING_TOO_LONG
+	}
+	return PREPARE_SUCCESS
+}
+
+// prepare_select resolves the projection, where clause and order by against
+// the tables of the select and plans its joins. "*" projects every column of
+// every table in order.
+func prepare_select(ast *Ast, statement *Statement, db *Database) int {
+	if result := prepare_table(db, ast.table.text, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	if result := prepare_joins(ast, statement, db); result != PREPARE_SUCCESS {
+		return result
+	}
+	scope := statement.scope
+	statement.explain = ast.explain
+
+	// Grouping rewrites the projection, so it gets a copy.
+	statement.projection = slices.Clone(ast.projection)
+	statement.columns = ast.names
+	if statement.projection == nil {
+		statement.columns = nil
+		for column := 0; column < scope.width; column++ {
+			statement.columns = append(statement.columns, scope_column_name(scope, column))
+			statement.projection = append(statement.projection, &Expression{
+				expression_type: EXPRESSION_COLUMN,
+				column:          column,
+				value_type:      scope_column_type(scope, column),
+			})
+		}
+	} else {
+		for _, expression := range statement.projection {
+			if result := prepare_expression(expression, scope); result != PREPARE_SUCCESS {
+				return result
+			}
+		}
+	}
+
+	statement.ordering = nil
+	for _, ordering := range ast.order_by {
+		if result := prepare_expression(ordering.expression, scope); result != PREPARE_SUCCESS {
+			return result
+		}
+		statement.ordering = append(statement.ordering, Ordering{expression: ordering.expression, descending: ordering.descending})
+	}
+
+	if result := prepare_grouping(ast, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+
+	statement.limit, statement.offset = math.MaxInt64, 0
+	if ast.limit != nil {
+		statement.limit = parse_count_value(*ast.limit)
+	}
+	if ast.offset != nil {
+		statement.offset = parse_count_value(*ast.offset)
+	}
+
+	if result := prepare_where(ast.where, &statement.where, scope); result != PREPARE_SUCCESS {
+		return result
+	}
+	if statement.explain {
+		statement.columns = []string{"plan"}
+	}
+	return PREPARE_SUCCESS
+}
+
+// parse_count_value reads a limit or offset. Counts too large for 64 bits are
+// as good as no limit.
+func parse_count_value(count Token) int64 {
+	value, err := strconv.ParseInt(count.text, 10, 64)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return value
+}
+
+func prepare_delete(ast *Ast, statement *Statement, db *Database) int {
+	if result := prepare_table(db, ast.table.text, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+
+	statement.scope = new_scope(statement.table, ast.table.text)
+	return prepare_where(ast.where, &statement.where, statement.scope)
+}
+
+func prepare_update(ast *Ast, statement *Statement, db *Database) int {
+	if result := prepare_table(db, ast.table.text, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	schema := statement.table.schema
+
+	statement.assignments = nil
+	for _, assignment := range ast.assignments {
+		column, ok := column_index(schema, assignment.column.text)
+		if !ok {
+			return PREPARE_UNRECOGNIZED_COLUMN
+		}
+		if column == KEY_COLUMN {
+			return PREPARE_ID_NOT_UPDATABLE
+		}
+		value, ok := literal_value(schema.columns[column].column_type, assignment.value)
+		if !ok {
+			return PREPARE_TYPE_MISMATCH
+		}
+		statement.assignments = append(statement.assignments, Assignment{column: column, value: value})
+	}
+
+	statement.scope = new_scope(statement.table, ast.table.text)
+	return prepare_where(ast.where, &statement.where, statement.scope)
+}
+
+// prepare_statement parses the input and checks it against the database.
+func prepare_statement(sql string, statement *Statement, db *Database) int {
+	ast, result, err := parse_sql(sql)
+	if result != PREPARE_SUCCESS {
+		statement.syntax_error = err
+		return result
+	}
+	// Parameters get their values from a compiled statement.
+	if ast.num_parameters > 0 {
+		parameter := ast_parameters(ast)[0].token
+		statement.syntax_error = &SyntaxError{line: parameter.line, column: parameter.column, message: "parameter " + parameter.text + " has no value"}
+		return PREPARE_SYNTAX_ERROR
+	}
+	return prepare_ast(ast, statement, db)
+}
+
+// prepare_ast checks a parsed statement against the database. It leaves the
+// Ast as it found it, so a compiled statement can be prepared again each
+// time it runs.
+func prepare_ast(ast *Ast, statement *Statement, db *Database) int {
+	statement.statement_type = ast.statement_type
+	switch ast.statement_type {
+	case STATEMENT_INSERT:
+		return prepare_insert(ast, statement, db)
+	case STATEMENT_SELECT:
+		return prepare_select(ast, statement, db)
+	case STATEMENT_DELETE:
+		return prepare_delete(ast, statement, db)
+	case STATEMENT_UPDATE:
+		return prepare_update(ast, statement, db)
+	case STATEMENT_CREATE_TABLE:
+		return prepare_create_table(ast, statement)
+	case STATEMENT_CREATE_INDEX:
+		return prepare_create_index(ast, statement, db)
+	}
+	return PREPARE_SUCCESS
+}
+
+// table_insert adds a row to the table and its indexes unless its key is
+// already taken.
+func table_insert(table *Table, row *Row) (int, error) {
+	key_to_insert := uint32(row.values[KEY_COLUMN].integer)
+	cursor, err := table_find(table, key_to_insert)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+
+	node, err := get_page(table.pager, cursor.page_num)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	num_cells := leaf_node_num_cells(*node)
+
+	if (cursor.cell_num < num_cells) {
+		key_at_index := leaf_node_key(*node, cursor.cell_num)
+		if (key_at_index == key_to_insert) {
+			return EXECUTE_DUPLICATE_KEY, nil;
+		}
+	}
+	if err := leaf_node_insert(cursor, key_to_insert, row); err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if err := index_add_row(table, row); err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+
+	return EXECUTE_SUCCESS, nil
+}
+
+func execute_insert(statement *Statement) (int, error) {
+	result, err := table_insert(statement.table, &statement.row_to_insert)
+	if result == EXECUTE_SUCCESS && err == nil {
+		statement.rows_affected = 1
+	}
+	return result, err
+}
+
+// ordered_by_key reports whether the rows a select reads are already sorted,
+// which is the case without an order by, or when it starts with the key
+// ascending and the rows are read in key order rather than through an index.
+func ordered_by_key(statement *Statement) bool {
+	ordering := statement.ordering
+	if len(ordering) == 0 {
+		return true
+	}
+	return statement.where.index == nil && is_key_column(ordering[0].expression) && !ordering[0].descending
+}
+
+func project_row(projection []*Expression, row *Row) []Value {
+	values := make([]Value, len(projection))
+	for i, expression := range projection {
+		values[i] = evaluate_expression(expression, row)
+	}
+	return values
+}
+
+// SelectOutput applies the order by, offset and limit of a select to the
+// rows it is given, and adds their projection to the rows of the statement.
+// Rows are added as they come unless they have to be sorted first.
+type SelectOutput struct {
+	statement *Statement
+	sorter    *Sorter
+	skip      int64
+	remaining int64
+	err       error // a sort that failed to spill, reported by select_output_finish
+}
+
+func select_output_start(statement *Statement, db *Database) *SelectOutput {
+	output := &SelectOutput{statement: statement, skip: statement.offset, remaining: statement.limit}
+	if statement.grouped || !ordered_by_key(statement) {
+		output.sorter = new_sorter(statement.ordering, db.sort_memory)
+	}
+	return output
+}
+
+// select_output_add takes the next row. It returns false once no more rows
+// are needed, or if the row could not be sorted.
+func select_output_add(output *SelectOutput, row *Row) bool {
+	statement := output.statement
+	if output.sorter == nil {
+		return select_output_emit(output, project_row(statement.projection, row))
+	}
+
+	// Each sorted row is its sort keys followed by its projected values.
+	values := make([]Value, 0, len(statement.ordering)+len(statement.projection))
+	for _, ordering := range statement.ordering {
+		values = append(values, evaluate_expression(ordering.expression, row))
+	}
+	values = append(values, project_row(statement.projection, row)...)
+	if err := sorter_add(output.sorter, values); err != nil {
+		output.err = err
+		return false
+	}
+	return true
+}
+
+func select_output_emit(output *SelectOutput, values []Value) bool {
+	if output.remaining <= 0 {
+		return false
+	}
+	if output.skip > 0 {
+		output.skip--
+		return true
+	}
+	output.statement.rows = append(output.statement.rows, values)
+	output.remaining--
+	return output.remaining > 0
+}
+
+// select_output_finish adds the sorted rows.
+func select_output_finish(output *SelectOutput) error {
+	if output.sorter == nil {
+		return nil
+	}
+	defer sorter_close(output.sorter)
+	if output.err != nil {
+		return output.err
+	}
+	for {
+		values, err := sorter_next(output.sorter)
+		if err != nil || values == nil {
+			return err
+		}
+		if !select_output_emit(output, values[len(output.statement.ordering):]) {
+			return nil
+		}
+	}
+}
+
+// select_scan passes the rows a select reads, joined and filtered by its
+// where clause, to visit in key order until visit returns false.
+func select_scan(statement *Statement, visit func(row *Row) bool) error {
+	if statement.joins != nil {
+		return join_scan(statement, visit)
+	}
+
+	table := statement.table
+	cursor, err := predicate_start(table, &statement.where)
+	if err != nil {
+		return err
+	}
+	var row Row
+	for {
+		found, err := predicate_find(cursor, &statement.where, &row)
+		if err != nil || !found || !visit(&row) {
+			return err
+		}
+		if err := predicate_advance(cursor); err != nil {
+			return err
+		}
+		pager_end_operation(table.pager)
+	}
+}
+
+// execute_select collects the projected rows. When key order is the order
+// asked for, rows are taken as they are read and the scan stops at the
+// limit. An explain returns its plan instead, one line of text per row.
+// Joins are planned here rather than when the statement is prepared, since
+// the plan depends on the size of the tables.
+func execute_select(statement *Statement, db *Database) (int, error) {
+	if err := plan_joins(statement); err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if statement.explain {
+		for _, line := range explain_select(statement) {
+			statement.rows = append(statement.rows, []Value{{value_type: COLUMN_TYPE_TEXT, text: line}})
+		}
+		return EXECUTE_SUCCESS, nil
+	}
+
+	output := select_output_start(statement, db)
+	var err error
+	if statement.grouped {
+		err = execute_aggregate(statement, output)
+	} else {
+		err = select_scan(statement, func(row *Row) bool {
+			return select_output_add(output, row)
+		})
+	}
+	if finish_err := select_output_finish(output); err == nil {
+		err = finish_err
+	}
+
+	return EXECUTE_SUCCESS, err
+}
+
+func execute_delete(statement *Statement) (int, error) {
+	table := statement.table
+	where := &statement.where
+
+	// Collect the rows first; deleting restructures the tree under the cursor.
+	var keys []uint32
+	var rows []Row
+	cursor, err := predicate_start(table, where)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	for {
+		var row Row
+		found, err := predicate_find(cursor, where, &row)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if !found {
+			break
+		}
+		key, err := cursor_key(cursor)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		keys = append(keys, key)
+		rows = append(rows, row)
+		if err := predicate_advance(cursor); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		pager_end_operation(table.pager)
+	}
+
+	for i, key := range keys {
+		cursor, err := table_find(table, key)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if err := leaf_node_delete(cursor); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if err := index_remove_row(table, &rows[i]); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		pager_end_operation(table.pager)
+	}
+
+	statement.rows_affected = int64(len(keys))
+	return EXECUTE_SUCCESS, nil
+}
+
+// execute_update rewrites the matching rows. Keys never change, but a row
+// that grows may no longer fit in its leaf, so like execute_delete the rows
+// are collected before any of them is written.
+func execute_update(statement *Statement) (int, error) {
+	table := statement.table
+	where := &statement.where
+
+	var keys []uint32
+	var old_rows, rows []Row
+	cursor, err := predicate_start(table, where)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	for {
+		var row Row
+		found, err := predicate_find(cursor, where, &row)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if !found {
+			break
+		}
+		old_rows = append(old_rows, Row{values: slices.Clone(row.values)})
+		for _, assignment := range statement.assignments {
+			row.values[assignment.column] = assignment.value
+		}
+		if !record_fits(table.schema, &row) {
+			return EXECUTE_ROW_TOO_LARGE, nil
+		}
+		key, err := cursor_key(cursor)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		keys = append(keys, key)
+		rows = append(rows, row)
+		if err := predicate_advance(cursor); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		pager_end_operation(table.pager)
+	}
+
+	for i, key := range keys {
+		cursor, err := table_find(table, key)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if err := leaf_node_update(cursor, &rows[i]); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if err := index_update_row(table, &old_rows[i], &rows[i]); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		pager_end_operation(table.pager)
+	}
+
+	statement.rows_affected = int64(len(keys))
+	return EXECUTE_SUCCESS, nil
+}
+
+// execute_transaction starts or ends an explicit transaction. Outside of one
+// every statement commits on its own.
+func execute_transaction(statement *Statement, db *Database) (int, error) {
+	pager := db.pager
+	if statement.statement_type == STATEMENT_BEGIN {
+		if pager.in_transaction {
+			return EXECUTE_TRANSACTION_ACTIVE, nil
+		}
+		pager.in_transaction = true
+		return EXECUTE_SUCCESS, nil
+	}
+
+	if !pager.in_transaction {
+		return EXECUTE_NO_TRANSACTION, nil
+	}
+	pager.in_transaction = false
+	if statement.statement_type == STATEMENT_ROLLBACK {
+		return EXECUTE_SUCCESS, execute_rollback(db)
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+func execute_create_table(statement *Statement, db *Database) (int, error) {
+	if _, exists := find_table(db, statement.schema.name); exists {
+		return EXECUTE_TABLE_EXISTS, nil
+	}
+	if _, exists := find_index(db, statement.schema.name); exists {
+		return EXECUTE_INDEX_EXISTS, nil
+	}
+	_, err := catalog_create_table(db, statement.schema)
+	return EXECUTE_SUCCESS, err
+}
+
+// execute_create_index builds a new index from the rows already in its table.
+// Tables and indexes share one namespace.
+func execute_create_index(statement *Statement, db *Database) (int, error) {
+	if _, exists := find_index(db, statement.index.name); exists {
+		return EXECUTE_INDEX_EXISTS, nil
+	}
+	if _, exists := find_table(db, statement.index.name); exists {
+		return EXECUTE_TABLE_EXISTS, nil
+	}
+	index, err := catalog_create_index(db, statement.index)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	return EXECUTE_SUCCESS, index_build(index, db.sort_memory)
+}
+
+// execute_statement runs a prepared statement. A result other than
+// EXECUTE_SUCCESS is an outcome the statement expects, such as a duplicate
+// key; an error is a failure of the storage underneath it. Either one undoes
+// a statement that runs on its own, but only an error abandons an explicit
+// transaction, whose changes can no longer be trusted.
+func execute_statement(statement *Statement, db *Database) (int, error) {
+	pager_begin_write(db.pager)
+	statement.rows = nil
+	statement.rows_affected = 0
+	result := EXECUTE_SUCCESS
+	var err error
+	switch statement.statement_type {
+	case STATEMENT_INSERT:
+		result, err = execute_insert(statement)
+	case STATEMENT_SELECT:
+		result, err = execute_select(statement, db)
+	case STATEMENT_DELETE:
+		result, err = execute_delete(statement)
+	case STATEMENT_UPDATE:
+		result, err = execute_update(statement)
+	case STATEMENT_BEGIN, STATEMENT_COMMIT, STATEMENT_ROLLBACK:
+		result, err = execute_transaction(statement, db)
+	case STATEMENT_CREATE_TABLE:
+		result, err = execute_create_table(statement, db)
+	case STATEMENT_CREATE_INDEX:
+		result, err = execute_create_index(statement, db)
+	}
+	pager_end_operation(db.pager)
+	if err != nil {
+		db.pager.in_transaction = false
+	}
+	if !db.pager.in_transaction {
+		if err == nil && result == EXECUTE_SUCCESS {
+			err = pager_commit(db.pager)
+		}
+		// A statement that fails part way leaves nothing behind.
+		if err != nil || result != EXECUTE_SUCCESS {
+			if rollback_err := execute_rollback(db); err == nil {
+				err = rollback_err
+			}
+		}
+		pager_end_operation(db.pager)
+		pager_end_write(db.pager)
+	}
+	if err != nil {
+		statement.rows = nil
+		statement.rows_affected = 0
+	}
+	return result, err
+}
+
+// execute_rollback undoes everything since the last commit and reads the
+// catalog back.
+func execute_rollback(db *Database) error {
+	if err := pager_rollback(db.pager); err != nil {
+		return err
+	}
+	return catalog_load(db)
+}
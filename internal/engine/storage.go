@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+const (
+	PAGE_SIZE       = 4096
+)
+
+// Page 0 holds the database header; the catalog's root lives on page 1.
+const (
+	HEADER_MAGIC                 = "godb format 6\x00"
+	HEADER_MAGIC_SIZE            = 16
+	HEADER_MAGIC_OFFSET          = 0
+	HEADER_PAGE_SIZE_OFFSET      = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+	HEADER_FREELIST_TRUNK_OFFSET = HEADER_PAGE_SIZE_OFFSET + 4
+	HEADER_FREELIST_COUNT_OFFSET = HEADER_FREELIST_TRUNK_OFFSET + 4
+	HEADER_PAGE_NUM              = 0
+)
+
+// Row holds the values of a row in the column order of its table's schema.
+type Row struct {
+	values []Value
+}
+
+// Table is one B-tree of the database and the schema of its rows.
+type Table struct {
+	pager *Pager
+	root_page_num uint32
+	schema *Schema
+	indexes []*Index
+}
+
+// Journal modes select how a database keeps its changes atomic.
+const (
+	JOURNAL_MODE_WAL    = 0 // append changes to a write-ahead log
+	JOURNAL_MODE_DELETE = 1 // save original pages to a rollback journal
+)
+
+// Options configures how a database is opened.
+type Options struct {
+	CachePages  int // size of the buffer pool in pages
+	JournalMode int // JOURNAL_MODE_WAL or JOURNAL_MODE_DELETE
+	SortMemory  int // bytes a sort keeps in memory before spilling to disk
+}
+
+func default_options() Options {
+	return Options{CachePages: DEFAULT_CACHE_PAGES, JournalMode: JOURNAL_MODE_WAL, SortMemory: DEFAULT_SORT_MEMORY}
+}
+
+func db_open(filename string, options Options) (*Database, error) {
+	pager, err := pager_open(filename, options)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &Database{
+		pager:       pager,
+		catalog:     &Table{pager: pager, root_page_num: CATALOG_ROOT_PAGE_NUM, schema: catalog_schema},
+		sort_memory: options.SortMemory,
+	}
+
+	if err := db_load(db); err != nil {
+		pager_abandon(pager)
+		return nil, err
+	}
+	pager_publish(pager)
+	return db, nil
+}
+
+// db_load checks the header of the file, or writes one into a new file, and
+// reads the catalog.
+func db_load(db *Database) error {
+	pager := db.pager
+	if pager.num_pages == 0 {
+		if err := initialize_database(pager); err != nil {
+			return err
+		}
+		if err := pager_commit(pager); err != nil {
+			return err
+		}
+	} else {
+		header, err := get_page(pager, HEADER_PAGE_NUM)
+		if err != nil {
+			return err
+		}
+		if string((*header)[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+len(HEADER_MAGIC)]) != HEADER_MAGIC {
+			return corrupt_error("file is not a godb database")
+		}
+		if binary.LittleEndian.Uint32((*header)[HEADER_PAGE_SIZE_OFFSET:]) != PAGE_SIZE {
+			return corrupt_error("database was created with a different page size")
+		}
+	}
+	pager_end_operation(pager)
+	return catalog_load(db)
+}
+
+// initialize_database writes the header and an empty catalog into a new file.
+func initialize_database(pager *Pager) error {
+	// The file grows by the header and then the root of the catalog.
+	for pager.num_pages <= CATALOG_ROOT_PAGE_NUM {
+		if _, err := pager_grow(pager); err != nil {
+			return err
+		}
+	}
+	header, err := get_page_for_write(pager, HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	copy((*header)[HEADER_MAGIC_OFFSET:], HEADER_MAGIC)
+	binary.LittleEndian.PutUint32((*header)[HEADER_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+
+	root_node, err := get_page_for_write(pager, CATALOG_ROOT_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	initialize_leaf_node(*root_node)
+	set_node_root(*root_node, true)
+	return nil
+}
+
+// db_close writes everything to the file and closes it. If that fails the
+// files are closed anyway, and whatever log or journal is left behind is
+// recovered on the next open.
+func db_close(db *Database) error {
+	pager := db.pager
+	pager_lock_file(pager)
+
+	// A transaction left open is abandoned.
+	var err error
+	if pager.in_transaction {
+		pager.in_transaction = false
+		err = pager_rollback(pager)
+	}
+	if err == nil {
+		err = pager_commit(pager)
+	}
+	if err == nil && pager.wal != nil {
+		err = wal_checkpoint(pager)
+	}
+	pager.frames = nil
+	if err != nil {
+		pager_abandon(pager)
+		return err
+	}
+
+	if err := syscall.Close(pager.fileDescriptor); err != nil {
+		if pager.wal != nil {
+			syscall.Close(pager.wal.fileDescriptor)
+		}
+		return io_error("closing file", err)
+	}
+	if pager.wal != nil {
+		return wal_close(pager.wal)
+	}
+	return nil
+}
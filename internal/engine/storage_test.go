@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// runStatement compiles a statement and runs it as the writer, or against a
+// snapshot of the last commit.
+func runStatement(db *Database, sql string, snapshot bool) (*Statement, error) {
+	compiled, err := NewStatementCache(1).Compile(sql)
+	if err != nil {
+		return nil, err
+	}
+	return db.Execute(compiled, nil, snapshot)
+}
+
+// createWideDatabase creates a table whose 30 rows take 300 bytes each, so
+// that it spans several leaves under an internal root.
+func createWideDatabase(t *testing.T, filename string) {
+	t.Helper()
+	db, err := Open(filename, default_options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []string{"create table wide (id integer, body text)"}
+	for i := 1; i <= 30; i++ {
+		commands = append(commands, fmt.Sprintf("insert into wide values (%d, '%s')", i, strings.Repeat("x", 290)))
+	}
+	for _, sql := range commands {
+		if _, err := runStatement(db, sql, false); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_storage_errors(t *testing.T) {
+	dir := t.TempDir()
+	wide := filepath.Join(dir, "wide.db")
+	createWideDatabase(t, wide)
+
+	db, err := Open(wide, default_options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPageNum := db.tables[0].root_page_num
+	root, err := get_page(db.pager, rootPageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get_node_type(*root) != NODE_INTERNAL {
+		t.Fatal("expected the table to have an internal root")
+	}
+	firstLeaf := binary.LittleEndian.Uint32(internal_node_cell(*root, 0))
+	numPages := db.pager.num_pages
+	pager_end_operation(db.pager)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(wide)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pointers to pages past the end of the database are refused rather than
+	// read, by readers of a snapshot and by the writer. The page just past
+	// the end must not be taken for a new one.
+	for _, pointer := range []struct {
+		name   string
+		offset int64
+	}{
+		{"child", int64(rootPageNum)*PAGE_SIZE + int64(INTERNAL_NODE_HEADER_SIZE)},
+		{"next leaf", int64(firstLeaf)*PAGE_SIZE + int64(LEAF_NODE_NEXT_LEAF_OFFSET)},
+	} {
+		for _, target := range []uint32{numPages, numPages + 100} {
+			corrupted := filepath.Join(dir, fmt.Sprintf("%s_%d.db", strings.ReplaceAll(pointer.name, " ", "_"), target))
+			corruptedContents := append([]byte(nil), contents...)
+			binary.LittleEndian.PutUint32(corruptedContents[pointer.offset:], target)
+			if err := os.WriteFile(corrupted, corruptedContents, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := Open(corrupted, default_options())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, snapshot := range []bool{true, false} {
+				if _, err := runStatement(db, "select * from wide", snapshot); !errors.Is(err, ErrPageOutOfRange) {
+					t.Errorf("%s pointer to page %d, snapshot %v: expected ErrPageOutOfRange, got %v", pointer.name, target, snapshot, err)
+				}
+			}
+			if db.pager.num_pages != numPages {
+				t.Errorf("%s pointer to page %d: expected %d pages, got %d", pointer.name, target, numPages, db.pager.num_pages)
+			}
+			db.Close()
+		}
+	}
+
+	// A database file that can no longer be written fails with ErrIO.
+	options := default_options()
+	options.JournalMode = JOURNAL_MODE_DELETE
+	db, err = Open(wide, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly, err := syscall.Open(wide, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Dup3(readOnly, db.pager.fileDescriptor, 0); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(readOnly)
+	if _, err := runStatement(db, "insert into wide values (31, 'more')", false); !errors.Is(err, ErrIO) {
+		t.Errorf("expected ErrIO from writing a read-only file, got %v", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// vacuum rebuilds every table and index into a temporary database with
+// densely packed pages and no free list, then copies that image over the
+// original. The file is truncated to the new size at the next commit. If it
+// fails the original is left half overwritten, and the caller rolls it back.
+func vacuum(db *Database) error {
+	temp_file, err := os.CreateTemp("", "godb-vacuum-*")
+	if err != nil {
+		return io_error("creating vacuum file", err)
+	}
+	temp_filename := temp_file.Name()
+	temp_file.Close()
+	defer os.Remove(temp_filename)
+
+	// Every page of the copy is new, so a journal never has anything to save.
+	temp, err := db_open(temp_filename, Options{CachePages: db.pager.capacity, JournalMode: JOURNAL_MODE_DELETE})
+	if err != nil {
+		return err
+	}
+	// The copy is thrown away, so it is closed without committing.
+	defer func() {
+		syscall.Close(temp.pager.fileDescriptor)
+		journal_delete(temp.pager.journal)
+	}()
+
+	for _, table := range db.tables {
+		copy_table, err := catalog_create_table(temp, table.schema)
+		if err != nil {
+			return err
+		}
+		if err := build_packed_tree(copy_table, table); err != nil {
+			return err
+		}
+		pager_end_operation(db.pager)
+		pager_end_operation(temp.pager)
+		for _, index := range table.indexes {
+			copy_index, err := catalog_create_index(temp, &Index{name: index.name, table: copy_table, column: index.column})
+			if err != nil {
+				return err
+			}
+			if err := index_build(copy_index, db.sort_memory); err != nil {
+				return err
+			}
+			pager_end_operation(temp.pager)
+		}
+	}
+
+	pager := db.pager
+	for i := uint32(0); i < temp.pager.num_pages; i++ {
+		page, err := get_page_for_write(pager, i)
+		if err != nil {
+			return err
+		}
+		temp_page, err := get_page(temp.pager, i)
+		if err != nil {
+			return err
+		}
+		copy(*page, *temp_page)
+		pager_end_operation(pager)
+		pager_end_operation(temp.pager)
+	}
+	for i := temp.pager.num_pages; i < pager.num_pages; i++ {
+		if err := pager_drop(pager, i); err != nil {
+			return err
+		}
+	}
+	pager.num_pages = temp.pager.num_pages
+	return catalog_load(db)
+}
+
+// leaf_cell_sizes returns the space every cell of the table takes in a leaf,
+// in key order.
+func leaf_cell_sizes(table *Table) ([]uint32, error) {
+	var sizes []uint32
+	cursor, err := table_start(table)
+	if err != nil {
+		return nil, err
+	}
+	for !cursor.end_of_table {
+		node, err := get_page(table.pager, cursor.page_num)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, leaf_cell_space(leaf_node_cell(*node, cursor.cell_num)))
+		if err := cursor_advance(cursor); err != nil {
+			return nil, err
+		}
+		pager_end_operation(table.pager)
+	}
+	return sizes, nil
+}
+
+// build_packed_tree fills the empty destination table with every row of the
+// source, filling leaves and internal nodes as far as possible instead of
+// leaving the half-empty pages that inserts produce.
+func build_packed_tree(destination *Table, source *Table) error {
+	sizes, err := leaf_cell_sizes(source)
+	if err != nil {
+		return err
+	}
+	total := uint32(0)
+	for _, size := range sizes {
+		total += size
+	}
+	cursor, err := table_start(source)
+	if err != nil {
+		return err
+	}
+
+	if total <= LEAF_NODE_SPACE_FOR_CELLS {
+		root, err := get_page_for_write(destination.pager, destination.root_page_num)
+		if err != nil {
+			return err
+		}
+		return copy_cells(destination, *root, cursor, uint32(len(sizes)))
+	}
+
+	// Spread the rows evenly so that the last leaf is not left nearly empty.
+	var children []uint32
+	var keys []uint32
+	previous_page_num := uint32(0)
+	num_leaves := (total + LEAF_NODE_SPACE_FOR_CELLS - 1) / LEAF_NODE_SPACE_FOR_CELLS
+	target := total / num_leaves
+	for start := 0; start < len(sizes); {
+		count := 0
+		used := uint32(0)
+		for start+count < len(sizes) && used < target && used+sizes[start+count] <= LEAF_NODE_SPACE_FOR_CELLS {
+			used += sizes[start+count]
+			count++
+		}
+		start += count
+
+		page_num, err := get_unused_page_num(destination.pager)
+		if err != nil {
+			return err
+		}
+		leaf, err := get_page_for_write(destination.pager, page_num)
+		if err != nil {
+			return err
+		}
+		initialize_leaf_node(*leaf)
+		if err := copy_cells(destination, *leaf, cursor, uint32(count)); err != nil {
+			return err
+		}
+		if previous_page_num != 0 {
+			previous, err := get_page_for_write(destination.pager, previous_page_num)
+			if err != nil {
+				return err
+			}
+			set_leaf_node_next_leaf(*previous, page_num)
+		}
+		previous_page_num = page_num
+
+		children = append(children, page_num)
+		keys = append(keys, leaf_node_key(*leaf, uint32(count-1)))
+
+		pager_end_operation(source.pager)
+		pager_end_operation(destination.pager)
+	}
+
+	// Add levels of internal nodes until the children fit under the root.
+	for uint32(len(children)) > INTERNAL_NODE_MAX_CELLS+1 {
+		num_children := uint32(len(children))
+		num_nodes := (num_children + INTERNAL_NODE_MAX_CELLS) / (INTERNAL_NODE_MAX_CELLS + 1)
+
+		var parents []uint32
+		var parent_keys []uint32
+		start := uint32(0)
+		for i := uint32(0); i < num_nodes; i++ {
+			count := num_children / num_nodes
+			if i < num_children%num_nodes {
+				count++
+			}
+
+			page_num, err := get_unused_page_num(destination.pager)
+			if err != nil {
+				return err
+			}
+			node, err := get_page_for_write(destination.pager, page_num)
+			if err != nil {
+				return err
+			}
+			initialize_internal_node(*node)
+			if err := internal_node_fill(destination, page_num, children[start:start+count], keys[start:start+count]); err != nil {
+				return err
+			}
+			pager_end_operation(destination.pager)
+
+			parents = append(parents, page_num)
+			parent_keys = append(parent_keys, keys[start+count-1])
+			start += count
+		}
+		children = parents
+		keys = parent_keys
+	}
+
+	root, err := get_page_for_write(destination.pager, destination.root_page_num)
+	if err != nil {
+		return err
+	}
+	initialize_internal_node(*root)
+	set_node_root(*root, true)
+	return internal_node_fill(destination, destination.root_page_num, children, keys)
+}
+
+// copy_cells appends the next count cells under the cursor to an empty leaf of
+// the destination. Records that spilled get a new overflow chain there.
+func copy_cells(destination *Table, leaf []byte, cursor *Cursor, count uint32) error {
+	for i := uint32(0); i < count; i++ {
+		key, err := cursor_key(cursor)
+		if err != nil {
+			return err
+		}
+		value, err := cursor_value(cursor)
+		if err != nil {
+			return err
+		}
+		cell, err := leaf_cell_build(destination.pager, key, value)
+		if err != nil {
+			return err
+		}
+		leaf_node_insert_cell(leaf, i, cell)
+		if err := cursor_advance(cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"syscall"
+)
+
+// Changes reach the database file through a write-ahead log kept next to it.
+// Every statement appends the pages it modified to the log and fsyncs it
+// before reporting success, and the last frame of each commit records the size
+// of the database so a reader knows where the transaction ends:
+//
+//	header: magic (16 bytes) | page size (4 bytes) | salt (4 bytes)
+//	frame:  page number (4 bytes) | database size for a commit, else 0 (4 bytes) |
+//	        salt (4 bytes) | checksum (4 bytes) | page (PAGE_SIZE bytes)
+//
+// The checksum of each frame covers its header and page and is chained from
+// the checksum of the previous frame, so a torn or stale tail stops recovery at
+// the last intact commit. Once the log holds WAL_CHECKPOINT_FRAMES frames its
+// pages are copied into the database file and the log starts over, as soon
+// as no reader is using it.
+const (
+	WAL_MAGIC                   = "godb wal 1\x00"
+	WAL_MAGIC_SIZE              = 16
+	WAL_HEADER_PAGE_SIZE_OFFSET = WAL_MAGIC_SIZE
+	WAL_HEADER_SALT_OFFSET      = WAL_HEADER_PAGE_SIZE_OFFSET + 4
+	WAL_HEADER_SIZE             = WAL_HEADER_SALT_OFFSET + 4
+	WAL_FRAME_PAGE_NUM_OFFSET   = 0
+	WAL_FRAME_DB_SIZE_OFFSET    = WAL_FRAME_PAGE_NUM_OFFSET + 4
+	WAL_FRAME_SALT_OFFSET       = WAL_FRAME_DB_SIZE_OFFSET + 4
+	WAL_FRAME_CHECKSUM_OFFSET   = WAL_FRAME_SALT_OFFSET + 4
+	WAL_FRAME_HEADER_SIZE       = WAL_FRAME_CHECKSUM_OFFSET + 4
+	WAL_FRAME_SIZE              = WAL_FRAME_HEADER_SIZE + PAGE_SIZE
+	WAL_CHECKPOINT_FRAMES       = 1000
+)
+
+type Wal struct {
+	fileDescriptor int
+	filename       string
+	length         int64 // end of the last frame written
+	salt           uint32
+	checksum       uint32 // checksum of the last frame written
+	num_frames     uint32
+	// index maps a page to the offset of its newest frame in the log.
+	index map[uint32]int64
+	// uncommitted is set when pages were spilled to the log by eviction since
+	// the last commit.
+	uncommitted bool
+
+	// State as of the last commit, restored by a rollback. index_undo holds
+	// the offset each page had in the index before the first uncommitted
+	// frame replaced it, or -1 if it was not logged.
+	db_size         uint32
+	commit_length   int64
+	commit_checksum uint32
+	commit_frames   uint32
+	index_undo      map[uint32]int64
+}
+
+func wal_filename(filename string) string {
+	return filename + "-wal"
+}
+
+// wal_open opens the log of a database and replays every committed frame it
+// holds into the database file.
+func wal_open(pager *Pager, filename string) error {
+	fd, err := syscall.Open(wal_filename(filename), syscall.O_RDWR|syscall.O_CREAT, 0666)
+	if err != nil {
+		return io_error("opening wal file", err)
+	}
+
+	wal := &Wal{
+		fileDescriptor: fd,
+		filename:       wal_filename(filename),
+		index:          make(map[uint32]int64),
+		index_undo:     make(map[uint32]int64),
+	}
+	pager.wal = wal
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	n, _ := syscall.Pread(fd, header, 0)
+	if n < WAL_HEADER_SIZE || string(header[:len(WAL_MAGIC)]) != WAL_MAGIC ||
+		binary.LittleEndian.Uint32(header[WAL_HEADER_PAGE_SIZE_OFFSET:]) != PAGE_SIZE {
+		err = wal_reset(wal)
+	} else {
+		wal.salt = binary.LittleEndian.Uint32(header[WAL_HEADER_SALT_OFFSET:])
+		if wal_recover(pager) {
+			err = wal_checkpoint(pager)
+		} else {
+			err = wal_reset(wal)
+		}
+	}
+	wal.db_size = pager.num_pages
+	return err
+}
+
+// wal_recover reads frames until the first one that fails its checksum and
+// indexes those that belong to a complete commit. It returns false if the log
+// holds no committed frames.
+func wal_recover(pager *Pager) bool {
+	wal := pager.wal
+	frame := make([]byte, WAL_FRAME_SIZE)
+	pending := make(map[uint32]int64)
+	checksum := wal.salt
+	committed := false
+
+	for offset := int64(WAL_HEADER_SIZE); ; offset += WAL_FRAME_SIZE {
+		n, _ := syscall.Pread(wal.fileDescriptor, frame, offset)
+		if n < WAL_FRAME_SIZE {
+			break
+		}
+		if binary.LittleEndian.Uint32(frame[WAL_FRAME_SALT_OFFSET:]) != wal.salt {
+			break
+		}
+		checksum = wal_checksum(checksum, frame)
+		if binary.LittleEndian.Uint32(frame[WAL_FRAME_CHECKSUM_OFFSET:]) != checksum {
+			break
+		}
+
+		pending[binary.LittleEndian.Uint32(frame[WAL_FRAME_PAGE_NUM_OFFSET:])] = offset
+		if db_size := binary.LittleEndian.Uint32(frame[WAL_FRAME_DB_SIZE_OFFSET:]); db_size != 0 {
+			for page_num, frame_offset := range pending {
+				wal.index[page_num] = frame_offset
+			}
+			clear(pending)
+			pager.num_pages = db_size
+			wal.length = offset + WAL_FRAME_SIZE
+			wal.checksum = checksum
+			wal.num_frames = uint32((wal.length - WAL_HEADER_SIZE) / WAL_FRAME_SIZE)
+			committed = true
+		}
+	}
+
+	return committed
+}
+
+func wal_checksum(previous uint32, frame []byte) uint32 {
+	checksum := crc32.Update(previous, crc32.IEEETable, frame[:WAL_FRAME_CHECKSUM_OFFSET])
+	return crc32.Update(checksum, crc32.IEEETable, frame[WAL_FRAME_HEADER_SIZE:])
+}
+
+// wal_reset empties the log. The salt changes so that frames left over from
+// before the reset can never pass for new ones.
+func wal_reset(wal *Wal) error {
+	wal.salt++
+	header := make([]byte, WAL_HEADER_SIZE)
+	copy(header, WAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[WAL_HEADER_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+	binary.LittleEndian.PutUint32(header[WAL_HEADER_SALT_OFFSET:], wal.salt)
+
+	if err := syscall.Ftruncate(wal.fileDescriptor, WAL_HEADER_SIZE); err != nil {
+		return io_error("truncating wal file", err)
+	}
+	if _, err := syscall.Pwrite(wal.fileDescriptor, header, 0); err != nil {
+		return io_error("writing wal file", err)
+	}
+	if err := syscall.Fsync(wal.fileDescriptor); err != nil {
+		return io_error("syncing wal file", err)
+	}
+
+	wal.length = WAL_HEADER_SIZE
+	wal.checksum = wal.salt
+	wal.num_frames = 0
+	wal.uncommitted = false
+	clear(wal.index)
+	wal_mark_committed(wal)
+	return nil
+}
+
+// wal_mark_committed records the end of the log as the state a rollback
+// returns to.
+func wal_mark_committed(wal *Wal) {
+	wal.commit_length = wal.length
+	wal.commit_checksum = wal.checksum
+	wal.commit_frames = wal.num_frames
+	clear(wal.index_undo)
+}
+
+// wal_rollback forgets the frames written since the last commit.
+func wal_rollback(wal *Wal) error {
+	for page_num, offset := range wal.index_undo {
+		if offset < 0 {
+			delete(wal.index, page_num)
+		} else {
+			wal.index[page_num] = offset
+		}
+	}
+	if err := syscall.Ftruncate(wal.fileDescriptor, wal.commit_length); err != nil {
+		return io_error("truncating wal file", err)
+	}
+
+	wal.length = wal.commit_length
+	wal.checksum = wal.commit_checksum
+	wal.num_frames = wal.commit_frames
+	wal.uncommitted = false
+	clear(wal.index_undo)
+	return nil
+}
+
+// wal_append writes a page to the end of the log. A non-zero db_size marks
+// the frame as the last one of a commit.
+func wal_append(pager *Pager, page_num uint32, data []byte, db_size uint32) error {
+	wal := pager.wal
+	frame := make([]byte, WAL_FRAME_SIZE)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_PAGE_NUM_OFFSET:], page_num)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_DB_SIZE_OFFSET:], db_size)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_SALT_OFFSET:], wal.salt)
+	copy(frame[WAL_FRAME_HEADER_SIZE:], data)
+	checksum := wal_checksum(wal.checksum, frame)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_CHECKSUM_OFFSET:], checksum)
+
+	if _, err := syscall.Pwrite(wal.fileDescriptor, frame, wal.length); err != nil {
+		return io_error("writing wal file", err)
+	}
+	wal.checksum = checksum
+
+	if _, ok := wal.index_undo[page_num]; !ok {
+		offset, logged := wal.index[page_num]
+		if !logged {
+			offset = -1
+		}
+		wal.index_undo[page_num] = offset
+	}
+	wal.index[page_num] = wal.length
+	wal.length += WAL_FRAME_SIZE
+	wal.num_frames++
+	pager.stats.wal_frames++
+	return nil
+}
+
+// wal_read fills data with the newest logged copy of a page, if there is one.
+func wal_read(wal *Wal, page_num uint32, data []byte) (bool, error) {
+	offset, ok := wal.index[page_num]
+	if !ok {
+		return false, nil
+	}
+	if _, err := syscall.Pread(wal.fileDescriptor, data, offset+WAL_FRAME_HEADER_SIZE); err != nil {
+		return false, io_error("reading wal file", err)
+	}
+	return true, nil
+}
+
+// wal_commit makes every change since the previous commit durable by logging
+// the modified pages and syncing the log.
+func wal_commit(pager *Pager) error {
+	wal := pager.wal
+
+	var dirty []uint32
+	for page_num, frame := range pager.frames {
+		if frame.dirty {
+			dirty = append(dirty, page_num)
+		}
+	}
+	if len(dirty) == 0 {
+		if !wal.uncommitted {
+			return nil
+		}
+		// Everything was spilled already; the header page closes the commit.
+		if _, err := get_page(pager, HEADER_PAGE_NUM); err != nil {
+			return err
+		}
+		dirty = append(dirty, HEADER_PAGE_NUM)
+	}
+	slices.Sort(dirty)
+
+	for i, page_num := range dirty {
+		db_size := uint32(0)
+		if i == len(dirty)-1 {
+			db_size = pager.num_pages
+		}
+		frame := pager.frames[page_num]
+		if err := wal_append(pager, page_num, frame.data, db_size); err != nil {
+			return err
+		}
+		frame.dirty = false
+	}
+	if err := syscall.Fsync(wal.fileDescriptor); err != nil {
+		return io_error("syncing wal file", err)
+	}
+	wal.uncommitted = false
+	wal.db_size = pager.num_pages
+	wal_mark_committed(wal)
+	pager_publish(pager)
+
+	if wal.num_frames >= WAL_CHECKPOINT_FRAMES {
+		return pager_checkpoint(pager)
+	}
+	return nil
+}
+
+// wal_checkpoint copies the newest version of every logged page into the
+// database file, syncs it and empties the log. The log must not hold
+// uncommitted frames.
+func wal_checkpoint(pager *Pager) error {
+	wal := pager.wal
+
+	var pages []uint32
+	for page_num := range wal.index {
+		if page_num < pager.num_pages {
+			pages = append(pages, page_num)
+		}
+	}
+	slices.Sort(pages)
+
+	data := make([]byte, PAGE_SIZE)
+	for _, page_num := range pages {
+		if _, err := wal_read(wal, page_num, data); err != nil {
+			return err
+		}
+		if err := pager_write(pager, page_num, data); err != nil {
+			return err
+		}
+	}
+
+	size := int64(pager.num_pages) * PAGE_SIZE
+	if pager.fileLength != size {
+		if err := syscall.Ftruncate(pager.fileDescriptor, size); err != nil {
+			return io_error("truncating file", err)
+		}
+		pager.fileLength = size
+	}
+	if err := syscall.Fsync(pager.fileDescriptor); err != nil {
+		return io_error("syncing file", err)
+	}
+
+	return wal_reset(wal)
+}
+
+func wal_close(wal *Wal) error {
+	if err := syscall.Close(wal.fileDescriptor); err != nil {
+		return io_error("closing wal file", err)
+	}
+	if err := syscall.Unlink(wal.filename); err != nil {
+		return io_error("removing wal file", err)
+	}
+	return nil
+}
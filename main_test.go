@@ -1,90 +1,1976 @@
-package main
+package godb
 
 import (
 	"bufio"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorogoroumaru/godb/internal/engine"
 )
 
-func runCommandInput(command string, args ...string) (string, error) {
-	cmd := exec.Command(command, args...)
-	stdin, _ := cmd.StdinPipe()
-	stdout, _ := cmd.StdoutPipe()
+var godbBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "godb-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	reader := bufio.NewReader(stdout)
+	godbBinary = filepath.Join(dir, "godb")
+	build := exec.Command("go", "build", "-o", godbBinary, "./cmd/godb")
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Println(err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
 
-	cmd.Start()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
 
-	for i := 1; i <= 14; i++ {
-		input := fmt.Sprintf("insert %d user%d person%d@example.com\n", i, i, i)
-		stdin.Write([]byte(input))
-		time.Sleep(100 * time.Microsecond)
+// runScript feeds the commands to a fresh godb process and returns its output split into lines.
+func runScript(t *testing.T, filename string, commands []string, args ...string) []string {
+	t.Helper()
 
-		reader.ReadString('\n')
-		reader.ReadString('\n')
-		reader.ReadString('\n')
+	cmd := exec.Command(godbBinary, append(args, filename)...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Error executing command: %v\n%s", err, output)
 	}
 
+	return strings.Split(string(output), "\n")
+}
 
-	stdin.Write([]byte(".btree\n"))
-	time.Sleep(100 * time.Microsecond)
-
-	var output []byte
+// createUsersTable creates the table the other helpers insert into.
+func createUsersTable(t *testing.T, filename string) {
+	t.Helper()
+	runScript(t, filename, []string{"create table users (id integer, username text, email text)"})
+}
 
-	for i := 0; i < 19; i++ {
-		time.Sleep(100 * time.Microsecond)
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			break
-		}
-		output = append(output, line...)
+func insertCommands(from int, to int) []string {
+	var commands []string
+	for i := from; i <= to; i++ {
+		commands = append(commands, fmt.Sprintf("insert into users values (%d, 'user%d', 'person%d@example.com')", i, i, i))
 	}
+	return commands
+}
 
-	stdin.Write([]byte(".exit\n"))
-	time.Sleep(100 * time.Microsecond)
+// createWideTable creates a table whose rows all take 300 bytes, so that 13 of
+// them fill a leaf.
+func createWideTable(t *testing.T, filename string) {
+	t.Helper()
+	runScript(t, filename, []string{"create table wide (id integer, body text)"})
+}
 
-	return string(output), nil
+func wideInsertCommands(from int, to int) []string {
+	var commands []string
+	for i := from; i <= to; i++ {
+		commands = append(commands, fmt.Sprintf("insert into wide values (%d, '%s')", i, strings.Repeat("x", 290)))
+	}
+	return commands
 }
 
 func Test_godb(t *testing.T) {
-	command := "./godb"
-	arg := "./my.db"
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createWideTable(t, filename)
 
-	output, err := runCommandInput(command, arg)
-	if err != nil {
-		t.Errorf("Error executing command: %v", err)
+	commands := append(wideInsertCommands(1, 14), ".btree wide")
+	output := runScript(t, filename, commands)
+
+	expected := []string{"db > Tree: ",
+		"- internal (size 1)",
+		"  - leaf (size 7)",
+		"    - 1",
+		"    - 2",
+		"    - 3",
+		"    - 4",
+		"    - 5",
+		"    - 6",
+		"    - 7",
+		"  - key 7",
+		"  - leaf (size 7)",
+		"    - 8",
+		"    - 9",
+		"    - 10",
+		"    - 11",
+		"    - 12",
+		"    - 13",
+		"    - 14"}
+
+	outputStr := output[2*14:]
+
+	for i := 0; i < len(expected); i++ {
+		if outputStr[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", outputStr[i], expected[i])
+		}
 	}
+}
+
+func Test_split_non_root_leaves(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createWideTable(t, filename)
+
+	commands := append(wideInsertCommands(1, 30), ".btree wide")
+	output := runScript(t, filename, commands)
 
 	expected := []string{"db > Tree: ",
-	    "- internal (size 1)",
-	    "  - leaf (size 7)",
-	    "    - 1",
+		"- internal (size 3)",
+		"  - leaf (size 7)",
+		"    - 1",
 		"    - 2",
 		"    - 3",
 		"    - 4",
 		"    - 5",
-	    "    - 6",
-	    "    - 7",
-	    "  - key 7",
-    	"  - leaf (size 7)",
-	    "    - 8",
-	    "    - 9",
-	    "    - 10",
-	    "    - 11",
-        "    - 12",
-	    "    - 13",
-	    "    - 14"}
-
-	outputStr := strings.Split(output, "\n")
+		"    - 6",
+		"    - 7",
+		"  - key 7",
+		"  - leaf (size 7)",
+		"    - 8",
+		"    - 9",
+		"    - 10",
+		"    - 11",
+		"    - 12",
+		"    - 13",
+		"    - 14",
+		"  - key 14",
+		"  - leaf (size 7)",
+		"    - 15",
+		"    - 16",
+		"    - 17",
+		"    - 18",
+		"    - 19",
+		"    - 20",
+		"    - 21",
+		"  - key 21",
+		"  - leaf (size 9)",
+		"    - 22",
+		"    - 23",
+		"    - 24",
+		"    - 25",
+		"    - 26",
+		"    - 27",
+		"    - 28",
+		"    - 29",
+		"    - 30",
+		"success"}
+
+	outputStr := output[2*30:]
 
 	for i := 0; i < len(expected); i++ {
 		if outputStr[i] != expected[i] {
-			t.Errorf("Output is not equal to expected: %v", err)
+			t.Errorf("Output is not equal to expected: %q != %q", outputStr[i], expected[i])
+		}
+	}
+}
+
+func Test_large_table_with_small_cache(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createWideTable(t, filename)
+
+	// Enough rows to split the root internal node, with a buffer pool far
+	// smaller than the file so pages are constantly evicted and reread.
+	var commands []string
+	for i := 0; i < 6000; i++ {
+		id := (i*2477)%6000 + 1
+		commands = append(commands, wideInsertCommands(id, id)...)
+	}
+	runScript(t, filename, commands, "-cache", "16")
+
+	output := runScript(t, filename, []string{".btree wide", "select * from wide"}, "-cache", "16")
+	if output[0] != "db > Tree: " || output[1] != "- internal (size 1)" || !strings.HasPrefix(output[2], "  - internal") {
+		t.Errorf("expected a three level tree, got %q", output[:3])
+	}
+
+	i := 0
+	for output[i] != "success" {
+		i++
+	}
+	rows := output[i+1:]
+	rows[0] = strings.TrimPrefix(rows[0], "db > ")
+	for id := 1; id <= 6000; id++ {
+		expected := fmt.Sprintf("(%d, %s)", id, strings.Repeat("x", 290))
+		if rows[id-1] != expected {
+			t.Fatalf("Output is not equal to expected: %q != %q", rows[id-1], expected)
+		}
+	}
+}
+
+func Test_select_across_leaves(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	// Insert out of order so that rows end up in several leaves.
+	var commands []string
+	for i := 0; i < 200; i++ {
+		id := (i*17)%200 + 1
+		commands = append(commands, fmt.Sprintf("insert into users values (%d, 'user%d', 'person%d@example.com')", id, id, id))
+	}
+	runScript(t, filename, commands)
+
+	output := runScript(t, filename, []string{"select * from users"})
+
+	if len(output) < 200 {
+		t.Fatalf("expected 200 rows, got %q", output)
+	}
+	for i := 1; i <= 200; i++ {
+		line := output[i-1]
+		if i == 1 {
+			line = strings.TrimPrefix(line, "db > ")
+		}
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", i, i, i)
+		if line != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", line, expected)
+		}
+	}
+}
+
+func Test_delete(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	commands := append(insertCommands(1, 60),
+		"delete from users where id between 10 and 50",
+		"delete from users where id = 3",
+		"delete from users where id > 58",
+		"delete from users where id < 2",
+		"select * from users")
+	output := runScript(t, filename, commands)
+
+	var remaining []int
+	for i := 2; i <= 58; i++ {
+		if i != 3 && (i < 10 || i > 50) {
+			remaining = append(remaining, i)
+		}
+	}
+
+	outputStr := output[2*64:]
+	outputStr[0] = strings.TrimPrefix(outputStr[0], "db > ")
+	for i, id := range remaining {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+		if outputStr[i] != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", outputStr[i], expected)
+		}
+	}
+	if outputStr[len(remaining)] != "Executed" {
+		t.Errorf("expected %d rows, got %q", len(remaining), outputStr)
+	}
+
+	// Deleting every row collapses the tree back into a single leaf.
+	output = runScript(t, filename, []string{"delete from users", ".btree users"})
+	expected := []string{"db > Executed", "execution finished", "db > Tree: ", "- leaf (size 0)", "success"}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_update(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	commands := append(insertCommands(1, 30),
+		"update users set email = 'new@example.com' where id = 7",
+		"update users set username = 'renamed' where id between 20 and 29",
+		"update users set email = 'moved@example.com' where username = 'renamed'",
+		"update users set id = 5",
+		"select * from users")
+	output := runScript(t, filename, commands)
+
+	outputStr := output[2*33:]
+	if outputStr[0] != "db > id cannot be updated" {
+		t.Errorf("expected the id update to be rejected, got %q", outputStr[0])
+	}
+	outputStr[1] = strings.TrimPrefix(outputStr[1], "db > ")
+	for id := 1; id <= 30; id++ {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+		if id == 7 {
+			expected = "(7, user7, new@example.com)"
+		} else if id >= 20 && id <= 29 {
+			expected = fmt.Sprintf("(%d, renamed, moved@example.com)", id)
+		}
+		if outputStr[id] != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", outputStr[id], expected)
+		}
+	}
+}
+
+func Test_update_shrinking_rows(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createWideTable(t, filename)
+
+	commands := append(wideInsertCommands(1, 30), "update wide set body = 'y'", ".btree wide", "select * from wide")
+	output := runScript(t, filename, commands)
+
+	// The leaves the update left underfull are merged back into the root.
+	outputStr := output[2*30:]
+	if outputStr[0] != "db > Executed" || outputStr[2] != "db > Tree: " || outputStr[3] != "- leaf (size 30)" {
+		t.Errorf("expected the shrunk rows to fit in one leaf, got %q", outputStr[:4])
+	}
+	outputStr = outputStr[3+30+2:]
+	outputStr[0] = strings.TrimPrefix(outputStr[0], "db > ")
+	for id := 1; id <= 30; id++ {
+		expected := fmt.Sprintf("(%d, y)", id)
+		if outputStr[id-1] != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", outputStr[id-1], expected)
+		}
+	}
+}
+
+func fileSize(t *testing.T, filename string) int64 {
+	t.Helper()
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func Test_free_pages_and_vacuum(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	runScript(t, filename, append(insertCommands(1, 600), "delete from users where id <= 500"))
+	size := fileSize(t, filename)
+
+	// Pages released by the delete are reused instead of growing the file.
+	runScript(t, filename, insertCommands(601, 1000))
+	if fileSize(t, filename) != size {
+		t.Errorf("expected freed pages to be reused, file grew from %d to %d bytes", size, fileSize(t, filename))
+	}
+
+	runScript(t, filename, []string{"delete from users where id between 601 and 990", ".vacuum"})
+	if fileSize(t, filename) >= size {
+		t.Errorf("expected .vacuum to shrink the file below %d bytes, got %d", size, fileSize(t, filename))
+	}
+
+	output := runScript(t, filename, []string{"select * from users"})
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	var ids []int
+	for id := 501; id <= 600; id++ {
+		ids = append(ids, id)
+	}
+	for id := 991; id <= 1000; id++ {
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+		if output[i] != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected)
+		}
+	}
+}
+
+// statsReports splits the output of a script into one map per .stats report.
+func statsReports(output []string) []map[string]string {
+	var reports []map[string]string
+	for _, line := range output {
+		line = strings.TrimPrefix(line, "db > ")
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		if name == "pages read" {
+			reports = append(reports, map[string]string{})
+		}
+		if len(reports) > 0 {
+			reports[len(reports)-1][name] = value
+		}
+	}
+	return reports
+}
+
+func Test_stats_and_dirty_pages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	// Every statement commits its pages to the log, so none stay dirty.
+	reports := statsReports(runScript(t, filename, append(insertCommands(1, 30), ".stats")))
+	if len(reports) != 1 || reports[0]["cached pages"] != "3 (0 dirty)" || reports[0]["pages written"] != "0" {
+		t.Errorf("expected inserts to be committed to the log only, got %v", reports)
+	}
+
+	// Reading the table back dirties nothing, so a second select is served
+	// entirely from the cache and nothing is written.
+	reports = statsReports(runScript(t, filename, []string{"select * from users", ".stats", "select * from users", ".stats"}))
+	if len(reports) != 2 {
+		t.Fatalf("expected two .stats reports, got %v", reports)
+	}
+	first, second := reports[0], reports[1]
+	if first["pages written"] != "0" || !strings.HasSuffix(first["cached pages"], " (0 dirty)") {
+		t.Errorf("expected a read only session to stay clean, got %v", first)
+	}
+	if second["pages read"] != first["pages read"] || second["cache misses"] != first["cache misses"] {
+		t.Errorf("expected the second select to be served from the cache, got %v then %v", first, second)
+	}
+	hits, _ := strconv.Atoi(first["cache hits"])
+	moreHits, _ := strconv.Atoi(second["cache hits"])
+	if moreHits <= hits {
+		t.Errorf("expected cache hits to grow, got %d then %d", hits, moreHits)
+	}
+}
+
+func Test_crash_recovery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+	runScript(t, filename, insertCommands(1, 100))
+
+	// Kill the process part way through a second batch of inserts. Every insert
+	// it reported as executed has to survive.
+	cmd := exec.Command(godbBinary, "-cache", "8", filename)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stdin.Write([]byte(strings.Join(insertCommands(101, 3000), "\n") + "\n"))
+	}()
+
+	executed := 0
+	scanner := bufio.NewScanner(stdout)
+	for executed < 1500 && scanner.Scan() {
+		if strings.HasSuffix(scanner.Text(), "Executed") {
+			executed++
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if _, err := os.Stat(filename + "-wal"); err != nil {
+		t.Fatalf("expected the killed process to leave its wal behind: %v", err)
+	}
+
+	// A torn frame at the end of the log is ignored.
+	wal, err := os.OpenFile(filename+"-wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Write([]byte("torn frame"))
+	wal.Close()
+
+	output := runScript(t, filename, []string{"select * from users"})
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	rows := 0
+	for rows < len(output) && strings.HasPrefix(output[rows], "(") {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", rows+1, rows+1, rows+1)
+		if output[rows] != expected {
+			t.Fatalf("Output is not equal to expected: %q != %q", output[rows], expected)
+		}
+		rows++
+	}
+	if rows < 100+executed {
+		t.Errorf("expected at least %d rows after recovery, got %d", 100+executed, rows)
+	}
+
+	if _, err := os.Stat(filename + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("expected a clean close to remove the wal, got %v", err)
+	}
+}
+
+func Test_transactions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	// The rolled back batch is large enough to spill pages out of the small
+	// cache, and rolling back has to undo those too.
+	commands := append(insertCommands(1, 10), "begin")
+	commands = append(commands, insertCommands(11, 500)...)
+	commands = append(commands, "delete from users where id < 5", "rollback", "commit", "begin")
+	commands = append(commands, insertCommands(11, 20)...)
+	commands = append(commands, "begin", "commit")
+	output := runScript(t, filename, commands, "-cache", "4")
+
+	rejected := 0
+	for _, line := range output {
+		switch strings.TrimPrefix(line, "db > ") {
+		case "Error: No transaction is active", "Error: A transaction is already active":
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("expected a commit without begin and a nested begin to be rejected, got %q", output)
+	}
+
+	// A transaction still open when the session ends is rolled back.
+	commands = append([]string{"begin"}, insertCommands(21, 30)...)
+	runScript(t, filename, commands)
+
+	output = runScript(t, filename, []string{"select * from users"})
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	for id := 1; id <= 20; id++ {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+		if output[id-1] != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", output[id-1], expected)
+		}
+	}
+	if output[20] != "Executed" {
+		t.Errorf("expected 20 rows, got %q", output)
+	}
+}
+
+func Test_rollback_journal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+	runScript(t, filename, insertCommands(1, 100), "-journal", "delete")
+	if _, err := os.Stat(filename + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("expected no wal in rollback journal mode, got %v", err)
+	}
+
+	// Kill the process in the middle of a transaction big enough that modified
+	// pages have already been spilled into the database file.
+	cmd := exec.Command(godbBinary, "-journal", "delete", "-cache", "4", filename)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		commands := append([]string{"begin", "delete from users where id <= 50"}, insertCommands(101, 3000)...)
+		stdin.Write([]byte(strings.Join(commands, "\n") + "\n"))
+	}()
+
+	executed := 0
+	scanner := bufio.NewScanner(stdout)
+	for executed < 1000 && scanner.Scan() {
+		if strings.HasSuffix(scanner.Text(), "Executed") {
+			executed++
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if _, err := os.Stat(filename + "-journal"); err != nil {
+		t.Fatalf("expected the killed transaction to leave a hot journal behind: %v", err)
+	}
+
+	// Opening the database plays the journal back, in either mode.
+	output := runScript(t, filename, []string{"select * from users"})
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	for id := 1; id <= 100; id++ {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+		if output[id-1] != expected {
+			t.Fatalf("Output is not equal to expected: %q != %q", output[id-1], expected)
+		}
+	}
+	if output[100] != "Executed" {
+		t.Errorf("expected 100 rows, got %q", output[100])
+	}
+	if _, err := os.Stat(filename + "-journal"); !os.IsNotExist(err) {
+		t.Errorf("expected the hot journal to be removed, got %v", err)
+	}
+}
+
+func Test_create_table(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+
+	output := runScript(t, filename, []string{
+		"insert into items values (1, 'a', 'b')",
+		"create table items (name text)",
+		"create table items (id integer, name text, price real, data blob, active boolean, price text)",
+		"create table items (id integer, name varchar)",
+		"create table items (id integer, name text, price real, data blob, active boolean)",
+		"create table items (id integer)",
+		"insert into items values (2, 'blue pen', 1.5, x'00ff', true)",
+		"insert into items values (1, 'pencil', 0.25, x'', false)",
+		"insert into items values (3, 'eraser', 'cheap', x'', false)",
+		"insert into items values (4, 'marker', 2, x'zz', false)",
+		"update items set price = 3, active = 0 where name = 'blue pen'",
+		"insert into items values (1, 'duplicate', 0, x'', false)",
+	})
+	expected := []string{
+		"db > unrecognized table",
+		"db > the first column must be an integer key",
+		"db > syntax error. could not parse statement",
+		"db > unrecognized type",
+		"db > Executed",
+		"execution finished",
+		"db > Error: Table already exists",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > type mismatch",
+		"db > syntax error at line 1, column 43: invalid blob literal",
+		"db > Executed",
+		"execution finished",
+		"db > Error: Duplicate Key",
+		"execution finished",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+
+	// The schema is stored in the file.
+	output = runScript(t, filename, []string{"select * from items"})
+	expected = []string{
+		"db > (1, pencil, 0.25, x'', false)",
+		"(2, blue pen, 3.0, x'00ff', false)",
+		"Executed",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_multiple_tables(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	commands := []string{"create table orders (id integer, user_id integer, total real)"}
+	commands = append(commands, insertCommands(1, 40)...)
+	for i := 1; i <= 40; i++ {
+		commands = append(commands, fmt.Sprintf("insert into orders values (%d, %d, %d.5)", i*10, i, i))
+	}
+	commands = append(commands,
+		"delete from orders where id > 100",
+		"insert into missing values (1)",
+		"delete from godb_master",
+		"create table orders (id integer)",
+		".tables")
+	output := runScript(t, filename, commands)
+	expected := []string{
+		"db > unrecognized table",
+		"db > table is read only",
+		"db > Error: Table already exists",
+		"execution finished",
+		"db > users",
+		"orders",
+		"success",
+	}
+	tail := output[len(output)-len(expected)-1 : len(output)-1]
+	for i := 0; i < len(expected); i++ {
+		if tail[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", tail[i], expected[i])
+		}
+	}
+
+	// Each table keeps its own rows, and the catalog lists both, before and
+	// after the file is vacuumed.
+	for _, vacuum := range []bool{false, true} {
+		commands := []string{"select * from users", "select * from orders", "select * from godb_master"}
+		if vacuum {
+			commands = append([]string{".vacuum"}, commands...)
+		}
+		output := runScript(t, filename, commands)
+		if vacuum {
+			output = output[2:]
+		}
+
+		for i := 1; i <= 40; i++ {
+			expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", i, i, i)
+			if i == 1 {
+				expected = "db > " + expected
+			}
+			if output[i-1] != expected {
+				t.Errorf("Output is not equal to expected: %q != %q", output[i-1], expected)
+			}
+		}
+		output = output[42:]
+		for i := 1; i <= 10; i++ {
+			expected := fmt.Sprintf("(%d, %d, %d.5)", i*10, i, i)
+			if i == 1 {
+				expected = "db > " + expected
+			}
+			if output[i-1] != expected {
+				t.Errorf("Output is not equal to expected: %q != %q", output[i-1], expected)
+			}
+		}
+		output = output[12:]
+		if !strings.HasPrefix(output[0], "db > (1, table, users, ") || !strings.HasPrefix(output[1], "(2, table, orders, ") ||
+			!strings.HasSuffix(output[1], ", create table orders (id integer, user_id integer, total real))") {
+			t.Errorf("expected the catalog to list both tables, got %q", output[:2])
+		}
+	}
+}
+
+func Test_variable_length_records(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	// Short rows only take the space they need, so many share one leaf.
+	output := runScript(t, filename, append(insertCommands(1, 80), ".btree users"))
+	if output[2*80] != "db > Tree: " || output[2*80+1] != "- leaf (size 80)" {
+		t.Errorf("expected 80 rows in a single leaf, got %q", output[2*80:2*80+2])
+	}
+
+	// Text is no longer limited to a fixed width, only by its 2 byte length.
+	long := strings.Repeat("a", 900)
+	output = runScript(t, filename, []string{
+		fmt.Sprintf("insert into users values (81, '%s', 'long@example.com')", long),
+		fmt.Sprintf("insert into users values (82, '%s', 'long@example.com')", strings.Repeat("a", engine.MAX_VALUE_LENGTH+1)),
+	})
+	expected := []string{"db > Executed", "execution finished", "db > String is too long"}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+
+	// Growing rows split the leaf, shrinking them leaves holes that later
+	// inserts reuse once the leaf is defragmented.
+	commands := []string{
+		fmt.Sprintf("update users set username = '%s' where id between 10 and 14", long),
+		"update users set username = 'short' where id between 10 and 12",
+		"delete from users where id between 30 and 60",
+	}
+	commands = append(commands, insertCommands(30, 60)...)
+	runScript(t, filename, commands)
+
+	output = runScript(t, filename, []string{"select * from users"})
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	for id := 1; id <= 81; id++ {
+		expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+		switch {
+		case id >= 10 && id <= 12:
+			expected = fmt.Sprintf("(%d, short, person%d@example.com)", id, id)
+		case id >= 13 && id <= 14:
+			expected = fmt.Sprintf("(%d, %s, person%d@example.com)", id, long, id)
+		case id == 81:
+			expected = fmt.Sprintf("(81, %s, long@example.com)", long)
+		}
+		if output[id-1] != expected {
+			t.Errorf("Output is not equal to expected: %q != %q", output[id-1], expected)
+		}
+	}
+}
+
+func Test_overflow_pages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	runScript(t, filename, []string{"create table files (id integer, name text, data blob)"})
+
+	// Values larger than a page spill into overflow chains and read back whole.
+	data := func(id int, size int) string {
+		return "x'" + strings.Repeat(fmt.Sprintf("%02x", id), size) + "'"
+	}
+	var commands []string
+	for id := 1; id <= 20; id++ {
+		commands = append(commands, fmt.Sprintf("insert into files values (%d, 'file%d', %s)", id, id, data(id, id*1000)))
+	}
+	runScript(t, filename, commands)
+	size := fileSize(t, filename)
+
+	output := runScript(t, filename, []string{"select * from files"})
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	for id := 1; id <= 20; id++ {
+		expected := fmt.Sprintf("(%d, file%d, %s)", id, id, data(id, id*1000))
+		if output[id-1] != expected {
+			t.Errorf("row %d did not read back whole, got %d bytes", id, len(output[id-1]))
+		}
+	}
+
+	// Deleting and shrinking rows frees their chains, which later rows reuse.
+	runScript(t, filename, []string{
+		"delete from files where id > 10",
+		"update files set data = x'00' where id <= 5",
+	})
+	commands = nil
+	for id := 11; id <= 20; id++ {
+		commands = append(commands, fmt.Sprintf("insert into files values (%d, 'file%d', %s)", id, id, data(id, id*1000)))
+	}
+	runScript(t, filename, commands)
+	if fileSize(t, filename) > size {
+		t.Errorf("expected freed overflow pages to be reused, file grew from %d to %d bytes", size, fileSize(t, filename))
+	}
+
+	// Vacuum gives every chain a new home in the packed file.
+	output = runScript(t, filename, []string{".vacuum", "select * from files"})
+	output = output[2:]
+	output[0] = strings.TrimPrefix(output[0], "db > ")
+	for id := 1; id <= 20; id++ {
+		expected := fmt.Sprintf("(%d, file%d, %s)", id, id, data(id, id*1000))
+		if id <= 5 {
+			expected = fmt.Sprintf("(%d, file%d, x'00')", id, id)
+		}
+		if output[id-1] != expected {
+			t.Errorf("row %d did not survive .vacuum, got %d bytes", id, len(output[id-1]))
+		}
+	}
+}
+
+func Test_sql_parser(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+
+	output := runScript(t, filename, []string{
+		"CREATE TABLE \"table\" (id INTEGER, note Text) -- a keyword as a name",
+		"Insert Into \"table\" Values (1, 'it''s, from ''where'' -- not a comment');",
+		"insert /* inline */ into \"table\" values (2, '  spaced  ');",
+		"select * from \"table\";",
+		"select * frm \"table\"",
+		"insert into \"table\" values (3, 'unterminated)",
+		"insert into \"table\" values (3 'missing comma')",
+		"update \"table\" set note = 'x' where id @ 1",
+		"select * from godb_master",
+	})
+	expected := []string{
+		"db > Executed",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > (1, it's, from 'where' -- not a comment)",
+		"(2,   spaced  )",
+		"Executed",
+		"execution finished",
+		"db > syntax error at line 1, column 10: expected \"from\" but found \"frm\"",
+		"db > syntax error at line 1, column 32: unterminated string",
+		"db > syntax error at line 1, column 31: expected \")\" but found 'missing comma'",
+		"db > syntax error at line 1, column 40: unexpected character '@'",
+		"db > (1, table, table, 2, create table \"table\" (id integer, note text))",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
 		}
 	}
 
-	return
+	// The quoted name is read back from the catalog when the file is reopened.
+	output = runScript(t, filename, []string{"select * from \"table\""})
+	if output[0] != "db > (1, it's, from 'where' -- not a comment)" {
+		t.Errorf("expected the table to survive a reopen, got %q", output[0])
+	}
+}
+
+func Test_where_expressions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	runScript(t, filename, []string{
+		"create table people (id integer, name text, email text, score real, active boolean)",
+		"insert into people values (1, 'alice', 'alice@example.com', 9.5, true)",
+		"insert into people values (2, 'bob', null, 7, false)",
+		"insert into people values (3, 'Carol', 'carol@example.org', null, true)",
+		"insert into people values (4, 'dave', 'dave@example.com', 3.25, null)",
+	})
+
+	queries := map[string][]int{
+		"email is null":                             {2},
+		"email is not null and score is null":       {3},
+		"email like '%.COM' and not active = false": {1},
+		"name like '_a%'":                           {3, 4},
+		"id in (1, 3, 9) or name = 'dave'":          {1, 3, 4},
+		"score * 2 >= 15":                           {1},
+		"id between 2 and 3 and name not like 'b%'": {3},
+		"id not between 2 and 3":                    {1, 4},
+		"score > 5 or active":                       {1, 2, 3},
+		"not (score > 5)":                           {4},
+		"id % 2 = 0":                                {2, 4},
+		"(id + 1) * 2 = 6 or -id = -4":              {2, 4},
+		"id = 2.5 or id > 3.5":                      {4},
+		"4 > id and id >= 3":                        {3},
+		"id < -1 or 1 / 0 is not null":              {},
+		"active in (true, null)":                    {1, 3},
+		"active not in (true)":                      {2},
+	}
+	for condition, ids := range queries {
+		output := runScript(t, filename, []string{"select * from people where " + condition})
+		output[0] = strings.TrimPrefix(output[0], "db > ")
+		var got []int
+		for _, line := range output {
+			if id, _, ok := strings.Cut(strings.TrimPrefix(line, "("), ","); ok && strings.HasPrefix(line, "(") {
+				n, _ := strconv.Atoi(id)
+				got = append(got, n)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(ids) {
+			t.Errorf("where %s: expected %v, got %v", condition, ids, got)
+		}
+	}
+
+	output := runScript(t, filename, []string{
+		"select * from people where name = 5",
+		"select * from people where id",
+		"select * from people where score < 'a'",
+		"select * from people where nope = 1",
+		"select * from people where id = 1 and",
+		"select * from people where name not = 'bob'",
+		"insert into people values (null, 'nobody', null, null, null)",
+		"update people set score = null where name like 'a%'",
+		"delete from people where score is null and active",
+		"select * from people",
+	})
+	expected := []string{
+		"db > type mismatch",
+		"db > type mismatch",
+		"db > type mismatch",
+		"db > unrecognized column",
+		"db > syntax error at line 1, column 38: expected an expression but found end of statement",
+		"db > syntax error at line 1, column 37: expected \"between\", \"in\" or \"like\" but found \"=\"",
+		"db > type mismatch",
+		"db > Executed",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > (2, bob, null, 7.0, false)",
+		"(4, dave, dave@example.com, 3.25, null)",
+		"Executed",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_where_key_lookups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+	runScript(t, filename, insertCommands(1, 300))
+
+	// Conditions on the key read only part of the tree, and whatever the
+	// range, every row in it is still checked against the whole condition.
+	queries := map[string][]int{
+		"id = 150":                             {150},
+		"id = 301":                             nil,
+		"id > 297":                             {298, 299, 300},
+		"id <= 2 or id = 300":                  {1, 2, 300},
+		"id in (299, 5, 5000)":                 {5, 299},
+		"id between 100 and 102 and id != 101": {100, 102},
+		"id >= 140 and username = 'user141'":   {141},
+		"id < 0":                               nil,
+		"id > 4294967295":                      nil,
+	}
+	for condition, ids := range queries {
+		output := runScript(t, filename, []string{"select * from users where " + condition})
+		output[0] = strings.TrimPrefix(output[0], "db > ")
+		for i, id := range ids {
+			expected := fmt.Sprintf("(%d, user%d, person%d@example.com)", id, id, id)
+			if output[i] != expected {
+				t.Errorf("where %s: %q != %q", condition, output[i], expected)
+			}
+		}
+		if output[len(ids)] != "Executed" {
+			t.Errorf("where %s: expected %d rows, got %q", condition, len(ids), output)
+		}
+	}
+}
+
+func Test_select_projection_and_order(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+	var commands []string
+	for i := 1; i <= 500; i++ {
+		commands = append(commands, fmt.Sprintf("insert into users values (%d, 'user%d', 'person%d@example.com')", i, i*37%101, i))
+	}
+	runScript(t, filename, commands)
+
+	// Sorting by username keeps rows with the same name in key order.
+	var ids []int
+	for i := 1; i <= 500; i++ {
+		ids = append(ids, i)
+	}
+	sort.SliceStable(ids, func(a, b int) bool {
+		return fmt.Sprintf("user%d", ids[a]*37%101) > fmt.Sprintf("user%d", ids[b]*37%101)
+	})
+
+	// A small sort memory makes the sort spill into several runs.
+	for _, sortMemory := range []string{"1000", "100000000"} {
+		output := runScript(t, filename, []string{"select email, id from users order by username desc limit 10 offset 20"}, "-sort-memory", sortMemory)
+		output[0] = strings.TrimPrefix(output[0], "db > ")
+		for i, id := range ids[20:30] {
+			expected := fmt.Sprintf("(person%d@example.com, %d)", id, id)
+			if output[i] != expected {
+				t.Errorf("sort memory %s: %q != %q", sortMemory, output[i], expected)
+			}
+		}
+		if output[10] != "Executed" {
+			t.Errorf("sort memory %s: expected 10 rows, got %q", sortMemory, output[10])
+		}
+	}
+
+	output := runScript(t, filename, []string{
+		"select id * 2, username from users where id < 5 order by id limit 2 offset 1",
+		"select * from users order by id desc limit 2",
+		"select id from users order by id asc, username limit 3 offset 498",
+		"select id, id % 3 from users where id <= 6 order by id % 3, id desc",
+		"select username from users limit 0",
+		"select id from users order by nope",
+		"select id from users limit -1",
+		"select id, from users",
+	}, "-sort-memory", "100")
+	expected := []string{
+		"db > (4, user74)",
+		"(6, user10)",
+		"Executed",
+		"execution finished",
+		"db > (500, user17, person500@example.com)",
+		"(499, user81, person499@example.com)",
+		"Executed",
+		"execution finished",
+		"db > (499)",
+		"(500)",
+		"Executed",
+		"execution finished",
+		"db > (6, 0)",
+		"(3, 0)",
+		"(4, 1)",
+		"(1, 1)",
+		"(5, 2)",
+		"(2, 2)",
+		"Executed",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > unrecognized column",
+		"db > syntax error at line 1, column 28: expected a whole number but found \"-\"",
+		"db > syntax error at line 1, column 12: expected an expression but found \"from\"",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_aggregates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	runScript(t, filename, []string{
+		"create table orders (id integer, customer text, amount integer, discount real)",
+		"insert into orders values (1, 'ann', 10, 0.5)",
+		"insert into orders values (2, 'bob', 25, null)",
+		"insert into orders values (3, 'ann', 5, 1.5)",
+		"insert into orders values (4, 'cid', null, null)",
+		"insert into orders values (5, 'bob', 40, 2.0)",
+		"insert into orders values (6, 'ann', 15, null)",
+	})
+
+	output := runScript(t, filename, []string{
+		"select count(*), count(amount), sum(amount), avg(amount), min(customer), max(discount) from orders",
+		"select customer, count(*), sum(amount) from orders group by customer order by customer",
+		"select customer, sum(amount) from orders group by customer having sum(amount) > 20 order by sum(amount) desc",
+		"select id % 2, count(*) * 10 from orders where id > 1 group by id % 2 order by id % 2",
+		"select sum(discount), avg(discount), max(amount) from orders where customer = 'cid'",
+		"select count(*), sum(amount) from orders where id > 100",
+		"select customer from orders group by customer having count(*) = 1",
+		"select customer, amount from orders group by customer",
+		"select * from orders group by customer",
+		"select customer from orders where count(*) > 1",
+		"select sum(count(*)) from orders",
+		"select sum(customer) from orders",
+		"select total(amount) from orders",
+		"select sum(*) from orders",
+	})
+	expected := []string{
+		"db > (6, 5, 95, 19.0, ann, 2.0)",
+		"Executed",
+		"execution finished",
+		"db > (ann, 3, 30)",
+		"(bob, 2, 65)",
+		"(cid, 1, null)",
+		"Executed",
+		"execution finished",
+		"db > (bob, 65)",
+		"(ann, 30)",
+		"Executed",
+		"execution finished",
+		"db > (0, 30)",
+		"(1, 20)",
+		"Executed",
+		"execution finished",
+		"db > (null, null, null)",
+		"Executed",
+		"execution finished",
+		"db > (0, null)",
+		"Executed",
+		"execution finished",
+		"db > (cid)",
+		"Executed",
+		"execution finished",
+		"db > column must appear in group by or be used in an aggregate",
+		"db > column must appear in group by or be used in an aggregate",
+		"db > misuse of aggregate function",
+		"db > misuse of aggregate function",
+		"db > type mismatch",
+		"db > unrecognized function",
+		"db > syntax error. could not parse statement",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_count_rows(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+
+	// count(*) over a whole table adds up the leaf headers, and has to agree
+	// with the rows a scan finds across many leaves.
+	output := runScript(t, filename, []string{"select count(*) from users"})
+	if output[0] != "db > (0)" {
+		t.Errorf("expected an empty table to have no rows, got %q", output[0])
+	}
+	runScript(t, filename, insertCommands(1, 1000))
+	runScript(t, filename, []string{"delete from users where id between 100 and 399"})
+	output = runScript(t, filename, []string{
+		"select count(*) from users",
+		"select count(*) from users where username like 'user%'",
+		"select count(*) + 1, count(*) from users limit 1 offset 0",
+	})
+	expected := []string{
+		"db > (700)",
+		"Executed",
+		"execution finished",
+		"db > (700)",
+		"Executed",
+		"execution finished",
+		"db > (701, 700)",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_joins(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	runScript(t, filename, []string{
+		"create table users (id integer, name text)",
+		"create table orders (id integer, user_id integer, amount integer)",
+		"insert into users values (1, 'ann')",
+		"insert into users values (2, 'bob')",
+		"insert into users values (3, 'cid')",
+		"insert into orders values (10, 1, 5)",
+		"insert into orders values (11, 1, 7)",
+		"insert into orders values (12, 3, 9)",
+		"insert into orders values (13, 4, 1)",
+	})
+
+	output := runScript(t, filename, []string{
+		"select u.name, o.amount from users u join orders o on o.user_id = u.id",
+		"select * from users as u left join orders o on o.user_id = u.id where u.id < 3",
+		"select a.name, b.name from users a inner join users b on a.id < b.id where a.id = 1",
+		"select o.id, u.name, v.name from orders o join users u on u.id = o.user_id join users v on v.id > u.id order by o.id desc",
+		"select u.name, count(o.id), sum(o.amount) from users u left join orders o on o.user_id = u.id group by u.name order by u.name",
+		"select id from users u join orders o on o.user_id = u.id",
+		"select u.amount from users u join orders o on o.user_id = u.id",
+		"select * from users u join missing m on m.id = u.id",
+		"select * from users u join orders o on o.amount",
+	})
+	expected := []string{
+		"db > (ann, 5)",
+		"(ann, 7)",
+		"(cid, 9)",
+		"Executed",
+		"execution finished",
+		"db > (1, ann, 10, 1, 5)",
+		"(1, ann, 11, 1, 7)",
+		"(2, bob, null, null, null)",
+		"Executed",
+		"execution finished",
+		"db > (ann, bob)",
+		"(ann, cid)",
+		"Executed",
+		"execution finished",
+		"db > (11, ann, bob)",
+		"(11, ann, cid)",
+		"(10, ann, bob)",
+		"(10, ann, cid)",
+		"Executed",
+		"execution finished",
+		"db > (ann, 2, 12)",
+		"(bob, 0, null)",
+		"(cid, 1, 9)",
+		"Executed",
+		"execution finished",
+		"db > ambiguous column",
+		"db > unrecognized column",
+		"db > unrecognized table",
+		"db > type mismatch",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_join_strategies(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+	runScript(t, filename, insertCommands(1, 500))
+	runScript(t, filename, []string{
+		"create table orders (id integer, user_id integer, amount integer)",
+		"insert into orders values (1, 7, 10)",
+		"insert into orders values (2, 300, 20)",
+		"insert into orders values (3, 9999, 30)",
+	})
+
+	// A few orders look their users up by key, a large table joined on a
+	// column that is not a key is hashed, and anything but an equality is a
+	// nested loop, which has to find the same rows as the key lookup.
+	output := runScript(t, filename, []string{
+		"explain select * from orders o join users u on u.id = o.user_id",
+		"explain select * from users a join users b on b.username = a.username where a.id > 10",
+		"explain select * from orders o left join users u on u.id < o.user_id and u.id > 498",
+		"explain select * from users u where u.id = 5",
+		"select o.id, u.username from orders o join users u on u.id = o.user_id",
+		"select o.id, u.username from orders o left join users u on u.id <= o.user_id and u.id >= o.user_id",
+	})
+	expected := []string{
+		"db > scan o",
+		"join u by key lookup",
+		"Executed",
+		"execution finished",
+		"db > search a by key range",
+		"join b by hash",
+		"Executed",
+		"execution finished",
+		"db > scan o",
+		"left join u by nested loop",
+		"Executed",
+		"execution finished",
+		"db > search u by key",
+		"Executed",
+		"execution finished",
+		"db > (1, user7)",
+		"(2, user300)",
+		"Executed",
+		"execution finished",
+		"db > (1, user7)",
+		"(2, user300)",
+		"(3, null)",
+		"Executed",
+		"execution finished",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+}
+
+func Test_indexes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	createUsersTable(t, filename)
+	runScript(t, filename, insertCommands(1, 1000))
+	runScript(t, filename, []string{
+		"create index on users(email)",
+		"insert into users values (1001, 'late', 'person500@example.com')",
+		"update users set email = 'moved@example.com' where id = 20",
+		"delete from users where email = 'person30@example.com'",
+	})
+
+	// Every statement reopens the database, so the index is read back from
+	// the catalog and has to have been kept up to date by each change.
+	output := runScript(t, filename, []string{
+		"explain select * from users where email = 'person500@example.com'",
+		"select id, username from users where email = 'person500@example.com'",
+		"select id from users where email = 'person20@example.com' or email = 'moved@example.com'",
+		"select count(*) from users where email = 'person30@example.com'",
+		"select id from users where email between 'person997' and 'person999@example.com' order by id desc",
+		"explain select * from users where id = 5 and email = 'person5@example.com'",
+		"create index on users(email)",
+		"create index on users(missing)",
+	})
+	expected := []string{
+		"db > search users by index users_email_index",
+		"Executed",
+		"execution finished",
+		"db > (500, user500)",
+		"(1001, late)",
+		"Executed",
+		"execution finished",
+		"db > (20)",
+		"Executed",
+		"execution finished",
+		"db > (0)",
+		"Executed",
+		"execution finished",
+		"db > (999)",
+		"(998)",
+		"(997)",
+		"Executed",
+		"execution finished",
+		"db > search users by key",
+		"Executed",
+		"execution finished",
+		"db > Error: Index already exists",
+		"execution finished",
+		"db > unrecognized column",
+	}
+	for i := 0; i < len(expected); i++ {
+		if output[i] != expected[i] {
+			t.Errorf("Output is not equal to expected: %q != %q", output[i], expected[i])
+		}
+	}
+
+	// Vacuum rebuilds the index along with the table.
+	output = runScript(t, filename, []string{
+		".vacuum",
+		"select id from users where email > 'person998@example.com' and email < 'person999@z'",
+	})
+	if output[1] != "success" || output[2] != "db > (999)" || output[3] != "Executed" {
+		t.Errorf("expected the index to survive a vacuum, got %q", output)
+	}
+}
+
+func Test_library_api(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	if _, err := Open(filename, &Options{CachePages: -1}); err == nil {
+		t.Errorf("expected a negative cache size to be rejected")
+	}
+
+	db, err := Open(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{
+		"create table users (id integer, username text, score real, active boolean)",
+		"insert into users values (1, 'alice', 1.5, true)",
+		"insert into users values (2, 'bob', null, false)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	result, err := db.Exec("update users set active = true where id > 0")
+	if err != nil || result.RowsAffected != 2 {
+		t.Errorf("expected the update to change 2 rows, got %d, %v", result.RowsAffected, err)
+	}
+
+	rows, err := db.Query("select id,  username , score from users order by id desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns := rows.Columns(); strings.Join(columns, "|") != "id|username|score" {
+		t.Errorf("unexpected columns %q", columns)
+	}
+	var got []string
+	for rows.Next() {
+		var id int64
+		var username string
+		var score any
+		if err := rows.Scan(&id, &username, &score); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %v", id, username, score))
+	}
+	if strings.Join(got, ",") != "2 bob <nil>,1 alice 1.5" {
+		t.Errorf("unexpected rows %q", got)
+	}
+
+	rows, _ = db.Query("select * from users where id = 1")
+	var active bool
+	var score float64
+	if rows.Next(); rows.Scan(new(int), new(string), &score, &active) != nil || !active || score != 1.5 {
+		t.Errorf("expected to scan every column of alice, got %v %v", score, active)
+	}
+	if strings.Join(rows.Columns(), "|") != "id|username|score|active" {
+		t.Errorf("unexpected columns for *: %q", rows.Columns())
+	}
+	if rows.Scan(new(int), new(int), new(int), new(int)) == nil {
+		t.Errorf("expected scanning text into an int to fail")
+	}
+
+	// Errors tell a statement that never ran from one that failed.
+	var statementError *Error
+	_, err = db.Exec("select * from missing")
+	if !errors.As(err, &statementError) || statementError.Ran() || err.Error() != "unrecognized table" {
+		t.Errorf("expected a prepare error, got %v", err)
+	}
+	_, err = db.Exec("insert into users values (1, 'again', 0.0, true)")
+	if !errors.As(err, &statementError) || !statementError.Ran() || err.Error() != "Duplicate Key" {
+		t.Errorf("expected a duplicate key error, got %v", err)
+	}
+
+	rows, _ = db.Query("explain select * from users where id = 1")
+	if !rows.Next() || !rows.Explain() || rows.Values()[0].String() != "search users by key" {
+		t.Errorf("expected the plan of the select")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("select * from users"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	// The REPL reads what the library wrote.
+	output := runScript(t, filename, []string{"select username from users"})
+	if output[0] != "db > (alice)" || output[1] != "(bob)" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func Test_storage_errors(t *testing.T) {
+	dir := t.TempDir()
+
+	// Files that are not databases are refused instead of ending the process.
+	notDatabase := filepath.Join(dir, "zeros.db")
+	if err := os.WriteFile(notDatabase, make([]byte, engine.PAGE_SIZE), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(notDatabase, nil); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for a file without a header, got %v", err)
+	}
+	truncated := filepath.Join(dir, "truncated.db")
+	if err := os.WriteFile(truncated, make([]byte, 100), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(truncated, nil); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for a partial page, got %v", err)
+	}
+
+	filename := filepath.Join(dir, "my.db")
+	db, err := Open(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{
+		"create table users (id integer, username text)",
+		"insert into users values (1, 'alice')",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	if _, err := db.Exec("insert into users values (1, 'again')"); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+	rows, err := db.Query("select root_page from godb_master where name = 'users'")
+	var rootPageNum int
+	if err == nil && rows.Next() {
+		err = rows.Scan(&rootPageNum)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the root of the table with garbage.
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := []byte(strings.Repeat("\xff", engine.PAGE_SIZE))
+	if _, err := file.WriteAt(garbage, int64(rootPageNum)*engine.PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	db, err = Open(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statementError *Error
+	_, err = db.Query("select * from users")
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &statementError) || !statementError.Ran() {
+		t.Errorf("expected ErrCorrupt from reading the table, got %v", err)
+	}
+	if _, err := db.Exec("insert into users values (2, 'bob')"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt from inserting into the table, got %v", err)
+	}
+	// The rest of the database is still usable.
+	if _, err := db.Exec("create table other (id integer)"); err != nil {
+		t.Errorf("expected another table to be created, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The REPL reports the error and carries on.
+	output := runScript(t, filename, []string{"select * from users", "insert into other values (1)", "select * from other"})
+	expected := []string{
+		"db > Error: database file is corrupt: ",
+		"execution finished",
+		"db > Executed",
+		"execution finished",
+		"db > (1)",
+	}
+	if !strings.HasPrefix(output[0], expected[0]) || output[1] != expected[1] || output[2] != expected[2] ||
+		output[3] != expected[3] || output[4] != expected[4] {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func Test_database_sql(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "my.db")
+	db, err := sql.Open("godb", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("create table users (id integer, username text, score real, active boolean, avatar blob)"); err != nil {
+		t.Fatal(err)
+	}
+	insert, err := db.Prepare("insert into users values (?, ?, ?, ?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]any{
+		{1, "alice", 1.5, true, []byte{0xca, 0xfe}},
+		{2, "o'brien?", -2, false, nil},
+		{3, "-- not a comment", nil, nil, []byte{}},
+	} {
+		if _, err := insert.Exec(args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	insert.Close()
+	if _, err := db.Exec("insert into users values (?, ?)", 4); err == nil {
+		t.Errorf("expected a missing argument to be rejected")
+	}
+
+	var username string
+	var score sql.NullFloat64
+	var avatar []byte
+	err = db.QueryRow("select username, score, avatar from users where id = ? and username != '?'", 2).Scan(&username, &score, &avatar)
+	if err != nil || username != "o'brien?" || score.Float64 != -2 || avatar != nil {
+		t.Errorf("unexpected row %q %v %v, %v", username, score, avatar, err)
+	}
+	if err := db.QueryRow("select id from users where id = 5 - ?", -1).Scan(new(int)); err != sql.ErrNoRows {
+		t.Errorf("expected no rows, got %v", err)
+	}
+
+	rows, err := db.Query("select id, active from users where id > ? order by id desc", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var id int
+		var active sql.NullBool
+		if err := rows.Scan(&id, &active); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %v", id, active.Valid && active.Bool))
+	}
+	if err := rows.Err(); err != nil || strings.Join(got, ",") != "3 false,2 false" {
+		t.Errorf("unexpected rows %q, %v", got, err)
+	}
+
+	// A rolled back transaction leaves nothing behind and a committed one
+	// stays.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("delete from users where id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := tx.Exec("update users set score = ? where id >= ?", 0.25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 2 {
+		t.Errorf("expected the update to change 2 rows, got %d", affected)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	var total float64
+	if err := db.QueryRow("select count(*), sum(score) from users").Scan(&count, &total); err != nil || count != 3 || total != 2 {
+		t.Errorf("expected 3 rows scoring 2 in all, got %d %v, %v", count, total, err)
+	}
+
+	_, err = db.Exec("insert into users values (?, 'again', null, null, null)", 1)
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+
+	// Statements run without being prepared are compiled once and cached.
+	shared_databases.Lock()
+	cache := shared_databases.files[filename].db.cache
+	shared_databases.Unlock()
+	cached := cache.Len()
+	for id := 10; id < 30; id++ {
+		if _, err := db.Exec("insert into users values (?, 'bulk', null, null, null)", id); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow("select username from users where id = ?", id).Scan(&username); err != nil || username != "bulk" {
+			t.Fatalf("expected user %d to be inserted, got %q, %v", id, username, err)
+		}
+	}
+	if cache.Len() != cached+2 {
+		t.Errorf("expected 2 more cached statements, got %d more", cache.Len()-cached)
+	}
+
+	// A context ends the wait for a transaction on another connection, and a
+	// context that has already ended runs nothing.
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "delete from users where id = 2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the delete to time out, got %v", err)
+	}
+	if _, err := db.BeginTx(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the transaction to time out, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.ExecContext(cancelled, "delete from users where id = 2"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the delete to be cancelled, got %v", err)
+	}
+	if err := db.QueryRow("select username from users where id = 2").Scan(&username); err != nil {
+		t.Errorf("expected user 2 to remain, got %v", err)
+	}
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted}); err == nil {
+		t.Errorf("expected an isolation level to be rejected")
+	}
+
+	// A transaction is not begun or ended by a statement, in a transaction
+	// of database/sql or outside one.
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{"begin", "commit", "rollback"} {
+		if _, err := db.Exec(sql); err == nil {
+			t.Errorf("expected %s to be refused", sql)
+		}
+		if _, err := tx.Exec(sql); err == nil {
+			t.Errorf("expected %s to be refused in a transaction", sql)
+		}
+	}
+	if _, err := tx.Exec("delete from users where id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select username from users where id = 2").Scan(&username); err != nil {
+		t.Errorf("expected the rollback to keep user 2, got %v", err)
+	}
+}
+
+func Test_prepared_statements(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "my.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table users (id integer, username text, score real)"); err != nil {
+		t.Fatal(err)
+	}
+
+	insert, err := db.Prepare("insert into users values (?, ?, $2)")
+	if err == nil {
+		_, err = insert.Exec(1, "alice")
+	}
+	if err == nil || err.Error() != "type mismatch" {
+		t.Errorf("expected text bound to a real column to be a type mismatch, got %v", err)
+	}
+	insert, err = db.Prepare("insert into users values (?, ?, ?)")
+	if err != nil || insert.NumInput() != 3 {
+		t.Fatalf("expected 3 parameters, got %v", err)
+	}
+	for i, username := range []string{"alice", "x'); delete from users; --", "$1 ?", ""} {
+		if _, err := insert.Exec(i+1, username, float32(i)/2); err != nil {
+			t.Fatalf("%q: %v", username, err)
+		}
+	}
+	if _, err := insert.Exec(5, "bob"); err == nil || err.Error() != "expected 3 arguments, got 2" {
+		t.Errorf("expected a missing argument to be rejected, got %v", err)
+	}
+	if _, err := insert.Exec(5, "bob", struct{}{}); err == nil {
+		t.Errorf("expected an unsupported argument to be rejected")
+	}
+	if _, err := db.Exec("select * from users where id = ?"); err == nil {
+		t.Errorf("expected a parameter without a value to be rejected")
+	}
+	if _, err := db.Exec("select * from users where id = $1000"); err == nil {
+		t.Errorf("expected a parameter out of range to be rejected")
+	}
+
+	// Values are compared as values, never read as SQL, and $1 can be used
+	// more than once.
+	rows, err := db.Query("select id, username from users where id = $1 or id = $1 + 1 or username = $2 order by id", 1, "$1 ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var id int
+		var username string
+		rows.Scan(&id, &username)
+		got = append(got, fmt.Sprintf("%d %s", id, username))
+	}
+	if strings.Join(got, ",") != "1 alice,2 x'); delete from users; --,3 $1 ?" {
+		t.Errorf("unexpected rows %q", got)
+	}
+
+	count, err := db.Prepare("select count(*) from users where score >= ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		score any
+		want  int64
+	}{{0, 4}, {1.0, 2}, {nil, 0}} {
+		rows, err := count.Query(test.score)
+		var n int64
+		if err == nil && rows.Next() {
+			err = rows.Scan(&n)
+		}
+		if err != nil || n != test.want {
+			t.Errorf("score >= %v: expected %d rows, got %d, %v", test.score, test.want, n, err)
+		}
+	}
+
+	// A compiled statement looks names up each time it runs, so it sees a
+	// table created and then rolled back come and go.
+	items, err := db.Prepare("select count(*) from items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := items.Query(); err == nil {
+		t.Errorf("expected items not to exist yet")
+	}
+	for _, sql := range []string{"begin", "create table items (id integer)", "insert into items values (1)"} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	if rows, err := items.Query(); err != nil || !rows.Next() || rows.Values()[0].String() != "1" {
+		t.Errorf("expected one item, got %v", err)
+	}
+	db.Exec("rollback")
+	if _, err := items.Query(); err == nil || err.Error() != "unrecognized table" {
+		t.Errorf("expected items to be gone after the rollback, got %v", err)
+	}
+	if _, err := insert.Exec(5, "bob", 0); err != nil {
+		t.Errorf("expected the insert to run after the rollback, got %v", err)
+	}
+
+	// The cache keeps the most recently used statements.
+	for i := 0; i < DEFAULT_STATEMENT_CACHE_SIZE+10; i++ {
+		db.Exec(fmt.Sprintf("select * from users where id = %d", i))
+	}
+	if db.cache.Len() != DEFAULT_STATEMENT_CACHE_SIZE {
+		t.Errorf("expected the cache to hold %d statements, got %d", DEFAULT_STATEMENT_CACHE_SIZE, db.cache.Len())
+	}
+}
+
+// Readers scan a table while a writer inserts into it, splitting pages and
+// checkpointing the log under them. Every scan has to see the rows of whole
+// commits, and never fewer than the scan before it. Run with -race.
+func Test_concurrent_readers(t *testing.T) {
+	for _, mode := range []struct {
+		name        string
+		journalMode int
+		numRows     int
+	}{{"wal", JOURNAL_MODE_WAL, 2000}, {"journal", JOURNAL_MODE_DELETE, 200}} {
+		t.Run(mode.name, func(t *testing.T) {
+			db, err := Open(filepath.Join(t.TempDir(), "my.db"), &Options{CachePages: 16, JournalMode: mode.journalMode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec("create table users (id integer, username text)"); err != nil {
+				t.Fatal(err)
+			}
+			insert, err := db.Prepare("insert into users values (?, ?)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := db.Prepare("select count(*) from users where id > ?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			padding := strings.Repeat("x", 200)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for id := 1; id <= mode.numRows; id++ {
+					if _, err := insert.Exec(id, fmt.Sprintf("user%d %s", id, padding)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			var readers sync.WaitGroup
+			for reader := 0; reader < 4; reader++ {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					seen := 0
+					for finished := false; !finished; {
+						select {
+						case <-done:
+							finished = true
+						default:
+						}
+						n, err := scanIds(db.Query("select id from users"))
+						if err != nil || n < seen {
+							t.Errorf("saw %d rows after %d, %v", n, seen, err)
+							return
+						}
+						seen = n
+
+						rows, err := count.Query(0)
+						var counted int
+						if err == nil && rows.Next() {
+							err = rows.Scan(&counted)
+						}
+						if err != nil || counted < seen {
+							t.Errorf("counted %d rows after %d, %v", counted, seen, err)
+							return
+						}
+					}
+				}()
+			}
+			readers.Wait()
+
+			if n, err := scanIds(db.Query("select id from users")); err != nil || n != mode.numRows {
+				t.Errorf("expected %d rows, got %d, %v", mode.numRows, n, err)
+			}
+			// Readers only hold a checkpoint off for so long.
+			var stats strings.Builder
+			db.WriteStats(&stats)
+			walFrames := statsReports(strings.Split(stats.String(), "\n"))[0]["wal frames"]
+			var total, sinceCheckpoint int
+			fmt.Sscanf(walFrames, "%d (%d since checkpoint)", &total, &sinceCheckpoint)
+			if sinceCheckpoint >= engine.WAL_CHECKPOINT_WAIT_FRAMES {
+				t.Errorf("expected the log to have been checkpointed, it has %d frames", sinceCheckpoint)
+			}
+		})
+	}
+}
+
+// scanIds checks that the rows are the ids 1 to n in order and returns n.
+func scanIds(rows *Rows, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		if n++; id != n {
+			return n, fmt.Errorf("expected id %d, got %d", n, id)
+		}
+	}
+	return n, nil
+}
+
+// Connections of the driver read while another one inserts batches of rows
+// in transactions, and only ever see whole batches. Run with -race.
+func Test_concurrent_driver_readers(t *testing.T) {
+	db, err := sql.Open("godb", filepath.Join(t.TempDir(), "my.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table users (id integer)"); err != nil {
+		t.Fatal(err)
+	}
+	const batchSize, numBatches = 10, 50
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for batch := 0; batch < numBatches; batch++ {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 1; i <= batchSize; i++ {
+				if _, err := tx.Exec("insert into users values (?)", batch*batchSize+i); err != nil {
+					t.Error(err)
+					tx.Rollback()
+					return
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			seen := 0
+			for finished := false; !finished; {
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+				rows, err := db.Query("select id from users")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := 0
+				for rows.Next() {
+					var id int
+					rows.Scan(&id)
+					if n++; id != n {
+						t.Errorf("expected id %d, got %d", n, id)
+					}
+				}
+				rows.Close()
+				if n%batchSize != 0 || n < seen {
+					t.Errorf("saw %d rows after %d", n, seen)
+					return
+				}
+				seen = n
+			}
+		}()
+	}
+	readers.Wait()
+
+	var n int
+	if err := db.QueryRow("select count(*) from users").Scan(&n); err != nil || n != batchSize*numBatches {
+		t.Errorf("expected %d rows, got %d, %v", batchSize*numBatches, n, err)
+	}
 }